@@ -0,0 +1,148 @@
+package main
+
+// arithmetic and logical operations, in the order of opecode 0x00-0x3D
+// (opecode >> 3) and ModRM reg field of group 1 (0x80-0x83)
+const (
+	aluAdd = iota
+	aluOr
+	aluAdc
+	aluSbb
+	aluAnd
+	aluSub
+	aluXor
+	aluCmp
+)
+
+// calculate v1 op v2 of size bits, and update eflags
+func (e *Emulator) alu(op uint8, v1, v2 uint32, size uint8) uint32 {
+	var carry uint32
+	if (op == aluAdc || op == aluSbb) && e.eflags.isEnable(CarryFlag) {
+		carry = 1
+	}
+
+	var result uint32
+	switch op {
+	case aluAdd, aluAdc:
+		result = (v1 + v2 + carry) & sizeMask(size)
+		e.eflags.updateByAddition(v1, v2, carry, result, size)
+	case aluSub, aluSbb, aluCmp:
+		result = (v1 - v2 - carry) & sizeMask(size)
+		e.eflags.updateBySubtraction(v1, v2, carry, result, size)
+	case aluOr:
+		result = v1 | v2
+		e.eflags.updateByLogical(result, size)
+	case aluAnd:
+		result = v1 & v2
+		e.eflags.updateByLogical(result, size)
+	case aluXor:
+		result = v1 ^ v2
+		e.eflags.updateByLogical(result, size)
+	}
+	return result
+}
+
+// r/m = r/m op r (or only update eflags for CMP)
+func (e *Emulator) aluRm8R8(inst *Instruction) {
+	m := inst.modrm
+	op := uint8(inst.opecode >> 3)
+	result := e.alu(op, uint32(e.getRm8(m)), uint32(e.getR8(m)), 8)
+	if op != aluCmp {
+		e.setRm8(m, uint8(result))
+	}
+}
+
+func (e *Emulator) aluRmR(inst *Instruction) {
+	m := inst.modrm
+	op := uint8(inst.opecode >> 3)
+	if inst.opsize == 16 {
+		result := e.alu(op, uint32(e.getRm16(m)), uint32(e.getR16(m)), 16)
+		if op != aluCmp {
+			e.setRm16(m, uint16(result))
+		}
+	} else {
+		result := e.alu(op, e.getRm32(m), e.getR32(m), 32)
+		if op != aluCmp {
+			e.setRm32(m, result)
+		}
+	}
+}
+
+// r = r op r/m
+func (e *Emulator) aluR8Rm8(inst *Instruction) {
+	m := inst.modrm
+	op := uint8(inst.opecode >> 3)
+	result := e.alu(op, uint32(e.getR8(m)), uint32(e.getRm8(m)), 8)
+	if op != aluCmp {
+		e.setR8(m, uint8(result))
+	}
+}
+
+func (e *Emulator) aluRRm(inst *Instruction) {
+	m := inst.modrm
+	op := uint8(inst.opecode >> 3)
+	if inst.opsize == 16 {
+		result := e.alu(op, uint32(e.getR16(m)), uint32(e.getRm16(m)), 16)
+		if op != aluCmp {
+			e.setR16(m, uint16(result))
+		}
+	} else {
+		result := e.alu(op, e.getR32(m), e.getRm32(m), 32)
+		if op != aluCmp {
+			e.setR32(m, result)
+		}
+	}
+}
+
+// AL = AL op imm8
+func (e *Emulator) aluAlImm8(inst *Instruction) {
+	op := uint8(inst.opecode >> 3)
+	result := e.alu(op, uint32(e.getRegister8(AL)), inst.imm, 8)
+	if op != aluCmp {
+		e.setRegister8(AL, uint8(result))
+	}
+}
+
+// eAX = eAX op imm16/32
+func (e *Emulator) aluEaxImm(inst *Instruction) {
+	op := uint8(inst.opecode >> 3)
+	if inst.opsize == 16 {
+		result := e.alu(op, uint32(e.getRegister16(AX)), inst.imm, 16)
+		if op != aluCmp {
+			e.setRegister16(AX, uint16(result))
+		}
+	} else {
+		result := e.alu(op, e.getRegister32(EAX), inst.imm, 32)
+		if op != aluCmp {
+			e.setRegister32(EAX, result)
+		}
+	}
+}
+
+// group 1: r/m8 = r/m8 op imm8 (0x80, 0x82)
+func (e *Emulator) aluRm8Imm8(inst *Instruction) {
+	m := inst.modrm
+	result := e.alu(m.opecode, uint32(e.getRm8(m)), inst.imm, 8)
+	if m.opecode != aluCmp {
+		e.setRm8(m, uint8(result))
+	}
+}
+
+// group 1: r/m = r/m op imm16/32 (0x81), or sign-extended imm8 (0x83)
+func (e *Emulator) aluRmImm(inst *Instruction) {
+	m := inst.modrm
+	imm := inst.imm
+	if inst.opecode == 0x83 {
+		imm = uint32(int8(imm))
+	}
+	if inst.opsize == 16 {
+		result := e.alu(m.opecode, uint32(e.getRm16(m)), imm&0xFFFF, 16)
+		if m.opecode != aluCmp {
+			e.setRm16(m, uint16(result))
+		}
+	} else {
+		result := e.alu(m.opecode, e.getRm32(m), imm, 32)
+		if m.opecode != aluCmp {
+			e.setRm32(m, result)
+		}
+	}
+}
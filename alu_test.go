@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+)
+
+// execute one instruction with registers and eflags, then return the emulator
+func execOne(t *testing.T, code []byte, protectedEnable bool, eflags uint32, registers map[uint8]uint32) *Emulator {
+	e := newTestEmulator(code, protectedEnable)
+	e.eflags = NewEflags(eflags)
+	for reg, value := range registers {
+		e.setRegister32(reg, value)
+	}
+	if err := e.execInst(); err != nil {
+		t.Fatalf("code=% x: %v", code, err)
+	}
+	if e.eip != 0x7c00+uint32(len(code)) {
+		t.Fatalf("code=% x: eip=0x%x", code, e.eip)
+	}
+	return e
+}
+
+func TestALU(t *testing.T) {
+	const flagMask = CarryFlag | ParityFlag | ZeroFlag | SignFlag | OverflowFlag
+	tests := []struct {
+		name   string
+		code   []byte
+		real   bool // 16bit mode
+		eflags uint32
+		eax    uint32
+		ecx    uint32
+		result uint32 // EAX after execution
+		flags  uint32
+	}{
+		{"add eax, ecx", []byte{0x01, 0xC8}, false, 0, 0xFFFFFFFF, 1, 0, CarryFlag | ZeroFlag | ParityFlag},
+		{"add eax, ecx", []byte{0x01, 0xC8}, false, 0, 0x7FFFFFFF, 1, 0x80000000, SignFlag | OverflowFlag | ParityFlag},
+		{"add al, cl", []byte{0x00, 0xC8}, false, 0, 0x12345680, 0x80, 0x12345600, CarryFlag | ZeroFlag | ParityFlag | OverflowFlag},
+		{"add ah, cl", []byte{0x00, 0xCC}, false, 0, 0x00000100, 0x01, 0x00000200, 0},
+		{"add ax, cx", []byte{0x66, 0x01, 0xC8}, false, 0, 0x1234FFFF, 0x0002, 0x12340001, CarryFlag},
+		{"adc eax, ecx", []byte{0x11, 0xC8}, false, CarryFlag, 1, 2, 4, 0},
+		{"adc eax, ecx", []byte{0x11, 0xC8}, false, CarryFlag, 0xFFFFFFFF, 0, 0, CarryFlag | ZeroFlag | ParityFlag},
+		{"adc ax, 0xffff", []byte{0x15, 0xFF, 0xFF}, true, CarryFlag, 0x00010001, 0, 0x00010001, CarryFlag},
+		{"sub eax, ecx", []byte{0x29, 0xC8}, false, 0, 1, 2, 0xFFFFFFFF, CarryFlag | SignFlag | ParityFlag},
+		{"sub eax, ecx", []byte{0x29, 0xC8}, false, 0, 0x80000000, 1, 0x7FFFFFFF, OverflowFlag | ParityFlag},
+		{"sbb eax, ecx", []byte{0x19, 0xC8}, false, CarryFlag, 0, 0xFFFFFFFF, 0, CarryFlag | ZeroFlag | ParityFlag},
+		{"sbb al, 1", []byte{0x1C, 0x01}, false, CarryFlag, 0x00000002, 0, 0, ZeroFlag | ParityFlag},
+		{"sub eax, 5", []byte{0x2D, 0x05, 0, 0, 0}, false, 0, 7, 0, 2, 0},
+		{"cmp eax, ecx", []byte{0x39, 0xC8}, false, 0, 3, 3, 3, ZeroFlag | ParityFlag},
+		{"cmp ecx, eax", []byte{0x3B, 0xC8}, false, 0, 4, 3, 4, CarryFlag | SignFlag | ParityFlag},
+		{"and eax, ecx", []byte{0x21, 0xC8}, false, CarryFlag | OverflowFlag, 0xF0F0, 0x0FF0, 0x00F0, ParityFlag},
+		{"or al, cl", []byte{0x08, 0xC8}, false, 0, 0x1200, 0x80, 0x1280, SignFlag},
+		{"xor eax, eax", []byte{0x31, 0xC0}, false, 0, 0x1234, 0, 0, ZeroFlag | ParityFlag},
+		{"xor ax, ax", []byte{0x31, 0xC0}, true, 0, 0x12341234, 0, 0x12340000, ZeroFlag | ParityFlag},
+		{"or cl, al", []byte{0x0A, 0xC8}, false, 0, 0x01, 0x02, 0x01, ParityFlag},
+		{"add eax, -1", []byte{0x83, 0xC0, 0xFF}, false, 0, 1, 0, 0, CarryFlag | ZeroFlag | ParityFlag},
+		{"sub ax, -1", []byte{0x66, 0x83, 0xE8, 0xFF}, false, 0, 0xFFFF, 0, 0, ZeroFlag | ParityFlag},
+		{"adc eax, 0x10", []byte{0x81, 0xD0, 0x10, 0, 0, 0}, false, CarryFlag, 1, 0, 0x12, ParityFlag},
+		{"sbb al, 0x10", []byte{0x80, 0xD8, 0x10}, false, CarryFlag, 0x20, 0, 0x0F, ParityFlag},
+		{"xor al, 0xff", []byte{0x34, 0xFF}, false, 0, 0x0F, 0, 0xF0, SignFlag | ParityFlag},
+		{"and ax, 0xff00", []byte{0x25, 0x00, 0xFF}, true, 0, 0xFFFF, 0, 0xFF00, SignFlag | ParityFlag},
+	}
+
+	for _, test := range tests {
+		e := execOne(t, test.code, !test.real, test.eflags, map[uint8]uint32{EAX: test.eax, ECX: test.ecx})
+		if e.getRegister32(EAX) != test.result {
+			t.Fatalf("%s: EAX=0x%x expected=0x%x", test.name, e.getRegister32(EAX), test.result)
+		}
+		if e.eflags.get()&flagMask != test.flags {
+			t.Fatalf("%s: eflags=0x%x expected=0x%x", test.name, e.eflags.get()&flagMask, test.flags)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"io"
+)
+
+// I/O ports of the primary ATA controller
+const (
+	ataData        = 0x1F0
+	ataError       = 0x1F1 // read: error, write: features
+	ataSectorCount = 0x1F2
+	ataLBALow      = 0x1F3
+	ataLBAMid      = 0x1F4
+	ataLBAHigh     = 0x1F5
+	ataDevice      = 0x1F6 // drive select and LBA 24-27
+	ataCommand     = 0x1F7 // read: status, write: command
+	ataControl     = 0x3F6 // read: alternate status, write: device control
+)
+
+// IRQ of the primary ATA controller
+const ataIRQ = 14
+
+// bits of the status register
+const (
+	ataBSY  = 0x80 // busy, never seen because commands complete immediately
+	ataDRDY = 0x40 // drive ready
+	ataDF   = 0x20 // drive fault
+	ataDSC  = 0x10 // seek complete
+	ataDRQ  = 0x08 // data request
+	ataERR  = 0x01 // error
+)
+
+// bits of the error register
+const (
+	ataABRT = 0x04 // command aborted
+	ataIDNF = 0x10 // sector not found
+)
+
+// bits of the device and the device control register
+const (
+	ataDeviceSlave = 0x10 // device: drive 1 is selected
+	ataDeviceLBA   = 0x40 // device: LBA addressing
+	ataNIEN        = 0x02 // device control: IRQ is disabled
+	ataSRST        = 0x04 // device control: software reset
+)
+
+// ATA commands
+const (
+	ataCmdReadSectors  = 0x20
+	ataCmdReadRetry    = 0x21
+	ataCmdWriteSectors = 0x30
+	ataCmdWriteRetry   = 0x31
+	ataCmdFlushCache   = 0xE7
+	ataCmdIdentify     = 0xEC
+)
+
+// ATA is the primary ATA (IDE) controller in PIO mode. The master and the
+// slave drive are disks[0] and disks[1], and the drive without the disk is not
+// present. Commands complete immediately, and IRQ14 is raised when the data is
+// ready or the command has finished.
+type ATA struct {
+	disks *[10]BlockDevice
+	irq   IRQLines
+
+	// task file
+	error       uint8
+	features    uint8
+	sectorCount uint8
+	lbaLow      uint8
+	lbaMid      uint8
+	lbaHigh     uint8
+	device      uint8
+	status      uint8
+	control     uint8
+
+	// PIO data transfer
+	command   uint8 // command which transfers the data
+	buffer    [SectorSize]byte
+	index     int    // position of the next data in buffer
+	lba       uint32 // sector in buffer
+	remaining uint32 // sectors to be transferred, including buffer
+}
+
+// NewATA returns the controller of disks, which raises IRQ14 on irq
+func NewATA(disks *[10]BlockDevice, irq IRQLines) *ATA {
+	return &ATA{disks: disks, irq: irq, status: ataDRDY | ataDSC}
+}
+
+// the disk of the selected drive, nil if it is not present
+func (a *ATA) disk() BlockDevice {
+	if a.device&ataDeviceSlave != 0 {
+		return a.disks[1]
+	}
+	return a.disks[0]
+}
+
+// In reads the register of the selected drive
+func (a *ATA) In(port uint16, size uint8) uint32 {
+	if a.disk() == nil {
+		return 0
+	}
+	switch port {
+	case ataData:
+		return a.readData(size)
+	case ataError:
+		return uint32(a.error)
+	case ataSectorCount:
+		return uint32(a.sectorCount)
+	case ataLBALow:
+		return uint32(a.lbaLow)
+	case ataLBAMid:
+		return uint32(a.lbaMid)
+	case ataLBAHigh:
+		return uint32(a.lbaHigh)
+	case ataDevice:
+		return uint32(a.device)
+	case ataCommand:
+		// reading the status acknowledges the interrupt
+		a.irq.LowerIRQ(ataIRQ)
+		return uint32(a.status)
+	case ataControl:
+		return uint32(a.status)
+	}
+	return 0
+}
+
+// Out writes the register, or starts the command
+func (a *ATA) Out(port uint16, size uint8, value uint32) {
+	switch port {
+	case ataData:
+		a.writeData(size, value)
+	case ataError:
+		a.features = uint8(value)
+	case ataSectorCount:
+		a.sectorCount = uint8(value)
+	case ataLBALow:
+		a.lbaLow = uint8(value)
+	case ataLBAMid:
+		a.lbaMid = uint8(value)
+	case ataLBAHigh:
+		a.lbaHigh = uint8(value)
+	case ataDevice:
+		a.device = uint8(value)
+	case ataCommand:
+		if a.disk() != nil {
+			a.execute(uint8(value))
+		}
+	case ataControl:
+		a.control = uint8(value)
+		if a.control&ataSRST != 0 {
+			a.command = 0
+			a.error = 0
+			a.status = ataDRDY | ataDSC
+		}
+	}
+}
+
+// LBA28 address in the task file. CHS addressing is not supported, and the
+// registers are always taken as LBA.
+func (a *ATA) taskLBA() uint32 {
+	return uint32(a.device&0xF)<<24 | uint32(a.lbaHigh)<<16 | uint32(a.lbaMid)<<8 | uint32(a.lbaLow)
+}
+
+func (a *ATA) execute(command uint8) {
+	a.error = 0
+	a.status = ataDRDY | ataDSC
+	switch command {
+	case ataCmdReadSectors, ataCmdReadRetry, ataCmdWriteSectors, ataCmdWriteRetry:
+		a.command = command
+		a.lba = a.taskLBA()
+		a.remaining = uint32(a.sectorCount)
+		if a.remaining == 0 {
+			a.remaining = 256
+		}
+		a.index = 0
+		if command == ataCmdWriteSectors || command == ataCmdWriteRetry {
+			// the first sector is requested without the interrupt
+			a.status |= ataDRQ
+			return
+		}
+		a.readSector()
+	case ataCmdFlushCache:
+		if err := a.disk().Flush(); err != nil {
+			a.abort(ataABRT)
+			return
+		}
+		a.interrupt()
+	case ataCmdIdentify:
+		a.command = command
+		a.identify()
+		a.index = 0
+		a.remaining = 1
+		a.status |= ataDRQ
+		a.interrupt()
+	default:
+		a.abort(ataABRT)
+	}
+}
+
+// finish the command with the error
+func (a *ATA) abort(err uint8) {
+	a.command = 0
+	a.error = err
+	a.status = ataDRDY | ataDSC | ataERR
+	a.interrupt()
+}
+
+func (a *ATA) interrupt() {
+	if a.control&ataNIEN == 0 {
+		a.irq.RaiseIRQ(ataIRQ)
+	}
+}
+
+// read the sector at lba into buffer, and request the transfer to the host
+func (a *ATA) readSector() {
+	a.buffer = [SectorSize]byte{}
+	if n, err := a.disk().ReadAt(a.buffer[:], int64(a.lba)*SectorSize); n == 0 || (err != nil && err != io.EOF) {
+		// the last sector of the image may be short
+		a.abort(ataIDNF)
+		return
+	}
+	a.index = 0
+	a.status |= ataDRQ
+	a.interrupt()
+}
+
+// write buffer to the sector at lba
+func (a *ATA) writeSector() bool {
+	if int64(a.lba)*SectorSize >= a.disk().Size() {
+		a.abort(ataIDNF)
+		return false
+	}
+	if _, err := a.disk().WriteAt(a.buffer[:], int64(a.lba)*SectorSize); err != nil {
+		a.abort(ataABRT)
+		return false
+	}
+	return true
+}
+
+// transfer size bits of the data from buffer to the host
+func (a *ATA) readData(size uint8) uint32 {
+	if a.status&ataDRQ == 0 || a.command == ataCmdWriteSectors || a.command == ataCmdWriteRetry {
+		return 0
+	}
+	var value uint32
+	for i := uint8(0); i < size/8 && a.index < SectorSize; i++ {
+		value |= uint32(a.buffer[a.index]) << (i * 8)
+		a.index++
+	}
+	if a.index < SectorSize {
+		return value
+	}
+
+	// the sector has been transferred
+	a.status &^= ataDRQ
+	a.remaining--
+	if a.remaining == 0 {
+		a.command = 0
+		return value
+	}
+	a.lba++
+	a.readSector()
+	return value
+}
+
+// transfer size bits of the data from the host to buffer
+func (a *ATA) writeData(size uint8, value uint32) {
+	if a.status&ataDRQ == 0 || (a.command != ataCmdWriteSectors && a.command != ataCmdWriteRetry) {
+		return
+	}
+	for i := uint8(0); i < size/8 && a.index < SectorSize; i++ {
+		a.buffer[a.index] = uint8(value >> (i * 8))
+		a.index++
+	}
+	if a.index < SectorSize {
+		return
+	}
+
+	// the sector has been transferred
+	a.status &^= ataDRQ
+	if !a.writeSector() {
+		return
+	}
+	a.remaining--
+	a.lba++
+	a.index = 0
+	if a.remaining == 0 {
+		a.command = 0
+	} else {
+		a.status |= ataDRQ
+	}
+	a.interrupt()
+}
+
+// build the IDENTIFY DEVICE data of the selected drive
+func (a *ATA) identify() {
+	size := a.disk().Size()
+	sectors := uint32((size + SectorSize - 1) / SectorSize)
+	if sectors > 1<<28-1 {
+		sectors = 1<<28 - 1
+	}
+
+	var words [SectorSize / 2]uint16
+	words[0] = 0x0040 // fixed drive
+	words[1] = 16383  // cylinders
+	words[3] = 16     // heads
+	words[6] = 63     // sectors per track
+	putString := func(first int, s string, length int) {
+		// two characters per word, the first one is in the upper byte
+		b := []byte(s)
+		for len(b) < length*2 {
+			b = append(b, ' ')
+		}
+		for i := 0; i < length; i++ {
+			words[first+i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+		}
+	}
+	putString(10, "TINYX86EMU", 10)       // serial number
+	putString(23, "1.0", 4)               // firmware revision
+	putString(27, "TINY X86 EMU ATA", 20) // model number
+	words[49] = 0x0200                    // LBA is supported
+	words[60] = uint16(sectors)
+	words[61] = uint16(sectors >> 16)
+
+	for i, w := range words {
+		a.buffer[2*i] = uint8(w)
+		a.buffer[2*i+1] = uint8(w >> 8)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// irqRecorder records the levels of the IRQ lines
+type irqRecorder struct {
+	lines  [16]bool
+	raised int
+}
+
+func (r *irqRecorder) RaiseIRQ(irq uint8) {
+	r.lines[irq] = true
+	r.raised++
+}
+
+func (r *irqRecorder) LowerIRQ(irq uint8) {
+	r.lines[irq] = false
+}
+
+func TestATA(t *testing.T) {
+	var disks [10]BlockDevice
+	data := make([]byte, 8*SectorSize)
+	for i := range data {
+		data[i] = uint8(i / SectorSize)
+	}
+	disks[1] = NewMemoryDisk(data)
+	irq := &irqRecorder{}
+	a := NewATA(&disks, irq)
+
+	// disk 0 is not present, disk 1 is present
+	if a.In(ataCommand, 8) != 0 {
+		t.Fatal("disk 0 must not be present")
+	}
+	a.Out(ataDevice, 8, 0xE0|ataDeviceSlave)
+	if status := a.In(ataCommand, 8); status&(ataBSY|ataDRDY) != ataDRDY {
+		t.Fatalf("status=0x%x", status)
+	}
+
+	// read sectors 2-3
+	for _, w := range [][2]uint32{{ataControl, 0}, {ataSectorCount, 2}, {ataLBALow, 2}, {ataLBAMid, 0}, {ataLBAHigh, 0}, {ataDevice, 0xE0 | ataDeviceSlave}, {ataCommand, ataCmdReadSectors}} {
+		a.Out(uint16(w[0]), 8, w[1])
+	}
+	for sector := uint8(2); sector < 4; sector++ {
+		if !irq.lines[ataIRQ] || a.In(ataCommand, 8)&ataDRQ == 0 || irq.lines[ataIRQ] {
+			t.Fatalf("sector %d: DRQ and IRQ14 must be set", sector)
+		}
+		for i := 0; i < SectorSize/4; i++ {
+			if v := a.In(ataData, 32); v != uint32(sector)*0x01010101 {
+				t.Fatalf("sector %d: data=0x%x", sector, v)
+			}
+		}
+	}
+	if a.In(ataCommand, 8) != ataDRDY|ataDSC {
+		t.Fatalf("status=0x%x", a.In(ataCommand, 8))
+	}
+
+	// write sector 5 with 16bit accesses
+	for _, w := range [][2]uint32{{ataSectorCount, 1}, {ataLBALow, 5}, {ataCommand, ataCmdWriteSectors}} {
+		a.Out(uint16(w[0]), 8, w[1])
+	}
+	if a.In(ataCommand, 8)&ataDRQ == 0 {
+		t.Fatal("DRQ must be set for the data")
+	}
+	for i := 0; i < SectorSize/2; i++ {
+		a.Out(ataData, 16, 0xABCD)
+	}
+	if !irq.lines[ataIRQ] || a.In(ataCommand, 8) != ataDRDY|ataDSC {
+		t.Fatalf("status=0x%x", a.In(ataCommand, 8))
+	}
+	if !bytes.Equal(data[5*SectorSize:5*SectorSize+4], []byte{0xCD, 0xAB, 0xCD, 0xAB}) || data[6*SectorSize] != 6 {
+		t.Fatalf("sector 5=%v", data[5*SectorSize:5*SectorSize+4])
+	}
+
+	// IDENTIFY: the number of the LBA28 sectors
+	a.Out(ataCommand, 8, ataCmdIdentify)
+	var identify [SectorSize / 2]uint16
+	for i := range identify {
+		identify[i] = uint16(a.In(ataData, 16))
+	}
+	if identify[49]&0x200 == 0 || identify[60] != 8 || identify[61] != 0 || identify[27] != 'T'<<8|'I' {
+		t.Fatalf("identify=%v", identify[:62])
+	}
+
+	// unknown command, and out of the disk
+	a.Out(ataCommand, 8, 0xFF)
+	if a.In(ataCommand, 8)&ataERR == 0 || a.In(ataError, 8) != ataABRT {
+		t.Fatalf("status=0x%x error=0x%x", a.In(ataCommand, 8), a.In(ataError, 8))
+	}
+	a.Out(ataLBALow, 8, 100)
+	a.Out(ataCommand, 8, ataCmdReadSectors)
+	if a.In(ataCommand, 8)&ataERR == 0 || a.In(ataError, 8) != ataIDNF {
+		t.Fatalf("status=0x%x error=0x%x", a.In(ataCommand, 8), a.In(ataError, 8))
+	}
+
+	// no interrupt while nIEN is set
+	raised := irq.raised
+	a.Out(ataControl, 8, ataNIEN)
+	a.Out(ataLBALow, 8, 0)
+	a.Out(ataCommand, 8, ataCmdReadSectors)
+	if irq.raised != raised || a.In(ataControl, 8)&ataDRQ == 0 {
+		t.Fatal("IRQ14 must not be raised")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+)
+
+// MMIODevice is a device mapped to a range of the physical address space.
+// offset is from the base address of the range, and size is the width of the
+// access in bits (8, 16 or 32).
+type MMIODevice interface {
+	Read(offset uint32, size uint8) uint32
+	Write(offset uint32, size uint8, value uint32)
+}
+
+type mmioRegion struct {
+	base   uint32
+	size   uint32
+	device MMIODevice
+}
+
+// Bus is the physical address space. RAM is at address 0, and the devices
+// are registered over it. Writes to the other addresses are dropped, and
+// reads from them return all ones.
+type Bus struct {
+	memory  []uint8 // RAM
+	regions []mmioRegion
+}
+
+// NewBus returns the bus which has memory as RAM
+func NewBus(memory []uint8) Bus {
+	return Bus{memory: memory}
+}
+
+// Register maps the device to size bytes from base, which may hide RAM
+func (b *Bus) Register(base, size uint32, device MMIODevice) error {
+	for _, r := range b.regions {
+		if base < r.base+r.size && r.base < base+size {
+			return fmt.Errorf("MMIO 0x%x-0x%x overlaps 0x%x-0x%x", base, base+size-1, r.base, r.base+r.size-1)
+		}
+	}
+	b.regions = append(b.regions, mmioRegion{base, size, device})
+	return nil
+}
+
+// the region which paddr is in, or nil
+func (b *Bus) region(paddr uint32) *mmioRegion {
+	for i := range b.regions {
+		if paddr-b.regions[i].base < b.regions[i].size {
+			return &b.regions[i]
+		}
+	}
+	return nil
+}
+
+// whether the access of size bits at paddr is partly in a region, which is
+// split into bytes
+func (b *Bus) straddles(paddr uint32, size uint8) bool {
+	return size > 8 && b.region(paddr) != b.region(paddr+uint32(size/8)-1)
+}
+
+// whether RAM is at paddr
+func (b *Bus) ram(paddr uint32) bool {
+	return paddr < uint32(len(b.memory))
+}
+
+// read size bits at the physical address
+func (b *Bus) read(paddr uint32, size uint8) uint32 {
+	if b.straddles(paddr, size) {
+		var ret uint32
+		for i := uint32(0); i < uint32(size/8); i++ {
+			ret |= b.read(paddr+i, 8) << (i * 8)
+		}
+		return ret
+	}
+	if r := b.region(paddr); r != nil {
+		return r.device.Read(paddr-r.base, size)
+	}
+	var ret uint32
+	for i := uint32(0); i < uint32(size/8); i++ {
+		v := uint8(0xFF) // nothing is at the address
+		if b.ram(paddr + i) {
+			v = b.memory[paddr+i]
+		}
+		ret |= uint32(v) << (i * 8)
+	}
+	return ret
+}
+
+// write size bits at the physical address
+func (b *Bus) write(paddr uint32, size uint8, value uint32) {
+	if b.straddles(paddr, size) {
+		for i := uint32(0); i < uint32(size/8); i++ {
+			b.write(paddr+i, 8, value>>(i*8)&0xFF)
+		}
+		return
+	}
+	if r := b.region(paddr); r != nil {
+		r.device.Write(paddr-r.base, size, value)
+		return
+	}
+	for i := uint32(0); i < uint32(size/8); i++ {
+		if b.ram(paddr + i) {
+			b.memory[paddr+i] = uint8(value >> (i * 8))
+		}
+	}
+}
+
+// read size bits at offset from the device which has 32bit registers
+func readRegister32(read32 func(uint32) uint32, offset uint32, size uint8) uint32 {
+	return read32(offset&^3) >> (offset & 3 * 8) & sizeMask(size)
+}
+
+// write size bits at offset to the device which has 32bit registers, the
+// other bits of the register are not changed
+func writeRegister32(read32 func(uint32) uint32, write32 func(uint32, uint32), offset uint32, size uint8, value uint32) {
+	if size == 32 {
+		write32(offset&^3, value)
+		return
+	}
+	shift := offset & 3 * 8
+	mask := sizeMask(size) << shift
+	write32(offset&^3, read32(offset&^3)&^mask|value<<shift&mask)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+)
+
+// testDevice records the last access
+type testDevice struct {
+	offset uint32
+	size   uint8
+	value  uint32
+}
+
+func (d *testDevice) Read(offset uint32, size uint8) uint32 {
+	d.offset, d.size = offset, size
+	return d.value
+}
+
+func (d *testDevice) Write(offset uint32, size uint8, value uint32) {
+	d.offset, d.size, d.value = offset, size, value
+}
+
+func TestBus(t *testing.T) {
+	e := newTestEmulator([]byte{}, true)
+	d := &testDevice{}
+	if err := e.bus.Register(0xD0000, 0x100, d); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.bus.Register(0xD00F0, 0x100, d); err == nil {
+		t.Fatal("overlapped region must not be registered")
+	}
+
+	// the device hides RAM
+	e.setMemory16(0xD0010, 0x1234)
+	if d.offset != 0x10 || d.size != 16 || d.value != 0x1234 || e.memory[0xD0010] != 0 {
+		t.Fatalf("device=%+v", *d)
+	}
+	d.value = 0x5678
+	if v := e.getMemory8(0xD0020); v != 0x78 || d.offset != 0x20 || d.size != 8 {
+		t.Fatalf("value=0x%x device=%+v", v, *d)
+	}
+
+	// RAM
+	e.setMemory32(0xD0100, 0x12345678)
+	if e.memory[0xD0100] != 0x78 || e.getMemory32(0xD0100) != 0x12345678 {
+		t.Fatalf("memory=0x%x", e.getMemory32(0xD0100))
+	}
+
+	// the access across the end of the device is split into bytes
+	e.setMemory32(0xD00FE, 0x12345678)
+	if d.offset != 0xFF || d.size != 8 || d.value != 0x56 || e.memory[0xD0100] != 0x34 || e.memory[0xD0101] != 0x12 {
+		t.Fatalf("device=%+v memory=0x%x", *d, e.getMemory16(0xD0100))
+	}
+	d.value = 0xAB
+	if v := e.getMemory32(0xD00FE); v != 0x1234ABAB || d.offset != 0xFF || d.size != 8 {
+		t.Fatalf("value=0x%x device=%+v", v, *d)
+	}
+
+	// nothing beyond RAM and in DEVSPACE, writes are dropped and reads are
+	// all ones
+	for _, paddr := range []uint32{PHYSTOP, 0x80108400, DEVSPACE} {
+		e.setMemory32(paddr, 0x12345678)
+		if v := e.getMemory32(paddr); v != 0xFFFFFFFF {
+			t.Fatalf("0x%x=0x%x", paddr, v)
+		}
+	}
+	e.setMemory32(PHYSTOP-2, 0x12345678)
+	if v := e.getMemory32(PHYSTOP - 2); v != 0xFFFF5678 {
+		t.Fatalf("0x%x=0x%x", PHYSTOP-2, v)
+	}
+	if v := e.getMemory16(PHYSTOP); v != 0xFFFF {
+		t.Fatalf("0x%x=0x%x", PHYSTOP, v)
+	}
+
+	// 32bit registers of APIC by bytes
+	e.setMemory8(LocalAPICBase+lapicTPR+1, 0x12)
+	e.setMemory8(LocalAPICBase+lapicTPR, 0x30)
+	if e.lapic.tpr != 0x30 || e.getMemory8(LocalAPICBase+lapicID+3) != 1 {
+		t.Fatalf("tpr=0x%x id=0x%x", e.lapic.tpr, e.getMemory8(LocalAPICBase+lapicID+3))
+	}
+}
+
+func TestBusPageCrossing(t *testing.T) {
+	e := newTestEmulator([]byte{}, true)
+
+	// 0x1000-0x1fff is mapped to 0x5000, and 0x2000-0x2fff to 0x3000
+	e.writePhysical32(0x10000, 0x11000|PagePresent|PageWrite)
+	for i := uint32(0); i < 1024; i++ {
+		e.writePhysical32(0x11000+4*i, i<<12|PagePresent|PageWrite)
+	}
+	e.writePhysical32(0x11000+4*1, 0x5000|PagePresent|PageWrite)
+	e.writePhysical32(0x11000+4*2, 0x3000|PagePresent|PageWrite)
+	e.cr[3] = 0x10000
+	e.cr[0] |= CR0PagingFlag
+
+	e.setMemory32(0x1FFE, 0x12345678)
+	if e.readPhysical32(0x5FFC)>>16 != 0x5678 || e.readPhysical32(0x3000)&0xFFFF != 0x1234 {
+		t.Fatalf("0x5ffc=0x%x 0x3000=0x%x", e.readPhysical32(0x5FFC), e.readPhysical32(0x3000))
+	}
+	if e.getMemory32(0x1FFE) != 0x12345678 {
+		t.Fatalf("value=0x%x", e.getMemory32(0x1FFE))
+	}
+}
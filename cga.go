@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// memory and I/O ports of the CGA text mode
+const (
+	cgaBase    = 0xB8000
+	cgaSize    = 0x8000
+	cgaColumns = 80
+	cgaRows    = 25
+
+	crtcIndex = 0x3D4 // index of the CRT controller register
+	crtcData  = 0x3D5 // CRT controller register selected by the index
+	cgaStatus = 0x3DA // read: status
+)
+
+// registers of the CRT controller
+const (
+	crtcStartHigh  = 0x0C // start address of the screen, in characters
+	crtcStartLow   = 0x0D
+	crtcCursorHigh = 0x0E // cursor location, in characters
+	crtcCursorLow  = 0x0F
+	crtcRegisters  = 0x12
+)
+
+// ANSI colors of the CGA colors 0-7
+var cgaANSIColors = [8]uint8{0, 4, 2, 6, 1, 5, 3, 7}
+
+// CGA is the 80x25 color text mode. Each character is a pair of the code and
+// the attribute, whose lower 4 bits are the foreground color and upper 4 bits
+// are the background color.
+type CGA struct {
+	memory    [cgaSize]byte
+	index     uint8
+	registers [crtcRegisters]uint8
+	retrace   bool // toggled by reading the status
+	dirty     bool // the screen is changed since Render
+}
+
+// NewCGA returns the blank screen
+func NewCGA() *CGA {
+	return &CGA{dirty: true}
+}
+
+// Read reads the memory
+func (c *CGA) Read(offset uint32, size uint8) uint32 {
+	var ret uint32
+	for i := uint32(0); i < uint32(size/8) && offset+i < cgaSize; i++ {
+		ret |= uint32(c.memory[offset+i]) << (i * 8)
+	}
+	return ret
+}
+
+// Write writes the memory
+func (c *CGA) Write(offset uint32, size uint8, value uint32) {
+	for i := uint32(0); i < uint32(size/8) && offset+i < cgaSize; i++ {
+		c.memory[offset+i] = uint8(value >> (i * 8))
+	}
+	c.dirty = true
+}
+
+// fill the screen with the spaces in light gray, and move the cursor to the
+// top left
+func (c *CGA) clear() {
+	for i := 0; i < cgaSize; i += 2 {
+		c.memory[i], c.memory[i+1] = ' ', 0x07
+	}
+	for _, r := range []uint8{crtcStartHigh, crtcStartLow, crtcCursorHigh, crtcCursorLow} {
+		c.registers[r] = 0
+	}
+	c.dirty = true
+}
+
+// In reads the CRT controller or the status
+func (c *CGA) In(port uint16, size uint8) uint32 {
+	switch port {
+	case crtcIndex:
+		return uint32(c.index)
+	case crtcData:
+		if c.index < crtcRegisters {
+			return uint32(c.registers[c.index])
+		}
+	case cgaStatus:
+		// the vertical retrace and the display disable alternate
+		c.retrace = !c.retrace
+		if c.retrace {
+			return 0x09
+		}
+	}
+	return 0
+}
+
+// Out writes the CRT controller
+func (c *CGA) Out(port uint16, size uint8, value uint32) {
+	switch port {
+	case crtcIndex:
+		c.index = uint8(value)
+		if size == 16 {
+			// the index and the data at once
+			c.Out(crtcData, 8, value>>8)
+		}
+	case crtcData:
+		if c.index < crtcRegisters {
+			c.registers[c.index] = uint8(value)
+			c.dirty = true
+		}
+	}
+}
+
+// the CRT controller register pair in characters
+func (c *CGA) register16(high uint8) int {
+	return int(c.registers[high])<<8 | int(c.registers[high+1])
+}
+
+// Cursor returns the position of the cursor on the screen
+func (c *CGA) Cursor() (row, column int) {
+	pos := c.register16(crtcCursorHigh) - c.register16(crtcStartHigh)
+	return pos / cgaColumns, pos % cgaColumns
+}
+
+// the code and the attribute of the character on the screen
+func (c *CGA) cell(row, column int) (code, attribute uint8) {
+	i := (c.register16(crtcStartHigh) + row*cgaColumns + column) * 2 % cgaSize
+	return c.memory[i], c.memory[i+1]
+}
+
+// the printable character of the code
+func cgaRune(code uint8) rune {
+	if code < 0x20 {
+		return ' '
+	}
+	if code > 0x7E {
+		return '?'
+	}
+	return rune(code)
+}
+
+// Text returns the screen as lines of the characters without the attributes.
+// The trailing spaces of the lines are removed.
+func (c *CGA) Text() string {
+	lines := make([]string, cgaRows)
+	for row := range lines {
+		var line strings.Builder
+		for column := 0; column < cgaColumns; column++ {
+			code, _ := c.cell(row, column)
+			line.WriteRune(cgaRune(code))
+		}
+		lines[row] = strings.TrimRight(line.String(), " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Dirty returns whether the screen is changed since Render
+func (c *CGA) Dirty() bool {
+	return c.dirty
+}
+
+// Render draws the screen on the ANSI terminal, and moves the cursor
+func (c *CGA) Render(w io.Writer) error {
+	c.dirty = false
+	b := bufio.NewWriter(w)
+	b.WriteString("\x1b[H")
+	last := -1
+	for row := 0; row < cgaRows; row++ {
+		for column := 0; column < cgaColumns; column++ {
+			code, attribute := c.cell(row, column)
+			if int(attribute) != last {
+				// bright foreground is 90-97, bit 7 of the background blinks
+				fg := 30 + int(cgaANSIColors[attribute&7])
+				if attribute&8 != 0 {
+					fg += 60
+				}
+				fmt.Fprintf(b, "\x1b[0;%d;%dm", fg, 40+int(cgaANSIColors[attribute>>4&7]))
+				last = int(attribute)
+			}
+			b.WriteRune(cgaRune(code))
+		}
+		b.WriteString("\x1b[0m")
+		if row < cgaRows-1 {
+			b.WriteString("\r\n")
+		}
+		last = -1
+	}
+	row, column := c.Cursor()
+	fmt.Fprintf(b, "\x1b[%d;%dH", row+1, column+1)
+	return b.Flush()
+}
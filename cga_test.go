@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// put the string at the position in the same way as cgaputc() of xv6
+func putCGA(e *Emulator, pos int, s string, attribute uint8) {
+	for i, c := range []byte(s) {
+		e.setMemory16(cgaBase+uint32(pos+i)*2, uint16(attribute)<<8|uint16(c))
+	}
+	pos += len(s)
+	e.io.out8(crtcIndex, crtcCursorHigh)
+	e.io.out8(crtcData, uint8(pos>>8))
+	e.io.out8(crtcIndex, crtcCursorLow)
+	e.io.out8(crtcData, uint8(pos))
+}
+
+func TestCGA(t *testing.T) {
+	e := newTestEmulator([]byte{}, false)
+	putCGA(e, 0, "$ ls", 0x07)
+	putCGA(e, cgaColumns, "README", 0x1E)
+
+	if e.memory[cgaBase] != 0 {
+		t.Fatal("RAM must be hidden")
+	}
+	if v := e.getMemory16(cgaBase + 2); v != 0x0720 {
+		t.Fatalf("memory=0x%x", v)
+	}
+	e.io.out8(crtcIndex, crtcCursorLow)
+	if pos := e.io.in8(crtcData); pos != cgaColumns+6 {
+		t.Fatalf("cursor=%d", pos)
+	}
+	if row, column := e.cga.Cursor(); row != 1 || column != 6 {
+		t.Fatalf("cursor=(%d, %d)", row, column)
+	}
+	if text := e.cga.Text(); text != "$ ls\nREADME"+strings.Repeat("\n", cgaRows-2) {
+		t.Fatalf("text=%q", text)
+	}
+
+	// scroll by the start address
+	e.io.out16(crtcIndex, cgaColumns<<8|crtcStartLow)
+	if text := e.cga.Text(); !strings.HasPrefix(text, "README\n\n") {
+		t.Fatalf("text=%q", text)
+	}
+	if row, column := e.cga.Cursor(); row != 0 || column != 6 {
+		t.Fatalf("cursor=(%d, %d)", row, column)
+	}
+}
+
+func TestCGARender(t *testing.T) {
+	c := NewCGA()
+	for i, v := range []uint16{0x0741, 0x0742, 0x1E43} {
+		c.Write(uint32(i*2), 16, uint32(v))
+	}
+	if !c.Dirty() {
+		t.Fatal("screen must be dirty")
+	}
+	out := &bytes.Buffer{}
+	if err := c.Render(out); err != nil {
+		t.Fatal(err)
+	}
+	if c.Dirty() {
+		t.Fatal("screen must not be dirty after Render")
+	}
+	// light gray on black, then yellow on blue
+	if s := out.String(); !strings.HasPrefix(s, "\x1b[H\x1b[0;37;40mAB\x1b[0;93;44mC\x1b[0;30;40m ") || !strings.HasSuffix(s, "\x1b[1;1H") {
+		t.Fatalf("output=%q", s)
+	}
+	if n := strings.Count(out.String(), "\r\n"); n != cgaRows-1 {
+		t.Fatalf("%d lines", n)
+	}
+}
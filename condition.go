@@ -0,0 +1,88 @@
+package main
+
+// condition codes, the lower 4 bits of Jcc, SETcc and CMOVcc opecodes
+const (
+	ccO  = iota // overflow
+	ccNO        // not overflow
+	ccB         // below (carry)
+	ccAE        // above or equal (not carry)
+	ccE         // equal (zero)
+	ccNE        // not equal (not zero)
+	ccBE        // below or equal
+	ccA         // above
+	ccS         // sign
+	ccNS        // not sign
+	ccP         // parity even
+	ccNP        // parity odd
+	ccL         // less
+	ccGE        // greater or equal
+	ccLE        // less or equal
+	ccG         // greater
+)
+
+// evaluate the condition code by eflags
+func (ef *Eflags) condition(cc uint8) bool {
+	var result bool
+	switch cc &^ 1 {
+	case ccO:
+		result = ef.isEnable(OverflowFlag)
+	case ccB:
+		result = ef.isEnable(CarryFlag)
+	case ccE:
+		result = ef.isEnable(ZeroFlag)
+	case ccBE:
+		result = ef.isEnable(CarryFlag) || ef.isEnable(ZeroFlag)
+	case ccS:
+		result = ef.isEnable(SignFlag)
+	case ccP:
+		result = ef.isEnable(ParityFlag)
+	case ccL:
+		result = ef.isEnable(SignFlag) != ef.isEnable(OverflowFlag)
+	case ccLE:
+		result = ef.isEnable(ZeroFlag) || ef.isEnable(SignFlag) != ef.isEnable(OverflowFlag)
+	}
+	// odd condition codes are negated
+	return result != (cc&1 != 0)
+}
+
+// jcc rel8 (0x70-0x7F), jcc rel16/32 (0x0F 0x80-0x8F)
+func (e *Emulator) jcc(inst *Instruction) {
+	if !e.eflags.condition(uint8(inst.opecode & 0xF)) {
+		return
+	}
+	rel := inst.imm
+	if inst.opecode < 0x0F00 {
+		rel = uint32(int8(rel))
+	} else if inst.opsize == 16 {
+		rel = uint32(int16(rel))
+	}
+	e.eip += rel
+	if inst.opsize == 16 {
+		e.eip &= 0xFFFF
+	}
+}
+
+// setcc r/m8 (0x0F 0x90-0x9F)
+func (e *Emulator) setcc(inst *Instruction) {
+	if e.eflags.condition(uint8(inst.opecode & 0xF)) {
+		e.setRm8(inst.modrm, 1)
+	} else {
+		e.setRm8(inst.modrm, 0)
+	}
+}
+
+// cmovcc r, r/m (0x0F 0x40-0x4F)
+func (e *Emulator) cmovcc(inst *Instruction) {
+	m := inst.modrm
+	if inst.opsize == 16 {
+		value := e.getRm16(m)
+		if e.eflags.condition(uint8(inst.opecode & 0xF)) {
+			e.setR16(m, value)
+		}
+	} else {
+		value := e.getRm32(m)
+		if e.eflags.condition(uint8(inst.opecode & 0xF)) {
+			e.setR32(m, value)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCondition(t *testing.T) {
+	e := newTestEmulator(nil, true)
+	run := func(code []byte, flags uint32) {
+		copy(e.memory[0x7c00:], code)
+		e.eip = 0x7c00
+		e.eflags = NewEflags(flags)
+		e.setRegister32(EAX, 0)
+		e.setRegister32(ECX, 0x12345678)
+		if err := e.execInst(); err != nil {
+			t.Fatalf("code=% x: %v", code, err)
+		}
+	}
+
+	// every combination of CF, PF, ZF, SF and OF
+	for i := uint32(0); i < 32; i++ {
+		cf, pf, zf, sf, of := i&1 != 0, i&2 != 0, i&4 != 0, i&8 != 0, i&16 != 0
+		var flags uint32
+		for j, flag := range []uint32{CarryFlag, ParityFlag, ZeroFlag, SignFlag, OverflowFlag} {
+			if i&(1<<uint32(j)) != 0 {
+				flags |= flag
+			}
+		}
+		expected := [16]bool{
+			ccO:  of,
+			ccNO: !of,
+			ccB:  cf,
+			ccAE: !cf,
+			ccE:  zf,
+			ccNE: !zf,
+			ccBE: cf || zf,
+			ccA:  !cf && !zf,
+			ccS:  sf,
+			ccNS: !sf,
+			ccP:  pf,
+			ccNP: !pf,
+			ccL:  sf != of,
+			ccGE: sf == of,
+			ccLE: zf || sf != of,
+			ccG:  !zf && sf == of,
+		}
+
+		for cc := uint8(0); cc < 16; cc++ {
+			ef := NewEflags(flags)
+			if ef.condition(cc) != expected[cc] {
+				t.Fatalf("eflags=0x%x cc=%d: %v", flags, cc, ef.condition(cc))
+			}
+
+			// jcc rel8, jcc rel32, setcc al, cmovcc eax, ecx
+			run([]byte{0x70 + cc, 0x10}, flags)
+			if (e.eip == 0x7c12) != expected[cc] {
+				t.Fatalf("j%d rel8 eflags=0x%x: eip=0x%x", cc, flags, e.eip)
+			}
+			run([]byte{0x0F, 0x80 + cc, 0x00, 0x01, 0x00, 0x00}, flags)
+			if (e.eip == 0x7d06) != expected[cc] {
+				t.Fatalf("j%d rel32 eflags=0x%x: eip=0x%x", cc, flags, e.eip)
+			}
+			run([]byte{0x0F, 0x90 + cc, 0xC0}, flags)
+			if (e.getRegister32(EAX) == 1) != expected[cc] {
+				t.Fatalf("set%d eflags=0x%x: eax=0x%x", cc, flags, e.getRegister32(EAX))
+			}
+			run([]byte{0x0F, 0x40 + cc, 0xC1}, flags)
+			if (e.getRegister32(EAX) == 0x12345678) != expected[cc] {
+				t.Fatalf("cmov%d eflags=0x%x: eax=0x%x", cc, flags, e.getRegister32(EAX))
+			}
+		}
+	}
+}
+
+func TestJccBackward(t *testing.T) {
+	// jge -2 (0x7D is JGE, not JC)
+	e := newTestEmulator([]byte{0x7D, 0xFE}, true)
+	e.eflags = NewEflags(CarryFlag)
+	e.execInst()
+	if e.eip != 0x7c00 {
+		t.Fatalf("eip=0x%x", e.eip)
+	}
+
+	// jne rel16 in 16bit mode
+	e = newTestEmulator([]byte{0x0F, 0x85, 0xFC, 0xFF}, false)
+	e.execInst()
+	if e.eip != 0x7c00 {
+		t.Fatalf("eip=0x%x", e.eip)
+	}
+
+	// jmp rel16 and jmp rel8 in 16bit mode
+	for _, code := range [][]byte{{0xE9, 0xFD, 0xFF}, {0xEB, 0xFE}} {
+		e = newTestEmulator(code, false)
+		e.execInst()
+		if e.eip != 0x7c00 {
+			t.Fatalf("code=% x: eip=0x%x", code, e.eip)
+		}
+	}
+
+	// IP wraps around in 16bit mode
+	e = newTestEmulator([]byte{}, false)
+	e.eip = 0xFFF0
+	e.memory[0xFFF0], e.memory[0xFFF1], e.memory[0xFFF2] = 0xE9, 0x10, 0x00
+	e.execInst()
+	if e.eip != 0x0003 {
+		t.Fatalf("eip=0x%x", e.eip)
+	}
+}
@@ -0,0 +1,624 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Instruction prefixes
+const (
+	prefixOperandSize = 1 << iota // 0x66
+	prefixAddressSize             // 0x67
+	prefixLock                    // 0xF0
+	prefixRepne                   // 0xF2
+	prefixRep                     // 0xF3 (REP/REPE)
+	prefixSegment                 // 0x26, 0x2E, 0x36, 0x3E, 0x64, 0x65
+)
+
+// segment override prefixes
+var segmentPrefixes = map[uint8]uint8{
+	0x26: ES,
+	0x2E: CS,
+	0x36: SS,
+	0x3E: DS,
+	0x64: FS,
+	0x65: GS,
+}
+
+// kinds of immediate operand which follow opecode (and ModRM)
+const (
+	immNone = iota
+	immB    // 8bit
+	immW    // 16bit
+	immZ    // 16bit or 32bit (depends on operand size)
+	immP    // far pointer, 16bit or 32bit offset and 16bit selector
+	immO    // memory offset, 16bit or 32bit (depends on address size)
+)
+
+// opecode attributes
+const (
+	fModRM      = 1 << iota // ModRM byte follows opecode
+	fString                 // string instruction, repeated by REP prefix
+	fRepCond                // REPE/REPNE also terminates by ZF (cmps, scas)
+	fPrivileged             // only in ring 0, #GP(0) otherwise
+	fMemory                 // ModRM must be a memory operand, #UD otherwise
+)
+
+// opecode is an entry of the opecode tables
+type opecode struct {
+	name  string
+	flags uint8
+	imm   uint8
+	exec  func(e *Emulator, inst *Instruction)
+	group *[8]opecode // selected by ModRM reg field
+}
+
+// Instruction is a decoded instruction at eip
+type Instruction struct {
+	eip      uint32   // address of the first byte (including prefixes)
+	length   uint32   // total length in bytes
+	prefix   uint8    // set of prefixXxx
+	segment  uint8    // segment of memory operand without ModRM (DS unless overridden)
+	opecode  uint16   // 0x00-0xFF, or 0x0F00-0x0FFF for two-byte opecodes
+	opsize   uint8    // operand size, 16 or 32
+	addrsize uint8    // address size, 16 or 32
+	modrm    ModRM    // valid only if op has fModRM
+	imm      uint32   // first immediate operand
+	imm2     uint32   // second immediate operand (selector of far pointer)
+	op       *opecode // table entry to execute
+}
+
+// UnsupportedOpcodeError is returned by execInst when the opecode tables have
+// no entry for the instruction at eip.
+type UnsupportedOpcodeError struct {
+	EIP     uint32 // address of the instruction
+	Opecode uint16 // 0x00-0xFF, or 0x0F00-0x0FFF for two-byte opecodes
+	Reg     int    // ModRM reg field for group opecodes, otherwise -1
+	Opsize  uint8  // operand size
+}
+
+func (err *UnsupportedOpcodeError) Error() string {
+	s := fmt.Sprintf("eip=0x%x opecode = %x", err.EIP, err.Opecode)
+	if err.Reg >= 0 {
+		s += fmt.Sprintf(" /%d", err.Reg)
+	}
+	if err.Opsize == 16 {
+		s += " (16bit)"
+	}
+	return s + " is not implemented"
+}
+
+// one-byte opecode table
+var oneByteOpecodes = [256]opecode{
+	0x00: {"add", fModRM, immNone, (*Emulator).aluRm8R8, nil},
+	0x01: {"add", fModRM, immNone, (*Emulator).aluRmR, nil},
+	0x02: {"add", fModRM, immNone, (*Emulator).aluR8Rm8, nil},
+	0x03: {"add", fModRM, immNone, (*Emulator).aluRRm, nil},
+	0x04: {"add", 0, immB, (*Emulator).aluAlImm8, nil},
+	0x05: {"add", 0, immZ, (*Emulator).aluEaxImm, nil},
+	0x08: {"or", fModRM, immNone, (*Emulator).aluRm8R8, nil},
+	0x09: {"or", fModRM, immNone, (*Emulator).aluRmR, nil},
+	0x0A: {"or", fModRM, immNone, (*Emulator).aluR8Rm8, nil},
+	0x0B: {"or", fModRM, immNone, (*Emulator).aluRRm, nil},
+	0x0C: {"or", 0, immB, (*Emulator).aluAlImm8, nil},
+	0x0D: {"or", 0, immZ, (*Emulator).aluEaxImm, nil},
+	0x10: {"adc", fModRM, immNone, (*Emulator).aluRm8R8, nil},
+	0x11: {"adc", fModRM, immNone, (*Emulator).aluRmR, nil},
+	0x12: {"adc", fModRM, immNone, (*Emulator).aluR8Rm8, nil},
+	0x13: {"adc", fModRM, immNone, (*Emulator).aluRRm, nil},
+	0x14: {"adc", 0, immB, (*Emulator).aluAlImm8, nil},
+	0x15: {"adc", 0, immZ, (*Emulator).aluEaxImm, nil},
+	0x18: {"sbb", fModRM, immNone, (*Emulator).aluRm8R8, nil},
+	0x19: {"sbb", fModRM, immNone, (*Emulator).aluRmR, nil},
+	0x1A: {"sbb", fModRM, immNone, (*Emulator).aluR8Rm8, nil},
+	0x1B: {"sbb", fModRM, immNone, (*Emulator).aluRRm, nil},
+	0x1C: {"sbb", 0, immB, (*Emulator).aluAlImm8, nil},
+	0x1D: {"sbb", 0, immZ, (*Emulator).aluEaxImm, nil},
+	0x20: {"and", fModRM, immNone, (*Emulator).aluRm8R8, nil},
+	0x21: {"and", fModRM, immNone, (*Emulator).aluRmR, nil},
+	0x22: {"and", fModRM, immNone, (*Emulator).aluR8Rm8, nil},
+	0x23: {"and", fModRM, immNone, (*Emulator).aluRRm, nil},
+	0x24: {"and", 0, immB, (*Emulator).aluAlImm8, nil},
+	0x25: {"and", 0, immZ, (*Emulator).aluEaxImm, nil},
+	0x28: {"sub", fModRM, immNone, (*Emulator).aluRm8R8, nil},
+	0x29: {"sub", fModRM, immNone, (*Emulator).aluRmR, nil},
+	0x2A: {"sub", fModRM, immNone, (*Emulator).aluR8Rm8, nil},
+	0x2B: {"sub", fModRM, immNone, (*Emulator).aluRRm, nil},
+	0x2C: {"sub", 0, immB, (*Emulator).aluAlImm8, nil},
+	0x2D: {"sub", 0, immZ, (*Emulator).aluEaxImm, nil},
+	0x30: {"xor", fModRM, immNone, (*Emulator).aluRm8R8, nil},
+	0x31: {"xor", fModRM, immNone, (*Emulator).aluRmR, nil},
+	0x32: {"xor", fModRM, immNone, (*Emulator).aluR8Rm8, nil},
+	0x33: {"xor", fModRM, immNone, (*Emulator).aluRRm, nil},
+	0x34: {"xor", 0, immB, (*Emulator).aluAlImm8, nil},
+	0x35: {"xor", 0, immZ, (*Emulator).aluEaxImm, nil},
+	0x38: {"cmp", fModRM, immNone, (*Emulator).aluRm8R8, nil},
+	0x39: {"cmp", fModRM, immNone, (*Emulator).aluRmR, nil},
+	0x3A: {"cmp", fModRM, immNone, (*Emulator).aluR8Rm8, nil},
+	0x3B: {"cmp", fModRM, immNone, (*Emulator).aluRRm, nil},
+	0x3C: {"cmp", 0, immB, (*Emulator).aluAlImm8, nil},
+	0x3D: {"cmp", 0, immZ, (*Emulator).aluEaxImm, nil},
+	0x40: {"inc", 0, immNone, (*Emulator).incR32, nil},
+	0x41: {"inc", 0, immNone, (*Emulator).incR32, nil},
+	0x42: {"inc", 0, immNone, (*Emulator).incR32, nil},
+	0x43: {"inc", 0, immNone, (*Emulator).incR32, nil},
+	0x44: {"inc", 0, immNone, (*Emulator).incR32, nil},
+	0x45: {"inc", 0, immNone, (*Emulator).incR32, nil},
+	0x46: {"inc", 0, immNone, (*Emulator).incR32, nil},
+	0x47: {"inc", 0, immNone, (*Emulator).incR32, nil},
+	0x48: {"dec", 0, immNone, (*Emulator).decR32, nil},
+	0x49: {"dec", 0, immNone, (*Emulator).decR32, nil},
+	0x4A: {"dec", 0, immNone, (*Emulator).decR32, nil},
+	0x4B: {"dec", 0, immNone, (*Emulator).decR32, nil},
+	0x4C: {"dec", 0, immNone, (*Emulator).decR32, nil},
+	0x4D: {"dec", 0, immNone, (*Emulator).decR32, nil},
+	0x4E: {"dec", 0, immNone, (*Emulator).decR32, nil},
+	0x4F: {"dec", 0, immNone, (*Emulator).decR32, nil},
+	0x50: {"push", 0, immNone, (*Emulator).pushR32, nil},
+	0x51: {"push", 0, immNone, (*Emulator).pushR32, nil},
+	0x52: {"push", 0, immNone, (*Emulator).pushR32, nil},
+	0x53: {"push", 0, immNone, (*Emulator).pushR32, nil},
+	0x54: {"push", 0, immNone, (*Emulator).pushR32, nil},
+	0x55: {"push", 0, immNone, (*Emulator).pushR32, nil},
+	0x56: {"push", 0, immNone, (*Emulator).pushR32, nil},
+	0x57: {"push", 0, immNone, (*Emulator).pushR32, nil},
+	0x58: {"pop", 0, immNone, (*Emulator).popR32, nil},
+	0x59: {"pop", 0, immNone, (*Emulator).popR32, nil},
+	0x5A: {"pop", 0, immNone, (*Emulator).popR32, nil},
+	0x5B: {"pop", 0, immNone, (*Emulator).popR32, nil},
+	0x5C: {"pop", 0, immNone, (*Emulator).popR32, nil},
+	0x5D: {"pop", 0, immNone, (*Emulator).popR32, nil},
+	0x5E: {"pop", 0, immNone, (*Emulator).popR32, nil},
+	0x5F: {"pop", 0, immNone, (*Emulator).popR32, nil},
+	0x68: {"push", 0, immZ, (*Emulator).pushImm, nil},
+	0x69: {"imul", fModRM, immZ, (*Emulator).imulRRmImm, nil},
+	0x6A: {"push", 0, immB, (*Emulator).pushImm8, nil},
+	0x6B: {"imul", fModRM, immB, (*Emulator).imulRRmImm, nil},
+	0x6C: {"insb", fString, immNone, (*Emulator).ins, nil},
+	0x6D: {"ins", fString, immNone, (*Emulator).ins, nil},
+	0x6E: {"outsb", fString, immNone, (*Emulator).outs, nil},
+	0x6F: {"outs", fString, immNone, (*Emulator).outs, nil},
+	0x70: {"jo", 0, immB, (*Emulator).jcc, nil},
+	0x71: {"jno", 0, immB, (*Emulator).jcc, nil},
+	0x72: {"jb", 0, immB, (*Emulator).jcc, nil},
+	0x73: {"jae", 0, immB, (*Emulator).jcc, nil},
+	0x74: {"je", 0, immB, (*Emulator).jcc, nil},
+	0x75: {"jne", 0, immB, (*Emulator).jcc, nil},
+	0x76: {"jbe", 0, immB, (*Emulator).jcc, nil},
+	0x77: {"ja", 0, immB, (*Emulator).jcc, nil},
+	0x78: {"js", 0, immB, (*Emulator).jcc, nil},
+	0x79: {"jns", 0, immB, (*Emulator).jcc, nil},
+	0x7A: {"jp", 0, immB, (*Emulator).jcc, nil},
+	0x7B: {"jnp", 0, immB, (*Emulator).jcc, nil},
+	0x7C: {"jl", 0, immB, (*Emulator).jcc, nil},
+	0x7D: {"jge", 0, immB, (*Emulator).jcc, nil},
+	0x7E: {"jle", 0, immB, (*Emulator).jcc, nil},
+	0x7F: {"jg", 0, immB, (*Emulator).jcc, nil},
+	0x80: {"grp1", fModRM, immNone, nil, &group80},
+	0x81: {"grp1", fModRM, immNone, nil, &group81},
+	0x82: {"grp1", fModRM, immNone, nil, &group80},
+	0x83: {"grp1", fModRM, immNone, nil, &group83},
+	0x84: {"test", fModRM, immNone, (*Emulator).testRm8R8, nil},
+	0x85: {"test", fModRM, immNone, (*Emulator).testRm32R32, nil},
+	0x87: {"xchg", fModRM, immNone, (*Emulator).xchg, nil},
+	0x88: {"mov", fModRM, immNone, (*Emulator).movRm8R8, nil},
+	0x89: {"mov", fModRM, immNone, (*Emulator).movRm32R32, nil},
+	0x8A: {"mov", fModRM, immNone, (*Emulator).movR8Rm8, nil},
+	0x8B: {"mov", fModRM, immNone, (*Emulator).movR32Rm32, nil},
+	0x8D: {"lea", fModRM | fMemory, immNone, (*Emulator).leaR32Rm32, nil},
+	0x8E: {"mov", fModRM, immNone, (*Emulator).movSregRm16, nil},
+	0x90: {"nop", 0, immNone, (*Emulator).nop, nil},
+	0x9C: {"pushf", 0, immNone, (*Emulator).pushf, nil},
+	0x9D: {"popf", 0, immNone, (*Emulator).popf, nil},
+	0xA1: {"mov", 0, immO, (*Emulator).movEaxMoffs32, nil},
+	0xA3: {"mov", 0, immO, (*Emulator).movMoffs32Eax, nil},
+	0xA4: {"movsb", fString, immNone, (*Emulator).movs, nil},
+	0xA5: {"movs", fString, immNone, (*Emulator).movs, nil},
+	0xA6: {"cmpsb", fString | fRepCond, immNone, (*Emulator).cmps, nil},
+	0xA7: {"cmps", fString | fRepCond, immNone, (*Emulator).cmps, nil},
+	0xA8: {"test", 0, immB, (*Emulator).testAlImm8, nil},
+	0xA9: {"test", 0, immZ, (*Emulator).testEaxImm, nil},
+	0xAA: {"stosb", fString, immNone, (*Emulator).stos, nil},
+	0xAB: {"stos", fString, immNone, (*Emulator).stos, nil},
+	0xAC: {"lodsb", fString, immNone, (*Emulator).lods, nil},
+	0xAD: {"lods", fString, immNone, (*Emulator).lods, nil},
+	0xAE: {"scasb", fString | fRepCond, immNone, (*Emulator).scas, nil},
+	0xAF: {"scas", fString | fRepCond, immNone, (*Emulator).scas, nil},
+	0xB0: {"mov", 0, immB, (*Emulator).movR8Imm8, nil},
+	0xB1: {"mov", 0, immB, (*Emulator).movR8Imm8, nil},
+	0xB2: {"mov", 0, immB, (*Emulator).movR8Imm8, nil},
+	0xB3: {"mov", 0, immB, (*Emulator).movR8Imm8, nil},
+	0xB4: {"mov", 0, immB, (*Emulator).movR8Imm8, nil},
+	0xB5: {"mov", 0, immB, (*Emulator).movR8Imm8, nil},
+	0xB6: {"mov", 0, immB, (*Emulator).movR8Imm8, nil},
+	0xB7: {"mov", 0, immB, (*Emulator).movR8Imm8, nil},
+	0xB8: {"mov", 0, immZ, (*Emulator).movRImm, nil},
+	0xB9: {"mov", 0, immZ, (*Emulator).movRImm, nil},
+	0xBA: {"mov", 0, immZ, (*Emulator).movRImm, nil},
+	0xBB: {"mov", 0, immZ, (*Emulator).movRImm, nil},
+	0xBC: {"mov", 0, immZ, (*Emulator).movRImm, nil},
+	0xBD: {"mov", 0, immZ, (*Emulator).movRImm, nil},
+	0xBE: {"mov", 0, immZ, (*Emulator).movRImm, nil},
+	0xBF: {"mov", 0, immZ, (*Emulator).movRImm, nil},
+	0xC0: {"grp2", fModRM, immNone, nil, &groupC0},
+	0xC1: {"grp2", fModRM, immNone, nil, &groupC1},
+	0xC3: {"ret", 0, immNone, (*Emulator).ret, nil},
+	0xC6: {"mov", fModRM, immB, (*Emulator).movRm8Imm8, nil},
+	0xC7: {"mov", fModRM, immZ, (*Emulator).movRm32Imm32, nil},
+	0xC9: {"leave", 0, immNone, (*Emulator).leave, nil},
+	0xCC: {"int3", 0, immNone, (*Emulator).int3, nil},
+	0xCD: {"int", 0, immB, (*Emulator).intImm8, nil},
+	0xCE: {"into", 0, immNone, (*Emulator).into, nil},
+	0xCF: {"iret", 0, immNone, (*Emulator).iret, nil},
+	0xD0: {"grp2", fModRM, immNone, nil, &groupD0},
+	0xD1: {"grp2", fModRM, immNone, nil, &groupD1},
+	0xD2: {"grp2", fModRM, immNone, nil, &groupD0},
+	0xD3: {"grp2", fModRM, immNone, nil, &groupD1},
+	0xE4: {"in", 0, immB, (*Emulator).inAlImm8, nil},
+	0xE5: {"in", 0, immB, (*Emulator).inAxImm8, nil},
+	0xE6: {"out", 0, immB, (*Emulator).outAlImm8, nil},
+	0xE7: {"out", 0, immB, (*Emulator).outAxImm8, nil},
+	0xE8: {"call", 0, immZ, (*Emulator).callRel, nil},
+	0xE9: {"jmp", 0, immZ, (*Emulator).jmpRel32, nil},
+	0xEA: {"jmp", 0, immP, (*Emulator).farJmp, nil},
+	0xEB: {"jmp", 0, immB, (*Emulator).shortJmp, nil},
+	0xEC: {"in", 0, immNone, (*Emulator).inAlDx, nil},
+	0xED: {"in", 0, immNone, (*Emulator).inAxDx, nil},
+	0xEE: {"out", 0, immNone, (*Emulator).outAlDx, nil},
+	0xEF: {"out", 0, immNone, (*Emulator).outAxDx, nil},
+	0xF4: {"hlt", fPrivileged, immNone, (*Emulator).halt, nil},
+	0xF6: {"grp3", fModRM, immNone, nil, &groupF6},
+	0xF7: {"grp3", fModRM, immNone, nil, &groupF7},
+	0xFA: {"cli", 0, immNone, (*Emulator).cli, nil},
+	0xFB: {"sti", 0, immNone, (*Emulator).sti, nil},
+	0xFC: {"cld", 0, immNone, (*Emulator).cld, nil},
+	0xFD: {"std", 0, immNone, (*Emulator).std, nil},
+	0xFF: {"grp5", fModRM, immNone, nil, &groupFF},
+}
+
+// two-byte opecode table (0x0F xx)
+var twoByteOpecodes = [256]opecode{
+	0x00: {"grp6", fModRM, immNone, nil, &group0F00},
+	0x01: {"grp7", fModRM, immNone, nil, &group0F01},
+	0x20: {"mov", fModRM | fPrivileged, immNone, (*Emulator).movR32Cr, nil},
+	0x22: {"mov", fModRM | fPrivileged, immNone, (*Emulator).movCrR32, nil},
+	0x40: {"cmovo", fModRM, immNone, (*Emulator).cmovcc, nil},
+	0x41: {"cmovno", fModRM, immNone, (*Emulator).cmovcc, nil},
+	0x42: {"cmovb", fModRM, immNone, (*Emulator).cmovcc, nil},
+	0x43: {"cmovae", fModRM, immNone, (*Emulator).cmovcc, nil},
+	0x44: {"cmove", fModRM, immNone, (*Emulator).cmovcc, nil},
+	0x45: {"cmovne", fModRM, immNone, (*Emulator).cmovcc, nil},
+	0x46: {"cmovbe", fModRM, immNone, (*Emulator).cmovcc, nil},
+	0x47: {"cmova", fModRM, immNone, (*Emulator).cmovcc, nil},
+	0x48: {"cmovs", fModRM, immNone, (*Emulator).cmovcc, nil},
+	0x49: {"cmovns", fModRM, immNone, (*Emulator).cmovcc, nil},
+	0x4A: {"cmovp", fModRM, immNone, (*Emulator).cmovcc, nil},
+	0x4B: {"cmovnp", fModRM, immNone, (*Emulator).cmovcc, nil},
+	0x4C: {"cmovl", fModRM, immNone, (*Emulator).cmovcc, nil},
+	0x4D: {"cmovge", fModRM, immNone, (*Emulator).cmovcc, nil},
+	0x4E: {"cmovle", fModRM, immNone, (*Emulator).cmovcc, nil},
+	0x4F: {"cmovg", fModRM, immNone, (*Emulator).cmovcc, nil},
+	0x80: {"jo", 0, immZ, (*Emulator).jcc, nil},
+	0x81: {"jno", 0, immZ, (*Emulator).jcc, nil},
+	0x82: {"jb", 0, immZ, (*Emulator).jcc, nil},
+	0x83: {"jae", 0, immZ, (*Emulator).jcc, nil},
+	0x84: {"je", 0, immZ, (*Emulator).jcc, nil},
+	0x85: {"jne", 0, immZ, (*Emulator).jcc, nil},
+	0x86: {"jbe", 0, immZ, (*Emulator).jcc, nil},
+	0x87: {"ja", 0, immZ, (*Emulator).jcc, nil},
+	0x88: {"js", 0, immZ, (*Emulator).jcc, nil},
+	0x89: {"jns", 0, immZ, (*Emulator).jcc, nil},
+	0x8A: {"jp", 0, immZ, (*Emulator).jcc, nil},
+	0x8B: {"jnp", 0, immZ, (*Emulator).jcc, nil},
+	0x8C: {"jl", 0, immZ, (*Emulator).jcc, nil},
+	0x8D: {"jge", 0, immZ, (*Emulator).jcc, nil},
+	0x8E: {"jle", 0, immZ, (*Emulator).jcc, nil},
+	0x8F: {"jg", 0, immZ, (*Emulator).jcc, nil},
+	0x90: {"seto", fModRM, immNone, (*Emulator).setcc, nil},
+	0x91: {"setno", fModRM, immNone, (*Emulator).setcc, nil},
+	0x92: {"setb", fModRM, immNone, (*Emulator).setcc, nil},
+	0x93: {"setae", fModRM, immNone, (*Emulator).setcc, nil},
+	0x94: {"sete", fModRM, immNone, (*Emulator).setcc, nil},
+	0x95: {"setne", fModRM, immNone, (*Emulator).setcc, nil},
+	0x96: {"setbe", fModRM, immNone, (*Emulator).setcc, nil},
+	0x97: {"seta", fModRM, immNone, (*Emulator).setcc, nil},
+	0x98: {"sets", fModRM, immNone, (*Emulator).setcc, nil},
+	0x99: {"setns", fModRM, immNone, (*Emulator).setcc, nil},
+	0x9A: {"setp", fModRM, immNone, (*Emulator).setcc, nil},
+	0x9B: {"setnp", fModRM, immNone, (*Emulator).setcc, nil},
+	0x9C: {"setl", fModRM, immNone, (*Emulator).setcc, nil},
+	0x9D: {"setge", fModRM, immNone, (*Emulator).setcc, nil},
+	0x9E: {"setle", fModRM, immNone, (*Emulator).setcc, nil},
+	0x9F: {"setg", fModRM, immNone, (*Emulator).setcc, nil},
+	0xA4: {"shld", fModRM, immB, (*Emulator).shld, nil},
+	0xA5: {"shld", fModRM, immNone, (*Emulator).shld, nil},
+	0xAC: {"shrd", fModRM, immB, (*Emulator).shrd, nil},
+	0xAD: {"shrd", fModRM, immNone, (*Emulator).shrd, nil},
+	0xAF: {"imul", fModRM, immNone, (*Emulator).imulRRm, nil},
+	0xB6: {"movzx", fModRM, immNone, (*Emulator).movzxR32Rm8, nil},
+	0xB7: {"movzx", fModRM, immNone, (*Emulator).movzxR32Rm16, nil},
+	0xBE: {"movsx", fModRM, immNone, (*Emulator).movsxR32Rm8, nil},
+	0xBF: {"movsx", fModRM, immNone, (*Emulator).movsxR32Rm16, nil},
+}
+
+// ModRM group tables (indexed by ModRM reg field)
+var (
+	group80 = [8]opecode{
+		0: {"add", 0, immB, (*Emulator).aluRm8Imm8, nil},
+		1: {"or", 0, immB, (*Emulator).aluRm8Imm8, nil},
+		2: {"adc", 0, immB, (*Emulator).aluRm8Imm8, nil},
+		3: {"sbb", 0, immB, (*Emulator).aluRm8Imm8, nil},
+		4: {"and", 0, immB, (*Emulator).aluRm8Imm8, nil},
+		5: {"sub", 0, immB, (*Emulator).aluRm8Imm8, nil},
+		6: {"xor", 0, immB, (*Emulator).aluRm8Imm8, nil},
+		7: {"cmp", 0, immB, (*Emulator).aluRm8Imm8, nil},
+	}
+	group81 = [8]opecode{
+		0: {"add", 0, immZ, (*Emulator).aluRmImm, nil},
+		1: {"or", 0, immZ, (*Emulator).aluRmImm, nil},
+		2: {"adc", 0, immZ, (*Emulator).aluRmImm, nil},
+		3: {"sbb", 0, immZ, (*Emulator).aluRmImm, nil},
+		4: {"and", 0, immZ, (*Emulator).aluRmImm, nil},
+		5: {"sub", 0, immZ, (*Emulator).aluRmImm, nil},
+		6: {"xor", 0, immZ, (*Emulator).aluRmImm, nil},
+		7: {"cmp", 0, immZ, (*Emulator).aluRmImm, nil},
+	}
+	group83 = [8]opecode{
+		0: {"add", 0, immB, (*Emulator).aluRmImm, nil},
+		1: {"or", 0, immB, (*Emulator).aluRmImm, nil},
+		2: {"adc", 0, immB, (*Emulator).aluRmImm, nil},
+		3: {"sbb", 0, immB, (*Emulator).aluRmImm, nil},
+		4: {"and", 0, immB, (*Emulator).aluRmImm, nil},
+		5: {"sub", 0, immB, (*Emulator).aluRmImm, nil},
+		6: {"xor", 0, immB, (*Emulator).aluRmImm, nil},
+		7: {"cmp", 0, immB, (*Emulator).aluRmImm, nil},
+	}
+	groupC0 = [8]opecode{
+		0: {"rol", 0, immB, (*Emulator).shiftRm8, nil},
+		1: {"ror", 0, immB, (*Emulator).shiftRm8, nil},
+		2: {"rcl", 0, immB, (*Emulator).shiftRm8, nil},
+		3: {"rcr", 0, immB, (*Emulator).shiftRm8, nil},
+		4: {"shl", 0, immB, (*Emulator).shiftRm8, nil},
+		5: {"shr", 0, immB, (*Emulator).shiftRm8, nil},
+		6: {"sal", 0, immB, (*Emulator).shiftRm8, nil},
+		7: {"sar", 0, immB, (*Emulator).shiftRm8, nil},
+	}
+	groupC1 = [8]opecode{
+		0: {"rol", 0, immB, (*Emulator).shiftRm, nil},
+		1: {"ror", 0, immB, (*Emulator).shiftRm, nil},
+		2: {"rcl", 0, immB, (*Emulator).shiftRm, nil},
+		3: {"rcr", 0, immB, (*Emulator).shiftRm, nil},
+		4: {"shl", 0, immB, (*Emulator).shiftRm, nil},
+		5: {"shr", 0, immB, (*Emulator).shiftRm, nil},
+		6: {"sal", 0, immB, (*Emulator).shiftRm, nil},
+		7: {"sar", 0, immB, (*Emulator).shiftRm, nil},
+	}
+	groupD0 = [8]opecode{ // 0xD0 and 0xD2
+		0: {"rol", 0, immNone, (*Emulator).shiftRm8, nil},
+		1: {"ror", 0, immNone, (*Emulator).shiftRm8, nil},
+		2: {"rcl", 0, immNone, (*Emulator).shiftRm8, nil},
+		3: {"rcr", 0, immNone, (*Emulator).shiftRm8, nil},
+		4: {"shl", 0, immNone, (*Emulator).shiftRm8, nil},
+		5: {"shr", 0, immNone, (*Emulator).shiftRm8, nil},
+		6: {"sal", 0, immNone, (*Emulator).shiftRm8, nil},
+		7: {"sar", 0, immNone, (*Emulator).shiftRm8, nil},
+	}
+	groupD1 = [8]opecode{ // 0xD1 and 0xD3
+		0: {"rol", 0, immNone, (*Emulator).shiftRm, nil},
+		1: {"ror", 0, immNone, (*Emulator).shiftRm, nil},
+		2: {"rcl", 0, immNone, (*Emulator).shiftRm, nil},
+		3: {"rcr", 0, immNone, (*Emulator).shiftRm, nil},
+		4: {"shl", 0, immNone, (*Emulator).shiftRm, nil},
+		5: {"shr", 0, immNone, (*Emulator).shiftRm, nil},
+		6: {"sal", 0, immNone, (*Emulator).shiftRm, nil},
+		7: {"sar", 0, immNone, (*Emulator).shiftRm, nil},
+	}
+	groupF6 = [8]opecode{
+		0: {"test", 0, immB, (*Emulator).testRm8Imm8, nil},
+		2: {"not", 0, immNone, (*Emulator).notRm8, nil},
+		3: {"neg", 0, immNone, (*Emulator).negRm8, nil},
+		4: {"mul", 0, immNone, (*Emulator).mulRm8, nil},
+		5: {"imul", 0, immNone, (*Emulator).imulRm8, nil},
+		6: {"div", 0, immNone, (*Emulator).divRm8, nil},
+		7: {"idiv", 0, immNone, (*Emulator).idivRm8, nil},
+	}
+	groupF7 = [8]opecode{
+		0: {"test", 0, immZ, (*Emulator).testRmImm, nil},
+		2: {"not", 0, immNone, (*Emulator).notRm, nil},
+		3: {"neg", 0, immNone, (*Emulator).negRm, nil},
+		4: {"mul", 0, immNone, (*Emulator).mulRm, nil},
+		5: {"imul", 0, immNone, (*Emulator).imulRm, nil},
+		6: {"div", 0, immNone, (*Emulator).divRm, nil},
+		7: {"idiv", 0, immNone, (*Emulator).idivRm, nil},
+	}
+	groupFF = [8]opecode{
+		0: {"inc", 0, immNone, (*Emulator).incRm32, nil},
+		1: {"dec", 0, immNone, (*Emulator).decRm32, nil},
+		2: {"call", 0, immNone, (*Emulator).callRm32, nil},
+		4: {"jmp", 0, immNone, (*Emulator).jmpRm32, nil},
+		6: {"push", 0, immNone, (*Emulator).pushRm32, nil},
+	}
+	group0F00 = [8]opecode{
+		2: {"lldt", fPrivileged, immNone, (*Emulator).lldt, nil},
+		3: {"ltr", fPrivileged, immNone, (*Emulator).ltrRm16, nil},
+	}
+	group0F01 = [8]opecode{
+		2: {"lgdt", fPrivileged | fMemory, immNone, (*Emulator).lgdt, nil},
+		3: {"lidt", fPrivileged | fMemory, immNone, (*Emulator).lidt, nil},
+		7: {"invlpg", fPrivileged | fMemory, immNone, (*Emulator).invlpg, nil},
+	}
+)
+
+// decoder fetches instruction bytes from eip without changing eip
+type decoder struct {
+	e *Emulator
+	n uint32 // number of fetched bytes
+}
+
+func (d *decoder) fetch8() uint8 {
+	b := d.e.getCode8(int32(d.n))
+	d.n++
+	return b
+}
+
+func (d *decoder) fetch16() uint16 {
+	return uint16(d.fetch8()) | uint16(d.fetch8())<<8
+}
+
+func (d *decoder) fetch32() uint32 {
+	return uint32(d.fetch16()) | uint32(d.fetch16())<<16
+}
+
+func (d *decoder) fetchImm(kind, opsize, addrsize uint8) uint32 {
+	switch kind {
+	case immB:
+		return uint32(d.fetch8())
+	case immW:
+		return uint32(d.fetch16())
+	case immZ, immP:
+		if opsize == 16 {
+			return uint32(d.fetch16())
+		}
+		return d.fetch32()
+	case immO:
+		if addrsize == 16 {
+			return uint32(d.fetch16())
+		}
+		return d.fetch32()
+	}
+	return 0
+}
+
+// decode the instruction at eip into inst
+func (e *Emulator) decode(inst *Instruction) error {
+	d := decoder{e: e}
+	*inst = Instruction{eip: e.eip, segment: DS}
+
+	// prefixes (any combination, in any order)
+	code := d.fetch8()
+prefixes:
+	for {
+		switch code {
+		case 0x26, 0x2E, 0x36, 0x3E, 0x64, 0x65:
+			inst.prefix |= prefixSegment
+			inst.segment = segmentPrefixes[code]
+		case 0x66:
+			inst.prefix |= prefixOperandSize
+		case 0x67:
+			inst.prefix |= prefixAddressSize
+		case 0xF0:
+			inst.prefix |= prefixLock
+		case 0xF2:
+			// the last one of REPNE/REPE is effective
+			inst.prefix = inst.prefix&^prefixRep | prefixRepne
+		case 0xF3:
+			inst.prefix = inst.prefix&^prefixRepne | prefixRep
+		default:
+			break prefixes
+		}
+		code = d.fetch8()
+	}
+
+	inst.opsize, inst.addrsize = 16, 16
+	if e.segments[CS].big {
+		inst.opsize, inst.addrsize = 32, 32
+	}
+	if inst.prefix&prefixOperandSize != 0 {
+		inst.opsize ^= 16 ^ 32
+	}
+	if inst.prefix&prefixAddressSize != 0 {
+		inst.addrsize ^= 16 ^ 32
+	}
+
+	var op *opecode
+	if code == 0x0F {
+		code = d.fetch8()
+		inst.opecode = 0x0F00 | uint16(code)
+		op = &twoByteOpecodes[code]
+	} else {
+		inst.opecode = uint16(code)
+		op = &oneByteOpecodes[code]
+	}
+
+	if op.exec == nil && op.group == nil {
+		return inst.unsupported(-1)
+	}
+
+	if op.flags&fModRM != 0 {
+		inst.modrm = d.modrm(inst.addrsize)
+		if inst.prefix&prefixSegment != 0 {
+			inst.modrm.segment = inst.segment
+		}
+	}
+	if op.group != nil {
+		op = &op.group[inst.modrm.opecode]
+		if op.exec == nil {
+			return inst.unsupported(int(inst.modrm.opecode))
+		}
+	}
+
+	inst.imm = d.fetchImm(op.imm, inst.opsize, inst.addrsize)
+	if op.imm == immP {
+		inst.imm2 = uint32(d.fetch16())
+	}
+	inst.op = op
+	inst.length = d.n
+	return nil
+}
+
+func (inst *Instruction) unsupported(reg int) error {
+	return &UnsupportedOpcodeError{
+		EIP:     inst.eip,
+		Opecode: inst.opecode,
+		Reg:     reg,
+		Opsize:  inst.opsize,
+	}
+}
+
+// load ModR/M, SIB and displacement
+func (d *decoder) modrm(addrsize uint8) ModRM {
+	code := d.fetch8()
+
+	// 76  543                210
+	// mod regIndex(opecode) r/m
+	m := ModRM{
+		mod:       (code >> 6) & 0x03,
+		opecode:   (code >> 3) & 0x07,
+		rm:        code & 0x07,
+		address16: addrsize == 16,
+		segment:   DS,
+	}
+
+	if m.mod == 3 {
+		return m
+	}
+
+	if m.address16 {
+		// 16 bit mode
+		if m.mod == 1 {
+			m.setDisp8(int8(d.fetch8()))
+		} else if m.mod == 2 || (m.mod == 0 && m.rm == 6) {
+			m.setDisp16(int16(d.fetch16()))
+		}
+		// [bp+si], [bp+di] and [bp+disp] are in the stack segment
+		if m.rm == 2 || m.rm == 3 || (m.rm == 6 && m.mod != 0) {
+			m.segment = SS
+		}
+		return m
+	}
+
+	// 32 bit mode
+	if m.rm == 4 {
+		m.sib = d.fetch8()
+	}
+	if m.mod == 2 || (m.mod == 0 && m.rm == 5) || (m.mod == 0 && m.rm == 4 && m.sib&0x7 == 0x5) {
+		// The last condition is [scaled index] + disp32
+		m.disp32 = d.fetch32()
+	} else if m.mod == 1 {
+		m.setDisp8(int8(d.fetch8()))
+	}
+	// [esp+...] and [ebp+disp] are in the stack segment
+	if (m.rm == 5 && m.mod != 0) || (m.rm == 4 && (m.sib&0x7 == 4 || (m.sib&0x7 == 5 && m.mod != 0))) {
+		m.segment = SS
+	}
+	return m
+}
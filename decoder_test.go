@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func newTestEmulator(code []byte, protectedEnable bool) *Emulator {
+	reader := &bytes.Buffer{}
+	writer := &bytes.Buffer{}
+	e := NewEmulator(0x7c00+0x10000, 0x7c00, 0x7c00, protectedEnable, true, reader, writer, map[uint64]string{})
+	for i := 0; i < len(code); i++ {
+		e.memory[uint32(i+0x7c00)] = code[i]
+	}
+	if protectedEnable {
+		// flat segments: 0x08 kernel code, 0x10 kernel data, 0x18 user code, 0x20 user data
+		e.gdtrBase = 0x800
+		e.gdtrSize = 0x27
+		for i, desc := range []uint64{0, 0x00CF9A000000FFFF, 0x00CF92000000FFFF, 0x00CFFA000000FFFF, 0x00CFF2000000FFFF} {
+			setDescriptor(e, 0x800+8*uint32(i), desc)
+		}
+	}
+	return e
+}
+
+// write the segment descriptor at the physical address
+func setDescriptor(e *Emulator, address uint32, desc uint64) {
+	e.writePhysical32(address, uint32(desc))
+	e.writePhysical32(address+4, uint32(desc>>32))
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		code            []byte
+		protectedEnable bool
+		opecode         uint16
+		length          uint32
+		opsize          uint8
+		imm             uint32
+	}{
+		{[]byte{0x90}, true, 0x90, 1, 32, 0},
+		{[]byte{0xB8, 0x78, 0x56, 0x34, 0x12}, true, 0xB8, 5, 32, 0x12345678},
+		{[]byte{0x66, 0xB8, 0x34, 0x12}, true, 0xB8, 4, 16, 0x1234},
+		{[]byte{0xB8, 0x34, 0x12}, false, 0xB8, 3, 16, 0x1234},
+		{[]byte{0x83, 0x45, 0x04, 0xFF}, true, 0x83, 4, 32, 0xFF},                   // add dword [ebp+4], -1
+		{[]byte{0x8D, 0x44, 0x0A, 0xFF}, true, 0x8D, 4, 32, 0},                      // lea eax, [edx+ecx-1]
+		{[]byte{0xC7, 0x05, 1, 0, 0, 0, 2, 0, 0, 0}, true, 0xC7, 10, 32, 2},         // mov dword [1], 2
+		{[]byte{0xF7, 0x04, 0x24, 9, 0, 0, 0}, true, 0xF7, 7, 32, 9},                // test dword [esp], 9
+		{[]byte{0x0F, 0x84, 0x10, 0, 0, 0}, true, 0x0F84, 6, 32, 0x10},              // je rel32
+		{[]byte{0xEA, 0x31, 0x7C, 0x08, 0x00}, false, 0xEA, 5, 16, 0x7C31},          // ljmp $0x8, $0x7c31
+		{[]byte{0x8B, 0x46, 0x02}, false, 0x8B, 3, 16, 0},                           // mov ax, [bp+2]
+		{[]byte{0x8B, 0x36, 0x00, 0x7E}, false, 0x8B, 4, 16, 0},                     // mov si, [0x7e00]
+		{[]byte{0xF3, 0xAB}, true, 0xAB, 2, 32, 0},                                  // rep stosd
+		{[]byte{0x0F, 0x01, 0x16, 0x64, 0x7C}, false, 0x0F01, 5, 16, 0},             // lgdt [0x7c64]
+		{[]byte{0xA1, 0x00, 0x10, 0x00, 0x00}, true, 0xA1, 5, 32, 0x1000},           // mov eax, [0x1000]
+		{[]byte{0x8B, 0x84, 0x88, 0x00, 1, 0, 0}, true, 0x8B, 7, 32, 0},             // mov eax, [eax+ecx*4+0x100]
+		{[]byte{0x8B, 0x04, 0x8D, 0x00, 0x01, 0, 0}, true, 0x8B, 7, 32, 0},          // mov eax, [ecx*4+0x100]
+		{[]byte{0x81, 0xFB, 0x78, 0x56, 0x34, 0x12}, true, 0x81, 6, 32, 0x12345678}, // cmp ebx, 0x12345678
+		{[]byte{0xE5, 0x40}, true, 0xE5, 2, 32, 0x40},                               // in eax, 0x40
+		{[]byte{0x66, 0xE7, 0x40}, true, 0xE7, 3, 16, 0x40},                         // out 0x40, ax
+		{[]byte{0xED}, false, 0xED, 1, 16, 0},                                       // in ax, dx
+		{[]byte{0x66, 0xED}, false, 0xED, 2, 32, 0},                                 // in eax, dx
+		{[]byte{0x9D}, true, 0x9D, 1, 32, 0},                                        // popf
+	}
+
+	for _, test := range tests {
+		e := newTestEmulator(test.code, test.protectedEnable)
+		var inst Instruction
+		if err := e.decode(&inst); err != nil {
+			t.Fatalf("code=% x: %v", test.code, err)
+		}
+		if inst.opecode != test.opecode || inst.length != test.length ||
+			inst.opsize != test.opsize || inst.imm != test.imm {
+			t.Fatalf("code=% x: opecode=%x length=%d opsize=%d imm=0x%x",
+				test.code, inst.opecode, inst.length, inst.opsize, inst.imm)
+		}
+	}
+}
+
+func TestUnsupportedOpcode(t *testing.T) {
+	tests := []struct {
+		code    []byte
+		opecode uint16
+		reg     int
+	}{
+		{[]byte{0xD6}, 0xD6, -1},
+		{[]byte{0x0F, 0x0B}, 0x0F0B, -1},
+		{[]byte{0xFF, 0xF8}, 0xFF, 7},
+	}
+
+	for _, test := range tests {
+		e := newTestEmulator(test.code, true)
+		err := e.execInst()
+		u, ok := err.(*UnsupportedOpcodeError)
+		if !ok {
+			t.Fatalf("code=% x: err=%v", test.code, err)
+		}
+		if u.EIP != 0x7c00 || u.Opecode != test.opecode || u.Reg != test.reg {
+			t.Fatalf("code=% x: %#v", test.code, u)
+		}
+		if e.eip != 0x7c00 {
+			t.Fatalf("code=% x: eip=0x%x", test.code, e.eip)
+		}
+	}
+}
+
+func TestDecodePrefix(t *testing.T) {
+	tests := []struct {
+		code            []byte
+		protectedEnable bool
+		prefix          uint8
+		length          uint32
+		opsize          uint8
+		addrsize        uint8
+		segment         uint8
+	}{
+		{[]byte{0x64, 0x8B, 0x00}, true, prefixSegment, 3, 32, 32, FS},                                 // mov eax, fs:[eax]
+		{[]byte{0x65, 0x66, 0x8B, 0x45, 0x04}, true, prefixSegment | prefixOperandSize, 5, 16, 32, GS}, // mov ax, gs:[ebp+4]
+		{[]byte{0x8B, 0x45, 0x04}, true, 0, 3, 32, 32, SS},                                             // mov eax, [ebp+4]
+		{[]byte{0x8B, 0x04, 0x24}, true, 0, 3, 32, 32, SS},                                             // mov eax, [esp]
+		{[]byte{0x8B, 0x04, 0x8D, 0, 0, 0, 0}, true, 0, 7, 32, 32, DS},                                 // mov eax, [ecx*4]
+		{[]byte{0x67, 0x8B, 0x07}, true, prefixAddressSize, 3, 32, 16, DS},                             // mov eax, [bx]
+		{[]byte{0x67, 0x8B, 0x46, 0x02}, true, prefixAddressSize, 4, 32, 16, SS},                       // mov eax, [bp+2]
+		{[]byte{0x67, 0x8B, 0x00}, false, prefixAddressSize, 3, 16, 32, DS},                            // mov ax, [eax]
+		{[]byte{0x26, 0x67, 0x66, 0x8B, 0x05, 1, 0, 0, 0}, false, prefixSegment | prefixAddressSize | prefixOperandSize, 9, 32, 32, ES},
+		{[]byte{0xF2, 0xAE}, true, prefixRepne, 2, 32, 32, DS},      // repne scasb
+		{[]byte{0xF2, 0xF3, 0xAE}, true, prefixRep, 3, 32, 32, DS},  // the last one wins
+		{[]byte{0xF0, 0xFF, 0x00}, true, prefixLock, 3, 32, 32, DS}, // lock inc dword [eax]
+		{[]byte{0x2E, 0x3E, 0x8B, 0x00}, true, prefixSegment, 4, 32, 32, DS},
+	}
+
+	for _, test := range tests {
+		e := newTestEmulator(test.code, test.protectedEnable)
+		var inst Instruction
+		if err := e.decode(&inst); err != nil {
+			t.Fatalf("code=% x: %v", test.code, err)
+		}
+		segment := inst.segment
+		if inst.op.flags&fModRM != 0 {
+			segment = inst.modrm.segment
+		}
+		if inst.prefix != test.prefix || inst.length != test.length || inst.opsize != test.opsize ||
+			inst.addrsize != test.addrsize || segment != test.segment {
+			t.Fatalf("code=% x: prefix=%x length=%d opsize=%d addrsize=%d segment=%d",
+				test.code, inst.prefix, inst.length, inst.opsize, inst.addrsize, segment)
+		}
+	}
+}
+
+func TestOperandSize16(t *testing.T) {
+	e := newTestEmulator([]byte{
+		0x66, 0xB8, 0x78, 0x56, 0x34, 0x12, // mov eax, 0x12345678
+		0x89, 0xC3, // mov bx, ax
+		0x40,             // inc ax
+		0x50,             // push ax
+		0x5A,             // pop dx
+		0x8D, 0x4F, 0x02, // lea cx, [bx+2]
+		0x6A, 0xFF, // push -1
+		0x58,             // pop ax
+		0xE8, 0x01, 0x00, // call +1
+		0xF4, // hlt
+		0x5E, // pop si
+	}, false)
+	e.setRegister32(EBX, 0xAAAA0000)
+	e.setRegister32(ECX, 0xBBBB0000)
+	e.setRegister32(ESI, 0xCCCC0000)
+	e.setRegister32(ESP, 0x7000)
+	for i := 0; i < 10; i++ {
+		if err := e.execInst(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, r := range []struct {
+		name  string
+		reg   uint8
+		value uint32
+	}{
+		{"EAX", EAX, 0x1234FFFF},
+		{"EBX", EBX, 0xAAAA5678},
+		{"ECX", ECX, 0xBBBB567A},
+		{"EDX", EDX, 0x5679},
+		{"ESI", ESI, 0xCCCC7C14},
+		{"ESP", ESP, 0x7000},
+	} {
+		assetRegister32(t, e, r.name, r.reg, r.value)
+	}
+}
+
+func TestRepneScasb(t *testing.T) {
+	// strlen: repne scasb
+	e := newTestEmulator([]byte{0xF2, 0xAE}, true)
+	copy(e.memory[0x9000:], "hello\x00world")
+	e.setRegister32(EDI, 0x9000)
+	e.setRegister32(ECX, 0xFFFFFFFF)
+	e.setRegister8(AL, 0)
+	for e.eip == 0x7c00 {
+		if err := e.execInst(); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	assetRegister32(t, e, "EDI", EDI, 0x9006)
+	assetRegister32(t, e, "ECX", ECX, 0xFFFFFFF9)
+	if e.eip != 0x7c02 {
+		t.Fatalf("eip=0x%x", e.eip)
+	}
+}
+
+func TestSegmentOverride(t *testing.T) {
+	// mov al, fs:[bx] in real mode
+	e := newTestEmulator([]byte{0x64, 0x8A, 0x07}, false)
+	e.setSreg16(FS, 0x1000)
+	e.setRegister16(BX, 0x0010)
+	e.memory[0x10010] = 0x42
+	if err := e.execInst(); err != nil {
+		t.Fatal(err.Error())
+	}
+	assetRegister32(t, e, "EAX", EAX, 0xaa42)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// BlockDevice is a disk image which the ATA drive reads and writes
+type BlockDevice interface {
+	ReadAt(p []byte, off int64) (int, error)
+	WriteAt(p []byte, off int64) (int, error)
+	Size() int64 // in bytes
+	Flush() error
+}
+
+// ErrReadOnly is returned by WriteAt of the read-only disk
+var ErrReadOnly = errors.New("disk is read-only")
+
+// RawDisk is the disk image in the file
+type RawDisk struct {
+	file     *os.File
+	size     int64
+	readOnly bool
+}
+
+// OpenRawDisk opens the image file
+func OpenRawDisk(name string, readOnly bool) (*RawDisk, error) {
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(name, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &RawDisk{file: file, size: info.Size(), readOnly: readOnly}, nil
+}
+
+// ReadAt reads the image
+func (d *RawDisk) ReadAt(p []byte, off int64) (int, error) {
+	return d.file.ReadAt(p, off)
+}
+
+// WriteAt writes the image, the file is not extended
+func (d *RawDisk) WriteAt(p []byte, off int64) (int, error) {
+	if d.readOnly {
+		return 0, ErrReadOnly
+	}
+	if off+int64(len(p)) > d.size {
+		return 0, io.ErrShortWrite
+	}
+	return d.file.WriteAt(p, off)
+}
+
+// Size of the image
+func (d *RawDisk) Size() int64 {
+	return d.size
+}
+
+// Flush the written data to the storage
+func (d *RawDisk) Flush() error {
+	if d.readOnly {
+		return nil
+	}
+	return d.file.Sync()
+}
+
+// Close the file
+func (d *RawDisk) Close() error {
+	return d.file.Close()
+}
+
+// MemoryDisk is the disk image in memory
+type MemoryDisk struct {
+	data []byte
+}
+
+// NewMemoryDisk returns the disk of data, which is written directly
+func NewMemoryDisk(data []byte) *MemoryDisk {
+	return &MemoryDisk{data: data}
+}
+
+// ReadAt reads the image
+func (d *MemoryDisk) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(d.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, d.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes the image, it is not extended
+func (d *MemoryDisk) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > int64(len(d.data)) {
+		return 0, io.ErrShortWrite
+	}
+	return copy(d.data[off:], p), nil
+}
+
+// Size of the image
+func (d *MemoryDisk) Size() int64 {
+	return int64(len(d.data))
+}
+
+// Flush does nothing
+func (d *MemoryDisk) Flush() error {
+	return nil
+}
+
+// OverlayDisk is the copy-on-write disk over the base image, which is never
+// written. The written sectors are kept in memory until Discard.
+type OverlayDisk struct {
+	base    BlockDevice
+	sectors map[int64][]byte // written sectors by the sector number
+}
+
+// NewOverlayDisk returns the overlay of base without changes
+func NewOverlayDisk(base BlockDevice) *OverlayDisk {
+	return &OverlayDisk{base: base, sectors: map[int64][]byte{}}
+}
+
+// ReadAt reads the written sectors, or the base image
+func (d *OverlayDisk) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		if off >= d.Size() {
+			return n, io.EOF
+		}
+		sector, offset := off/SectorSize, off%SectorSize
+		length := len(p) - n
+		if length > int(SectorSize-offset) {
+			length = int(SectorSize - offset)
+		}
+		if data, ok := d.sectors[sector]; ok {
+			copy(p[n:n+length], data[offset:])
+		} else if m, err := d.base.ReadAt(p[n:n+length], off); m < length {
+			return n + m, err
+		}
+		n += length
+		off += int64(length)
+	}
+	return n, nil
+}
+
+// WriteAt writes the sectors in memory, which are copied from the base image
+// first
+func (d *OverlayDisk) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > d.Size() {
+		return 0, io.ErrShortWrite
+	}
+	n := 0
+	for n < len(p) {
+		sector, offset := off/SectorSize, off%SectorSize
+		data, ok := d.sectors[sector]
+		if !ok {
+			data = make([]byte, SectorSize)
+			if m, err := d.base.ReadAt(data, sector*SectorSize); m < SectorSize && err != io.EOF {
+				return n, err
+			}
+			d.sectors[sector] = data
+		}
+		m := copy(data[offset:], p[n:])
+		n += m
+		off += int64(m)
+	}
+	return n, nil
+}
+
+// Size of the base image
+func (d *OverlayDisk) Size() int64 {
+	return d.base.Size()
+}
+
+// Flush does nothing, the changes are not written to the base image
+func (d *OverlayDisk) Flush() error {
+	return nil
+}
+
+// Discard the changes
+func (d *OverlayDisk) Discard() {
+	d.sectors = map[int64][]byte{}
+}
+
+// Snapshot returns the read-only disk of the current contents, which is not
+// affected by the later changes
+func (d *OverlayDisk) Snapshot() BlockDevice {
+	snapshot := NewOverlayDisk(d.base)
+	for sector, data := range d.sectors {
+		snapshot.sectors[sector] = append([]byte{}, data...)
+	}
+	return ReadOnlyDisk{snapshot}
+}
+
+// ReadOnlyDisk is the disk which can not be written
+type ReadOnlyDisk struct {
+	BlockDevice
+}
+
+// WriteAt always fails
+func (d ReadOnlyDisk) WriteAt(p []byte, off int64) (int, error) {
+	return 0, ErrReadOnly
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sectors filled with the sector number
+func numberedSectors(n int) []byte {
+	data := make([]byte, n*SectorSize)
+	for i := range data {
+		data[i] = uint8(i / SectorSize)
+	}
+	return data
+}
+
+func TestMemoryDisk(t *testing.T) {
+	d := NewMemoryDisk(numberedSectors(2))
+	if d.Size() != 2*SectorSize {
+		t.Fatalf("size=%d", d.Size())
+	}
+	if _, err := d.WriteAt([]byte{0xAA, 0xBB}, SectorSize-1); err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 4)
+	if n, err := d.ReadAt(p, SectorSize-2); n != 4 || err != nil || !bytes.Equal(p, []byte{0, 0xAA, 0xBB, 1}) {
+		t.Fatalf("n=%d err=%v p=%v", n, err, p)
+	}
+	// the image is not extended
+	if _, err := d.WriteAt(p, 2*SectorSize-2); err == nil {
+		t.Fatal("write beyond the end must fail")
+	}
+	if n, err := d.ReadAt(p, 2*SectorSize-2); n != 2 || err != io.EOF {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+}
+
+func TestOverlayDisk(t *testing.T) {
+	data := numberedSectors(4)
+	base := NewMemoryDisk(append([]byte{}, data...))
+	d := NewOverlayDisk(base)
+
+	// write across sectors 1 and 2
+	if _, err := d.WriteAt([]byte{0xAA, 0xBB, 0xCC}, 2*SectorSize-1); err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 5)
+	if _, err := d.ReadAt(p, 2*SectorSize-2); err != nil || !bytes.Equal(p, []byte{1, 0xAA, 0xBB, 0xCC, 2}) {
+		t.Fatalf("err=%v p=%v", err, p)
+	}
+	if !bytes.Equal(base.data, data) {
+		t.Fatal("the base image must not be written")
+	}
+
+	snapshot := d.Snapshot()
+	if _, err := snapshot.WriteAt([]byte{0}, 0); err != ErrReadOnly {
+		t.Fatalf("err=%v", err)
+	}
+	if _, err := d.WriteAt([]byte{0xDD}, 2*SectorSize); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := snapshot.ReadAt(p[:1], 2*SectorSize); err != nil || p[0] != 0xBB {
+		t.Fatalf("snapshot=0x%x", p[0])
+	}
+
+	d.Discard()
+	if _, err := d.ReadAt(p, 2*SectorSize-2); err != nil || !bytes.Equal(p, data[2*SectorSize-2:2*SectorSize+3]) {
+		t.Fatalf("err=%v p=%v", err, p)
+	}
+	if _, err := snapshot.ReadAt(p[:1], 2*SectorSize-1); err != nil || p[0] != 0xAA {
+		t.Fatalf("snapshot=0x%x", p[0])
+	}
+}
+
+func TestRawDisk(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(name, numberedSectors(2), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := OpenRawDisk(name, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Size() != 2*SectorSize {
+		t.Fatalf("size=%d", d.Size())
+	}
+	if _, err := d.WriteAt([]byte{0}, 0); err != ErrReadOnly {
+		t.Fatalf("err=%v", err)
+	}
+	d.Close()
+
+	d, err = OpenRawDisk(name, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if _, err := d.WriteAt([]byte{0xAA}, SectorSize); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.WriteAt([]byte{0, 0}, 2*SectorSize-1); err == nil {
+		t.Fatal("write beyond the end must fail")
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 2)
+	if _, err := d.ReadAt(p, SectorSize-1); err != nil || !bytes.Equal(p, []byte{0, 0xAA}) {
+		t.Fatalf("err=%v p=%v", err, p)
+	}
+}
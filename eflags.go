@@ -6,8 +6,12 @@ import (
 	// "github.com/fatih/color"
 )
 
-// Eflags is a set of flags
-type Eflags uint32
+// Eflags is a set of flags.
+// CF, PF, AF, ZF, SF and OF are computed lazily from the last operation.
+type Eflags struct {
+	value uint32    // flags, except the ones pending in lazy
+	lazy  lazyFlags // the last operation which updates arithmetic flags
+}
 
 // eflags
 const (
@@ -20,8 +24,52 @@ const (
 	InterruptFlag = uint32(1) << 9
 	DirectionFlag = uint32(1) << 10
 	OverflowFlag  = uint32(1) << 11
+	IOPLMask      = uint32(3) << 12 // I/O privilege level
+)
+
+// flags updated by arithmetic and logical operations
+const arithmeticFlags = CarryFlag | ParityFlag | AdjustFlag | ZeroFlag | SignFlag | OverflowFlag
+
+// kinds of the last operation
+const (
+	lazyNone  = iota // value is up to date
+	lazyAdd          // v1 + v2 (+ carry)
+	lazySub          // v1 - v2 (- carry)
+	lazyLogic        // AND, OR, XOR and TEST
+	lazyInc          // v1 + 1, CF is not changed
+	lazyDec          // v1 - 1, CF is not changed
+	lazyShl          // v1 << v2 (SHL and SHLD)
+	lazyShr          // v1 >> v2 (SHR and SHRD)
+	lazySar          // int(v1) >> v2
+	lazyMul          // v1 * v2, result is the lower half and carry is set if the upper half is significant
 )
 
+// lazyFlags is the last operation, its operands and its result
+type lazyFlags struct {
+	op     uint8
+	size   uint8  // operand size, 8, 16 or 32
+	v1, v2 uint32 // operands
+	result uint32 // result, masked by size
+	carry  uint32 // carry-in of ADC/SBB, or overflow of MUL
+}
+
+// NewEflags returns Eflags with the value
+func NewEflags(value uint32) Eflags {
+	return Eflags{value: value}
+}
+
+// get the value of eflags
+func (ef *Eflags) get() uint32 {
+	ef.flush()
+	return ef.value
+}
+
+// load the value of eflags (POPF, IRET etc.)
+func (ef *Eflags) load(value uint32) {
+	ef.lazy.op = lazyNone
+	ef.value = value
+}
+
 func (ef *Eflags) setVal(flag uint32, value bool) {
 	if value {
 		ef.set(flag)
@@ -31,53 +79,167 @@ func (ef *Eflags) setVal(flag uint32, value bool) {
 }
 
 func (ef *Eflags) set(flag uint32) {
-	*ef = Eflags(uint32(*ef) | flag)
+	ef.flush()
+	ef.value |= flag
 }
 
 func (ef *Eflags) unset(flag uint32) {
-	*ef = Eflags(uint32(*ef) & ^flag)
+	ef.flush()
+	ef.value &^= flag
 }
 
 func (ef *Eflags) isEnable(flag uint32) bool {
-	return uint32(*ef)&flag == flag
+	if flag&arithmeticFlags != 0 {
+		ef.flush()
+	}
+	return ef.value&flag == flag
 }
 
-func (ef *Eflags) updateBySub8(v1, v2 uint8, result uint16) {
-	sign1 := (v1 >> 7) & 0x01
-	sign2 := (v2 >> 7) & 0x01
-	signr := uint8((result >> 7) & 0x01)
+// mask of the sign bit for size (8, 16 or 32) bits operand
+func signMask(size uint8) uint32 {
+	return uint32(1) << (size - 1)
+}
 
-	ef.setVal(CarryFlag, (result>>8) != 0)
-	ef.setVal(ZeroFlag, result == 0)
-	ef.setVal(SignFlag, signr != 0)
-	ef.setVal(OverflowFlag,
-		(sign1 == 0 && sign2 == 1 && signr == 1) || (sign1 == 1 && sign2 == 0 && signr == 0))
+// mask of all bits for size (8, 16 or 32) bits operand
+func sizeMask(size uint8) uint32 {
+	return uint32((uint64(1) << size) - 1)
 }
 
-func (ef *Eflags) updateByAndOr8(result uint8) {
-	ef.setVal(OverflowFlag, false)
-	ef.setVal(CarryFlag, false)
-	ef.setVal(SignFlag, (result>>7) != 0)
-	ef.setVal(ZeroFlag, result == 0)
-	popcnt := bits.OnesCount8(result)
-	ef.setVal(ParityFlag, popcnt%2 == 0)
+// record the operation, whose flags are computed when they are read
+func (ef *Eflags) record(op uint8, v1, v2, result, carry uint32, size uint8) {
+	ef.lazy = lazyFlags{
+		op:     op,
+		size:   size,
+		v1:     v1,
+		v2:     v2,
+		result: result & sizeMask(size),
+		carry:  carry,
+	}
 }
 
-func (ef *Eflags) updateBySub(v1, v2 uint32, result uint64) {
-	sign1 := (v1 >> 31) & 0x01
-	sign2 := (v2 >> 31) & 0x01
-	signr := uint32((result >> 31) & 0x01)
+// compute the flags of the last operation into value
+func (ef *Eflags) flush() {
+	l := &ef.lazy
+	if l.op == lazyNone {
+		return
+	}
+	sign := signMask(l.size)
+	r := l.result
+	flags := ef.value &^ arithmeticFlags
 
-	ef.setVal(CarryFlag, (result>>32) != 0)
-	ef.setVal(ZeroFlag, result == 0)
-	ef.setVal(SignFlag, signr != 0)
-	ef.setVal(OverflowFlag,
-		(sign1 == 0 && sign2 == 1 && signr == 1) || (sign1 == 1 && sign2 == 0 && signr == 0))
+	if r == 0 {
+		flags |= ZeroFlag
+	}
+	if r&sign != 0 {
+		flags |= SignFlag
+	}
+	if bits.OnesCount8(uint8(r))%2 == 0 {
+		flags |= ParityFlag
+	}
+
+	var cf, af, of bool
+	switch l.op {
+	case lazyAdd:
+		cf = r < l.v1 || (l.carry != 0 && r == l.v1)
+		af = (l.v1^l.v2^r)&0x10 != 0
+		of = ^(l.v1^l.v2)&(l.v1^r)&sign != 0
+	case lazySub:
+		cf = l.v1 < l.v2 || (l.carry != 0 && l.v1 == l.v2)
+		af = (l.v1^l.v2^r)&0x10 != 0
+		of = (l.v1^l.v2)&(l.v1^r)&sign != 0
+	case lazyInc:
+		cf = ef.value&CarryFlag != 0
+		af = r&0xF == 0
+		of = r == sign
+	case lazyDec:
+		cf = ef.value&CarryFlag != 0
+		af = r&0xF == 0xF
+		of = r == sign-1
+	case lazyShl:
+		cf = (l.v1>>(uint32(l.size)-l.v2))&1 != 0
+		of = (r&sign != 0) != cf
+	case lazyShr:
+		cf = (l.v1>>(l.v2-1))&1 != 0
+		of = (r&sign != 0) != (l.v1&sign != 0)
+	case lazySar:
+		cf = (l.v1>>(l.v2-1))&1 != 0
+	case lazyMul:
+		cf = l.carry != 0
+		of = cf
+	}
+	if cf {
+		flags |= CarryFlag
+	}
+	if af {
+		flags |= AdjustFlag
+	}
+	if of {
+		flags |= OverflowFlag
+	}
+
+	ef.value = flags
+	l.op = lazyNone
+}
+
+// update flags by result = v1 + v2 (+ carry) of size bits operands
+func (ef *Eflags) updateByAddition(v1, v2, carry, result uint32, size uint8) {
+	ef.record(lazyAdd, v1, v2, result, carry, size)
+}
+
+// update flags by result = v1 - v2 (- carry) of size bits operands
+func (ef *Eflags) updateBySubtraction(v1, v2, carry, result uint32, size uint8) {
+	ef.record(lazySub, v1, v2, result, carry, size)
+}
+
+// update flags by result of AND, OR, XOR and TEST
+func (ef *Eflags) updateByLogical(result uint32, size uint8) {
+	ef.record(lazyLogic, 0, 0, result, 0, size)
 }
 
-func (ef *Eflags) updatePF(result uint8) {
-	popcnt := bits.OnesCount8(result)
-	ef.setVal(ParityFlag, popcnt%2 == 0)
+// update flags by result = v + 1 (CF is not changed)
+func (ef *Eflags) updateByInc(v, result uint32, size uint8) {
+	ef.flush()
+	ef.record(lazyInc, v, 1, result, 0, size)
+}
+
+// update flags by result = v - 1 (CF is not changed)
+func (ef *Eflags) updateByDec(v, result uint32, size uint8) {
+	ef.flush()
+	ef.record(lazyDec, v, 1, result, 0, size)
+}
+
+// update flags by result = v << count, v >> count (SHR) or int(v) >> count (SAR).
+// count must be masked, and flags are not changed if count is 0.
+func (ef *Eflags) updateByShift(op uint8, v, count, result uint32, size uint8) {
+	if count == 0 {
+		return
+	}
+	if count > uint32(size) {
+		// only possible for 8 and 16 bits operands, and CF is undefined
+		count = uint32(size)
+	}
+	ef.record(op, v, count, result, 0, size)
+}
+
+// update CF and OF by rotation (ROL, ROR, RCL and RCR), other flags are not changed
+func (ef *Eflags) updateByRotate(cf, of bool) {
+	ef.flush()
+	ef.setVal(CarryFlag, cf)
+	ef.setVal(OverflowFlag, of)
+}
+
+// update flags by multiplication, overflow is true if the upper half is significant
+func (ef *Eflags) updateByMul(result uint32, overflow bool, size uint8) {
+	var carry uint32
+	if overflow {
+		carry = 1
+	}
+	ef.record(lazyMul, 0, 0, result, carry, size)
+}
+
+// update flags by 32 bits subtraction, result = uint64(v1) - uint64(v2)
+func (ef *Eflags) updateBySub(v1, v2 uint32, result uint64) {
+	ef.updateBySubtraction(v1, v2, 0, uint32(result), 32)
 }
 
 func (ef *Eflags) dump() {
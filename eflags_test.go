@@ -14,3 +14,35 @@ func TestFlags(t *testing.T) {
 		t.Fatalf("Overflow = %v\n", e.isEnable(OverflowFlag))
 	}
 }
+
+func TestLazyFlags(t *testing.T) {
+	tests := []struct {
+		name     string
+		update   func(ef *Eflags)
+		initial  uint32
+		expected uint32
+	}{
+		{"add 0x0f+0x01", func(ef *Eflags) { ef.updateByAddition(0x0F, 0x01, 0, 0x10, 8) }, 0, AdjustFlag},
+		{"add 0xff+0x01", func(ef *Eflags) { ef.updateByAddition(0xFF, 0x01, 0, 0x00, 8) }, 0, CarryFlag | ParityFlag | AdjustFlag | ZeroFlag},
+		{"adc 0x7fff+0+1", func(ef *Eflags) { ef.updateByAddition(0x7FFF, 0, 1, 0x8000, 16) }, 0, ParityFlag | AdjustFlag | SignFlag | OverflowFlag},
+		{"sub 0x10-0x01", func(ef *Eflags) { ef.updateBySubtraction(0x10, 0x01, 0, 0x0F, 32) }, 0, ParityFlag | AdjustFlag},
+		{"sbb 0-0-1", func(ef *Eflags) { ef.updateBySubtraction(0, 0, 1, 0xFF, 8) }, 0, CarryFlag | ParityFlag | AdjustFlag | SignFlag},
+		{"and", func(ef *Eflags) { ef.updateByLogical(0x8003, 16) }, CarryFlag | OverflowFlag | AdjustFlag, ParityFlag | SignFlag},
+		{"inc 0x7f", func(ef *Eflags) { ef.updateByInc(0x7F, 0x80, 8) }, CarryFlag, CarryFlag | AdjustFlag | SignFlag | OverflowFlag},
+		{"dec 0", func(ef *Eflags) { ef.updateByDec(0, 0xFFFFFFFF, 32) }, 0, ParityFlag | AdjustFlag | SignFlag},
+		{"shl 0x80000001,1", func(ef *Eflags) { ef.updateByShift(lazyShl, 0x80000001, 1, 0x2, 32) }, 0, CarryFlag | OverflowFlag},
+		{"shr 0x81,1", func(ef *Eflags) { ef.updateByShift(lazyShr, 0x81, 1, 0x40, 8) }, 0, CarryFlag | OverflowFlag},
+		{"sar 0x8000,15", func(ef *Eflags) { ef.updateByShift(lazySar, 0x8000, 15, 0xFFFF, 16) }, 0, ParityFlag | SignFlag},
+		{"shl by 0", func(ef *Eflags) { ef.updateByShift(lazyShl, 0x1, 0, 0x1, 32) }, ZeroFlag, ZeroFlag},
+		{"rol", func(ef *Eflags) { ef.updateByRotate(true, false) }, ZeroFlag, ZeroFlag | CarryFlag},
+		{"mul", func(ef *Eflags) { ef.updateByMul(0, true, 32) }, 0, CarryFlag | ParityFlag | ZeroFlag | OverflowFlag},
+	}
+
+	for _, test := range tests {
+		ef := NewEflags(test.initial)
+		test.update(&ef)
+		if ef.get() != test.expected {
+			t.Fatalf("%s: eflags=0x%x expected=0x%x", test.name, ef.get(), test.expected)
+		}
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	// "errors"
 	"fmt"
-	"time"
 	// "github.com/fatih/color"
 	"io"
 )
@@ -50,6 +49,7 @@ const (
 	CS = 1
 	SS = 2
 	DS = 3
+	FS = 4
 	GS = 5
 )
 
@@ -58,6 +58,7 @@ const (
 // Controll Register
 const (
 	CR4PageSizeExtension = 0x10
+	CR0WriteProtect      = 0x1 << 16
 	CR0PagingFlag        = 0x1 << 31
 )
 
@@ -98,26 +99,34 @@ type TaskState struct {
 
 // Emulator is an i386 Virtual Machine
 type Emulator struct {
-	registers              [8]uint32    // general registers
-	cr                     [16]uint32   // controll registers
-	sreg                   [6]uint32    // segment registers
-	tr                     TaskRegister // task register
-	taskState              TaskState    // task state
-	eflags                 Eflags       // eflags
-	gdtrSize               uint16       // global table descriptor table's size
-	gdtrBase               uint32       // global table descriptor table's base phys address
-	idtrSize               uint16       // interrupt table descriptor table's size
-	idtrBase               uint32       // interrupt table descriptor table's base phys address
-	memory                 []uint8      // physical memory
-	eip                    uint32       // program counter
-	isSilent               bool         // silent mode
-	reader                 io.Reader
-	writer                 io.Writer
-	io                     IO
-	operandSizeOverride    bool              // true if operand size override (0x66) is enabled
-	genuineProtectedEnable bool              // procted mode is refreshed only when sreg is changed
-	PageSizeExtensionEable bool              // CR4PageSizeExtension Enable
-	disasm                 map[uint64]string // disasmed code (ex. 32255 -> "0000 add [bx+si],al")
+	registers [8]uint32       // general registers
+	cr        [16]uint32      // controll registers
+	sreg      [6]uint32       // segment registers
+	segments  [6]segmentCache // descriptor caches of segment registers
+	ldtr      LDTRegister     // local descriptor table register
+	tr        TaskRegister    // task register
+	taskState TaskState       // task state
+	eflags    Eflags          // eflags
+	gdtrSize  uint16          // global table descriptor table's size
+	gdtrBase  uint32          // global table descriptor table's base phys address
+	idtrSize  uint16          // interrupt table descriptor table's size
+	idtrBase  uint32          // interrupt table descriptor table's base phys address
+	memory    []uint8         // physical memory
+	eip       uint32          // program counter
+	isSilent  bool            // silent mode
+	reader    io.Reader
+	writer    io.Writer
+	io        *IO
+	uart      *UART // COM1
+	keyboard  *Keyboard
+	cga       *CGA // text mode console
+	vga       *VGA // mode 13h graphics
+	bus       Bus // physical address space
+	lapic     LocalAPIC
+	ioapic    IOAPIC
+	tlb       TLB               // translation lookaside buffer
+	disasm    map[uint64]string // disasmed code (ex. 32255 -> "0000 add [bx+si],al")
+	inst      Instruction       // instruction being executed
 }
 
 func getMpConf() [72]byte {
@@ -224,11 +233,48 @@ func NewEmulator(memorySize, eip, esp uint32, protectedMode, isSilent bool, read
 	e.registers[ESP] = esp
 	e.cr[0] = 0x10
 	e.io = NewIO(&reader, &writer)
-	e.eflags = 2
+	ata := NewATA(&e.io.hdds, e)
+	e.uart = NewUART(reader, writer, e, com1IRQ)
+	e.keyboard = NewKeyboard(e)
+	e.cga = NewCGA()
+	e.vga = NewVGA()
+	for _, r := range []portRegion{
+		{ataData, ataCommand, ata},
+		{ataControl, ataControl, ata},
+		{com1Base, com1Base + uartSCR, e.uart},
+		{kbdData, kbdData, e.keyboard},
+		{kbdStatus, kbdStatus, e.keyboard},
+		{crtcIndex, crtcData, e.cga},
+		{cgaStatus, cgaStatus, e.cga},
+		{dacMask, dacData, e.vga},
+	} {
+		if err := e.io.Claim(r.first, r.last, r.device); err != nil {
+			panic(err)
+		}
+	}
+	e.eflags = NewEflags(2)
+	e.tlb = NewTLB()
+	e.lapic = NewLocalAPIC(1, &e.ioapic)
+	e.ioapic = NewIOAPIC(1, &e.lapic)
+	e.bus = NewBus(e.memory)
+	for _, device := range []mmioRegion{
+		{LocalAPICBase, lapicSize, &e.lapic},
+		{IOAPICBase, ioapicSize, &e.ioapic},
+		{cgaBase, cgaSize, e.cga},
+		{vgaBase, vgaSize, e.vga},
+	} {
+		if err := e.bus.Register(device.base, device.size, device.device); err != nil {
+			panic(err)
+		}
+	}
+	e.idtrSize = 0x3FF // IVT at 0
 	if protectedMode {
 		e.cr[0] |= 1
-		e.genuineProtectedEnable = true
 	}
+	for i := range e.segments {
+		e.segments[i] = flatSegment(segPresent|segNotSystem|segWritable, protectedMode)
+	}
+	e.segments[CS] = flatSegment(segPresent|segNotSystem|segCode|segReadable, protectedMode)
 
 	// setup BDA (BIOS Data Area)
 	e.memory[0x040E] = uint8(EBDABase >> 4)
@@ -251,1468 +297,600 @@ func NewEmulator(memorySize, eip, esp uint32, protectedMode, isSilent bool, read
 // emulate instruction
 
 func (e *Emulator) execInst() error {
-
-	switch e.getCode8(0) {
-	case 0x01:
-		e.addRm32R32()
-	case 0x03:
-		e.addR32Rm32()
-	case 0x05:
-		e.addEaxImm32()
-	case 0x09:
-		e.orRm32R32()
-	case 0x0B:
-		e.orR32Rm32()
-	case 0x0D:
-		e.orEaxImm32()
-	case 0x0F:
-		e.code0f()
-	case 0x25:
-		if (e.genuineProtectedEnable && !e.operandSizeOverride) || (!e.genuineProtectedEnable && e.operandSizeOverride) {
-			e.andEaxImm32()
-		} else {
-			e.andAxImm16()
+	// an instruction takes a bus cycle
+	e.lapic.tick(1)
+	e.uart.poll()
+	e.keyboard.poll()
+	if e.eflags.isEnable(InterruptFlag) {
+		// external interrupt from APIC or PIC, before the next instruction
+		if e.lapic.hasInterrupt() {
+			return e.handleFault(&Fault{Vector: e.lapic.acknowledge(), EIP: e.eip})
 		}
-	case 0x29:
-		e.subRm32R32()
-	case 0x2D:
-		e.subEaxImm32()
-	case 0x31:
-		if (e.genuineProtectedEnable && !e.operandSizeOverride) || (!e.genuineProtectedEnable && e.operandSizeOverride) {
-			e.xorRm32R32()
-		} else {
-			e.xorRm16R16()
+		if e.io.pic.hasInterrupt() {
+			return e.handleFault(&Fault{Vector: e.io.pic.acknowledge(), EIP: e.eip})
 		}
-	case 0x38:
-		e.cmpRm8R8()
-	case 0x39:
-		e.cmpRm32R32()
-	case 0x3b:
-		e.cmpR32Rm32()
-	case 0x3c:
-		e.cmpAlImm8()
-	case 0x3d:
-		e.cmpEaxImm32()
-	case 0x40, 0x41, 0x42, 0x43, 0x44, 0x45, 0x46, 0x47:
-		e.incR32()
-	case 0x48, 0x49, 0x4a, 0x4b, 0x4c, 0x4d, 0x4e, 0x4f:
-		e.decR32()
-	case 0x50, 0x51, 0x52, 0x53, 0x54, 0x55, 0x56, 0x57:
-		e.pushR32()
-	case 0x58, 0x59, 0x5a, 0x5b, 0x5c, 0x5d, 0x5e, 0x5f:
-		e.popR32()
-	case 0x66:
-		e.operandSizeOverride = true
-		e.eip++
-		e.execInst()
-		e.operandSizeOverride = false
-	case 0x68:
-		if (e.genuineProtectedEnable && !e.operandSizeOverride) || (!e.genuineProtectedEnable && e.operandSizeOverride) {
-			e.pushImm32()
-		} else {
-			e.pushImm16()
-		}
-	case 0x69:
-		e.imulR32Rm32Imm32()
-	case 0x6a:
-		e.pushImm8()
-	case 0x6d:
-		e.insd()
-	case 0x71:
-		e.jno()
-	case 0x72:
-		e.jb()
-	case 0x73:
-		e.jae()
-	case 0x74:
-		e.jz()
-	case 0x75:
-		e.jnz()
-	case 0x76:
-		e.jna()
-	case 0x77:
-		e.ja()
-	case 0x78:
-		e.js()
-	case 0x79:
-		e.jns()
-	case 0x84:
-		e.testRm8R8()
-	case 0x85:
-		e.testRm32R32()
-	case 0x7A:
-		e.jp()
-	case 0x7B:
-		e.jpo()
-	case 0x7C:
-		e.jl()
-	case 0x7D:
-		e.jc()
-	case 0x7E:
-		e.jng()
-	case 0x7F:
-		e.jg()
-	case 0x80:
-		e.code80()
-		// e.orRm8Imm8()
-	case 0x81:
-		e.code81()
-	case 0x83:
-		e.code83()
-	case 0x87:
-		e.xchg()
-	case 0x88:
-		e.movRm8R8()
-	case 0x89:
-		e.movRm32R32()
-	case 0x9C:
-		e.pushf()
-	case 0x8A:
-		e.movR8Rm8()
-	case 0x8B:
-		e.movR32Rm32()
-	case 0x8D:
-		e.leaR32Rm32()
-	case 0xA1:
-		e.movEaxMoffs32()
-	case 0xA3:
-		e.movMoffs32Eax()
-	case 0xA4:
-		e.movsb()
-	case 0xA8:
-		e.testAlImm8()
-	case 0xA9:
-		if (e.genuineProtectedEnable && !e.operandSizeOverride) || (!e.genuineProtectedEnable && e.operandSizeOverride) {
-			e.testEaxImm32()
-		} else {
-			e.testAxImm16()
-		}
-	case 0x8E:
-		e.movSregRm16() // 16 bit mode
-	case 0xB0, 0xB1, 0xB2, 0xB3, 0xB4, 0xB5, 0xB6, 0xB7:
-		e.movR8Imm8()
-	case 0x90:
-		e.nop()
-	case 0xAA:
-		e.stosb()
-	case 0xAB:
-		e.stosd()
-	case 0xC1:
-		e.codeC1()
-	case 0xC3:
-		e.ret()
-	case 0xC6:
-		e.movRm8Imm8()
-	case 0xC7:
-		e.movRm32Imm32()
-	case 0xC9:
-		e.leave()
-	case 0xCD:
-		e.intImm8()
-	case 0xEB:
-		e.shortJmp()
-	case 0xE4:
-		e.inAlImm8()
-	case 0xE5:
-		if e.genuineProtectedEnable {
-			e.inEaxImm8()
-		} else {
-			e.inAxImm8()
-		}
-	case 0xE6:
-		e.outAlImm8()
-	case 0xB8, 0xB9, 0xBA, 0xBB, 0xBC, 0xBD, 0xBE, 0xBF:
-		if (e.genuineProtectedEnable && !e.operandSizeOverride) || (!e.genuineProtectedEnable && e.operandSizeOverride) {
-			e.movR32Imm32()
-		} else {
-			e.movR16Imm16()
-		}
-	case 0xE8:
-		if (e.genuineProtectedEnable && !e.operandSizeOverride) || (!e.genuineProtectedEnable && e.operandSizeOverride) {
-			e.callRel32()
-		} else {
-			e.callRel16()
-		}
-	case 0xE9:
-		e.jmpRel32()
-	case 0xEA:
-		e.farJmp()
-	case 0xEC:
-		e.inAlDx()
-	case 0xEE:
-		e.outAlDx()
-	case 0xEF:
-		e.outAxDx()
-	case 0xF3:
-		// rep prefix
-		ecx := e.getRegister32(ECX)
-		// printf("repeat %d times. ", ecx)
-		if ecx > 1 {
-			e.eip++
-			// printf("eip=0x%x code=0x%x\n", e.eip, e.getCode8(0))
-			e.execInst()
-			// printf("The exec of %d loop finished.\n", ecx)
-			e.decRegister32(ECX, 1)
-			e.eip -= 2
-			// printf("Next eip=0x%x(0x%x) paddr of pdtentry=0x%x code=0x%x ecx=0x%x\n",
-			// 	e.eip, e.v2p(e.eip),
-			// 	(e.cr[3]>>22)+4*(e.eip>>22),
-			// 	e.getCode8(0), e.getRegister32(ECX))
-		} else if ecx == 1 {
-			e.eip++
-			// printf("eip=0x%x code=0x%x\n", e.eip, e.getCode8(0))
-			e.execInst()
-			e.decRegister32(ECX, 1)
-		} else {
-			e.eip += 2
-		}
-	case 0xF4:
-		e.halt()
-	case 0xF6:
-		e.testRm8Imm8()
-	case 0xF7:
-		e.codeF7()
-	case 0xFA:
-		e.cli()
-	case 0xFB:
-		e.sti()
-	case 0xFC:
-		e.cld()
-	case 0xF0:
-		// lock
-		e.eip++
-	case 0xFF:
-		e.codeFf()
-	default:
-		return fmt.Errorf("eip=0x%x(0x%x) opecode = %x is not implemented at execInst()", e.eip, e.v2p(e.eip), e.getCode8(0))
-	}
-	// Jump to Interrupt Handler described in IDT
-	// Timer: # of vector is T_IRQ0 + IRQ_TIMER = 32
-	if e.eip == 0x80103ca7  && e.eflags.isEnable(InterruptFlag) {
-		printf("Insert Timer Interrupt @emu\n");
-	}
-	return nil
-}
-
-func (e *Emulator) nop() {
-	e.eip++
-}
-
-func (e *Emulator) stosb() {
-	address := e.getRegister32(EDI)
-	value := e.getRegister8(AL)
-	e.setMemory8(address, value)
-	if e.eflags.isEnable(DirectionFlag) {
-		e.decRegister32(EDI, 1)
-	} else {
-		e.incRegister32(EDI, 1)
 	}
-	e.eip++
+
+	inst := &e.inst
+	f := catchFault(func() { e.exec(inst) })
+	if f == nil {
+		return nil
+	}
+	// faults are restarted, the handler returns to the faulting instruction
+	f.EIP = inst.eip
+	e.eip = inst.eip
+	return e.handleFault(f)
 }
 
-func (e *Emulator) stosd() {
-	address := e.getRegister32(EDI)
-	value := e.getRegister32(EAX)
-	// printf("stodsd address=0x%x(0x%x) value=0x%x\n", address, e.v2p(address), value)
-	e.setMemory32(address, value)
-	if e.eflags.isEnable(DirectionFlag) {
-		e.decRegister32(EDI, 4)
+func (e *Emulator) exec(inst *Instruction) {
+	if err := e.decode(inst); err != nil {
+		panic(&Fault{Vector: vectorUD, cause: err})
+	}
+	if inst.op.flags&fMemory != 0 && inst.modrm.mod == 3 {
+		raise(vectorUD)
+	}
+	if inst.op.flags&fPrivileged != 0 && e.cpl() != 0 {
+		raiseWithErrorCode(vectorGP, 0)
+	}
+	e.eip += inst.length
+
+	if inst.op.flags&fString != 0 && inst.prefix&(prefixRep|prefixRepne) != 0 {
+		// rep prefix, one iteration per execInst
+		count := e.getIndex(inst, ECX)
+		if count == 0 {
+			return
+		}
+		inst.op.exec(e, inst)
+		count--
+		e.setIndex(inst, ECX, count)
+
+		repeat := count != 0
+		if inst.op.flags&fRepCond != 0 {
+			// REPE stops when ZF=0, REPNE stops when ZF=1
+			repeat = repeat && e.eflags.isEnable(ZeroFlag) == (inst.prefix&prefixRep != 0)
+		}
+		if repeat {
+			e.eip = inst.eip
+		}
 	} else {
-		e.incRegister32(EDI, 4)
+		inst.op.exec(e, inst)
 	}
-	e.eip++
 }
 
-func (e *Emulator) insd() {
-	ioAddress := e.getRegister16(DX)
-	value := e.io.in32(ioAddress)
-	memAddress := e.getRegister32(EDI)
-	// printf("(insd) input 0x%08x from io[0x%x] to memory[paddr=0x%x vaddr=0x%x]\n",
-	// 	value, ioAddress, memAddress, e.v2p(memAddress))
-	e.setMemory32(memAddress, value)
-	e.incRegister32(EDI, 4)
-	e.eip++
+func (e *Emulator) nop(inst *Instruction) {
 }
 
-func (e *Emulator) cli() {
+func (e *Emulator) cli(inst *Instruction) {
+	e.checkInterruptFlagPrivilege()
 	e.eflags.unset(InterruptFlag)
-	e.eip++
 }
 
-func (e *Emulator) sti() {
+func (e *Emulator) sti(inst *Instruction) {
+	e.checkInterruptFlagPrivilege()
 	e.eflags.set(InterruptFlag)
-	e.eip++
-	// printf("Enable Interruput Flag by sti inst.\n")
-	time.Sleep(5 * time.Second)
 }
 
-func (e *Emulator) cld() {
+func (e *Emulator) cld(inst *Instruction) {
 	e.eflags.unset(DirectionFlag)
-	e.eip++
 }
 
-// eip=801005f6 opecode = 0 is not implemented.
-func (e *Emulator) codeF7() {
-	testRm32Imm32 := func(e *Emulator, m ModRM) {
-		value := e.getCode32(0)
-		e.eip += 4
-		result := e.getRm32(m) & value
-		if result == 0 {
-			e.eflags.set(ZeroFlag)
-		} else {
-			e.eflags.unset(ZeroFlag)
-		}
-		e.eflags.unset(CarryFlag)
-		e.eflags.unset(OverflowFlag)
-		e.eflags.updatePF(uint8(result & 0xFF))
-	}
-	negRm32 := func(e *Emulator, m ModRM) {
-		value := e.getRm32(m)
-		e.setRm32(m, (^value)+1)
-	}
-	divRm32 := func(e *Emulator, m ModRM) {
-		// x/y = a ... b
-		x := (uint64(e.getRegister32(EDX)) << 32) | uint64(e.getRegister32(EAX))
-		y := uint64(e.getRm32(m))
-		a := uint32(x / y)
-		b := uint32(x % y)
+func (e *Emulator) std(inst *Instruction) {
+	e.eflags.set(DirectionFlag)
+}
 
-		e.setRegister32(EAX, a)
-		e.setRegister32(EDX, b)
+func (e *Emulator) lgdt(inst *Instruction) {
+	address := e.calcLinearAddress(inst.modrm, 6, false)
+	e.gdtrSize = e.getMemory16(address)
+	base := e.getMemory32(address + 2)
+	if inst.opsize == 16 {
+		// 24bit base address
+		base &= 0xFFFFFF
 	}
+	e.gdtrBase = e.v2p(base)
+	printf("lgdt: address=0x%x gdtSize=0x%x gdtBase=0x%x @emu\n",
+		address, e.gdtrSize, e.gdtrBase)
 
-	e.eip++
-	m := e.parseModRM()
+	e.dumpGDTEntry(e.gdtrBase)
+	e.dumpGDTEntry(e.gdtrBase + 0x8)
+	e.dumpGDTEntry(e.gdtrBase + 0x10)
+	e.dumpGDTEntry(e.gdtrBase + 0x18)
+	e.dumpGDTEntry(e.gdtrBase + 0x20)
+	e.dumpGDTEntry(e.gdtrBase + 0x28)
+}
 
-	if e.genuineProtectedEnable == false && e.operandSizeOverride == false ||
-		e.genuineProtectedEnable == true && e.operandSizeOverride == true {
-		panic("16bit mode is not implemented")
+func (e *Emulator) lidt(inst *Instruction) {
+	address := e.calcLinearAddress(inst.modrm, 6, false)
+	e.idtrSize = e.getMemory16(address)
+	base := e.getMemory32(address + 2)
+	if inst.opsize == 16 {
+		// 24bit base address
+		base &= 0xFFFFFF
 	}
+	e.idtrBase = e.v2p(base)
+	printf("lidt: address=0x%x idtSize=0x%x idtBase=0x%x @emu\n",
+		address, e.idtrSize, e.idtrBase)
+	e.dumpIDTEntry(e.idtrBase + 0x8*32) // IDT Entry for Timer
+}
 
-	switch m.opecode {
-	case 0:
-		testRm32Imm32(e, m)
-	case 3:
-		negRm32(e, m)
-	case 6:
-		divRm32(e, m)
-	default:
-		panic(fmt.Sprintf("eip=%x opecode = %d\n", e.eip, m.opecode) + "not implemented")
-	}
+func (e *Emulator) ltrRm16(inst *Instruction) {
+	e.tr.gdtOffset = e.getRm16(inst.modrm)
+	tss := e.descriptor(e.tr.gdtOffset, 0)
+	e.tr.TSSBase = tss.base
+	e.tr.TSSLimit = tss.limit
+
+	e.loadTaskState()
+
+	printf("ltrRm16: gdtEntryPhysAddr=0x%x tssBase=0x%x tssLimit=0x%x ss0=0x%x esp0=0x%x @emu\n",
+		e.gdtrBase+uint32(e.tr.gdtOffset), e.tr.TSSBase, e.tr.TSSLimit, e.taskState.ss0, e.taskState.esp0)
 }
 
-func (e *Emulator) code0f() {
-	lgdt := func() {
-		m := e.parseModRM()
-		address := e.calcMemoryAddress32(m) // 32bit mode
-		if e.genuineProtectedEnable == false && e.operandSizeOverride == false ||
-			e.genuineProtectedEnable == true && e.operandSizeOverride == true {
-			address = uint32(e.calcMemoryAddress16(m)) // 16bit mode
-		}
-		if m.opecode == 2 {
-			// LGDT
-			e.gdtrSize = e.getMemory16(address)
-			e.gdtrBase = e.v2p(e.getMemory32(address + 2))
-			printf("lgdt: address=0x%x gdtSize=0x%x gdtBase=0x%x @emu\n",
-				address, e.gdtrSize, e.gdtrBase)
-
-			e.dumpGDTEntry(e.gdtrBase)
-			e.dumpGDTEntry(e.gdtrBase + 0x8)
-			e.dumpGDTEntry(e.gdtrBase + 0x10)
-			e.dumpGDTEntry(e.gdtrBase + 0x18)
-			e.dumpGDTEntry(e.gdtrBase + 0x20)
-			e.dumpGDTEntry(e.gdtrBase + 0x28)
-		} else if m.opecode == 3 {
-			// LIDT
-			e.idtrSize = e.getMemory16(address)
-			e.idtrBase = e.v2p(e.getMemory32(address + 2))
-			printf("lidt: address=0x%x idtSize=0x%x idtBase=0x%x @emu\n",
-				address, e.idtrSize, e.idtrBase)
-			e.dumpIDTEntry(e.idtrBase + 0x8 * 32) // IDT Entry for Timer
-		} else {
-			printf("Invalid Operation: 0x0f 0x01 but invalid opecode\n")
-		}
+func (e *Emulator) movR32Cr(inst *Instruction) {
+	m := inst.modrm
+	// e.setR32(m, e.cr[m.opecode])
+	e.setRm32(m, e.cr[m.opecode])
+}
+
+func (e *Emulator) movCrR32(inst *Instruction) {
+	m := inst.modrm
+	// e.cr[m.opecode] = e.getR32(m)
+	old := e.cr[m.opecode]
+	e.cr[m.opecode] = e.getRm32(m)
+
+	// the cached translations are invalid on the change of the page tables
+	// or the paging mode
+	changed := old ^ e.cr[m.opecode]
+	if m.opecode == 3 ||
+		(m.opecode == 0 && changed&(CR0PagingFlag|CR0WriteProtect) != 0) ||
+		(m.opecode == 4 && changed&CR4PageSizeExtension != 0) {
+		e.tlb.flush()
 	}
-	ltrRm16 := func() {
-		m := e.parseModRM()
-		e.tr.gdtOffset = e.getRm16(m)
-		// Read GDT
-		// entry := e.getMemory64(e.gdtrBase + uint32(e.tr.gdtOffset))
-		var entry uint64
-		for i := uint32(0); i < 8; i++ {
-			entry |= uint64(e.memory[e.gdtrBase+uint32(e.tr.gdtOffset)+i]) << uint32(i*8)
-		}
 
-		e.tr.TSSBase = uint32((((entry >> 56) & 0xFF) << 24) | (((entry >> 32) & 0xFF) << 16) | ((entry >> 16) & 0xFFFF))
-		e.tr.TSSLimit = uint32((((entry >> 48) & 0xF) << 16) | (entry & 0xFFFF))
-
-		e.taskState.ss0 = uint16(e.memory[e.tr.TSSBase+9])<<8 | uint16(e.memory[e.tr.TSSBase+8])
-		e.taskState.esp0 = uint32(e.memory[e.tr.TSSBase+7])<<24 | uint32(e.memory[e.tr.TSSBase+6])<<16 | uint32(e.memory[e.tr.TSSBase+5])<<8 | uint32(e.memory[e.tr.TSSBase+4])
-
-		printf("ltrRm16: gdtEntryPhysAddr=0x%x tssBase=0x%x tssLimit=0x%x ss0=0x%x esp0=0x%x @emu\n",
-			e.gdtrBase+uint32(e.tr.gdtOffset), e.tr.TSSBase, e.tr.TSSLimit, e.taskState.ss0, e.taskState.esp0)
-	}
-	movR32Cr := func() {
-		m := e.parseModRM()
-		// e.setR32(m, e.cr[m.opecode])
-		e.setRm32(m, e.cr[m.opecode])
-	}
-	movCrR32 := func() {
-		m := e.parseModRM()
-		// e.cr[m.opecode] = e.getR32(m)
-		e.cr[m.opecode] = e.getRm32(m)
-		// printf("%d %d\n", m.opecode, e.cr[m.opecode])
-		// if m.opecode == 4 && e.cr[m.opecode]&CR4PageSizeExtension != 0 {
-		if m.opecode == 3 {
-			if e.cr[4]&CR4PageSizeExtension != 0 {
-				printf("CR4 page size sxtension Enabled (Page size is 4MB).\n")
-				e.PageSizeExtensionEable = true
-			} else {
-				printf("CR4 page size sxtension Disabled (Page size is 4KB).\n")
-				e.PageSizeExtensionEable = false
-			}
-			e.cr[4] &^= CR4PageSizeExtension
-			printf("CR3 Page Directory Table is at 0x%08x\n", e.cr[m.opecode]>>12)
-			printf("Page Directory Table[%d] = 0x%08x\n",
-				0, e.getMemory32((e.cr[m.opecode]>>22)+4*0))
-			printf("Page Directory Table[%d] = 0x%08x\n",
-				512, e.getMemory32((e.cr[m.opecode]>>22)+4*512))
+	if m.opecode == 3 {
+		printf("CR3 Page Directory Table is at 0x%08x\n", e.cr[m.opecode]&0xFFFFF000)
+		for _, i := range []uint32{0, 512, 513} {
 			printf("Page Directory Table[%d] = 0x%08x\n",
-				513, e.getMemory32((e.cr[m.opecode]>>22)+4*513))
-		} else if m.opecode == 0 && e.cr[m.opecode]&CR0PagingFlag != 0 {
-			printf("CR0 paging is Enabled.\n")
+				i, e.readPhysical32(e.cr[m.opecode]&0xFFFFF000+4*i))
 		}
+	} else if m.opecode == 0 && e.cr[m.opecode]&CR0PagingFlag != 0 {
+		printf("CR0 paging is Enabled.\n")
+	} else if m.opecode == 4 && e.cr[m.opecode]&CR4PageSizeExtension != 0 {
+		printf("CR4 page size sxtension Enabled (4MB pages are available).\n")
 	}
-	MovzxR32Rm8 := func() {
-		m := e.parseModRM()
-		// e.setRegister32(m.opecode, uint32(e.getMemory8(e.calcMemoryAddress32(m))))
+}
+
+func (e *Emulator) movzxR32Rm8(inst *Instruction) {
+	m := inst.modrm
+	if inst.opsize == 16 {
+		e.setRegister16(m.opecode, uint16(e.getRm8(m)))
+	} else {
 		e.setRegister32(m.opecode, uint32(e.getRm8(m)))
 	}
-	cmoveR32Rm32 := func() {
-		m := e.parseModRM()
-		rm32 := e.getRm32(m)
-		if e.eflags.isEnable(ZeroFlag) {
-			e.setR32(m, rm32)
-		}
-	}
-	MovzxR32Rm16 := func() {
-		m := e.parseModRM()
-		// printf("m.disp32=0x%x\n", m.disp32)
-		// e.setRegister32(m.opecode, uint32(e.getMemory16(m.disp32)))
+}
+
+func (e *Emulator) movzxR32Rm16(inst *Instruction) {
+	m := inst.modrm
+	if inst.opsize == 16 {
+		e.setRegister16(m.opecode, e.getRm16(m))
+	} else {
 		e.setRegister32(m.opecode, uint32(e.getRm16(m)))
 	}
-	MovsxR32Rm8 := func() {
-		m := e.parseModRM()
-		value := uint32(e.getRm8(m))
-		if value&0x80 != 0 {
-			value |= 0xFFFFFF00
-		}
-		e.setRegister32(m.opecode, value)
-	}
-	seteRm8 := func() {
-		m := e.parseModRM()
-		if e.eflags.isEnable(ZeroFlag) {
-			e.setRm8(m, 1)
-		} else {
-			e.setRm8(m, 0)
-		}
-	}
-	MovsxR32Rm16 := func() {
-		m := e.parseModRM()
-		// printf("m.disp32=0x%x\n", m.disp32)
-		value := uint32(e.getMemory16(m.disp32))
-		if value&0x8000 != 0 {
-			value |= 0xFFFF0000
-		}
-		e.setRegister32(m.opecode, value)
-	}
-	// panic: EIP=0x80107eff 0x0F 0x82 is not implemented
-	jb := func() {
-		// printf("jb @emu")
-		rel := e.getCode32(0)
-		e.eip += 4
-		if e.eflags.isEnable(CarryFlag) {
-			e.eip += rel
-		}
-	}
-	jne := func() {
-		rel := e.getCode32(0)
-		e.eip += 4
-		if !e.eflags.isEnable(ZeroFlag) {
-			e.eip += rel
-		}
-	}
-	je := func() {
-		rel := e.getCode32(0)
-		e.eip += 4
-		if e.eflags.isEnable(ZeroFlag) {
-			e.eip += rel
-		}
-	}
-	jg := func() {
-		rel := e.getCode32(0)
-		e.eip += 4
-		if !e.eflags.isEnable(ZeroFlag) && e.eflags.isEnable(SignFlag) == e.eflags.isEnable(OverflowFlag) {
-			e.eip += rel
-		}
-	}
-	jae := func() {
-		rel := e.getCode32(0)
-		e.eip += 4
-		if !e.eflags.isEnable(CarryFlag) {
-			e.eip += rel
-		}
-	}
-	ja := func() {
-		rel := e.getCode32(0)
-		e.eip += 4
-		if !e.eflags.isEnable(ZeroFlag) && !e.eflags.isEnable(CarryFlag) {
-			e.eip += rel
-		}
-	}
+}
 
-	second := e.getCode8(1)
-	e.eip += 2
-	if second == 0x00 {
-		ltrRm16()
-	} else if second == 0x01 {
-		lgdt()
-	} else if second == 0x20 {
-		movR32Cr()
-	} else if second == 0x22 {
-		movCrR32()
-	} else if second == 0x44 {
-		cmoveR32Rm32()
-	} else if second == 0x82 {
-		jb()
-	} else if second == 0x83 {
-		jae()
-	} else if second == 0x84 {
-		je()
-	} else if second == 0x85 {
-		jne()
-	} else if second == 0x87 {
-		ja()
-	} else if second == 0x8f {
-		jg()
-	} else if second == 0xB6 {
-		MovzxR32Rm8()
-	} else if second == 0xB7 {
-		MovzxR32Rm16()
-	} else if second == 0xBe {
-		MovsxR32Rm8()
-	} else if second == 0xBf {
-		MovsxR32Rm16()
-	} else if second == 0x94 {
-		seteRm8()
+func (e *Emulator) movsxR32Rm8(inst *Instruction) {
+	m := inst.modrm
+	value := uint32(e.getRm8(m))
+	if value&0x80 != 0 {
+		value |= 0xFFFFFF00
+	}
+	if inst.opsize == 16 {
+		e.setRegister16(m.opecode, uint16(value))
 	} else {
-		panic(fmt.Sprintf("EIP=0x%x 0x0F 0x%x is not implemented\n", e.eip-1, second))
+		e.setRegister32(m.opecode, value)
 	}
 }
 
-func (e *Emulator) intImm8() {
-	value := e.getCode8(1)
-	if value == 0x10 && e.getRegister16(AX) == 0x13 {
-		// TODO: change video mode, 16color, 80x25
-	} else if value == 0x10 && e.getRegister8(AH) == 0x0e {
-		charCode := e.getRegister8(AL)
-		fmt.Fprintf(e.writer, "%c", charCode)
+func (e *Emulator) movsxR32Rm16(inst *Instruction) {
+	m := inst.modrm
+	value := uint32(e.getRm16(m))
+	if value&0x8000 != 0 {
+		value |= 0xFFFF0000
+	}
+	if inst.opsize == 16 {
+		e.setRegister16(m.opecode, uint16(value))
 	} else {
-		panic(fmt.Sprintf("int not implemented"))
+		e.setRegister32(m.opecode, value)
 	}
-	e.eip += 2
 }
 
-func (e *Emulator) outAlImm8() {
-	address := uint16(e.getCode8(1))
+func (e *Emulator) outAlImm8(inst *Instruction) {
+	address := uint16(inst.imm)
+	e.checkIOPermission(address, 8)
 	value := e.getRegister8(AL)
 	e.io.out8(address, value)
-	e.eip += 2
 }
 
-func (e *Emulator) inAlImm8() {
-	address := uint16(e.getCode8(1))
+func (e *Emulator) inAlImm8(inst *Instruction) {
+	address := uint16(inst.imm)
+	e.checkIOPermission(address, 8)
 	value := e.io.in8(address)
 	e.setRegister8(AL, value)
-	e.eip += 2
-}
-
-func (e *Emulator) inAxImm8() {
-	panic(fmt.Sprintf("inAxImm8 not implemented"))
-}
-
-func (e *Emulator) inEaxImm8() {
-	panic(fmt.Sprintf("inEaxImm8 not implemented"))
 }
 
-func (e *Emulator) movR16Imm16() {
-	reg := e.getCode8(0) - 0xB8
-	value := e.getCode16(1)
-	e.setRegister16(reg, value)
-	e.eip += 3
-}
-
-func (e *Emulator) movR32Imm32() {
-	reg := e.getCode8(0) - 0xB8
-	value := e.getCode32(1)
-	e.registers[reg] = value
-	e.eip += 5
+func (e *Emulator) movRImm(inst *Instruction) {
+	reg := uint8(inst.opecode - 0xB8)
+	if inst.opsize == 16 {
+		e.setRegister16(reg, uint16(inst.imm))
+	} else {
+		e.setRegister32(reg, inst.imm)
+	}
 }
 
-func (e *Emulator) movEaxMoffs32() {
-	value := e.getMemory32(e.getCode32(1))
+func (e *Emulator) movEaxMoffs32(inst *Instruction) {
+	if inst.opsize == 16 {
+		e.setRegister16(AX, e.getMemory16(e.linearAddress(inst.segment, inst.imm, 2, false)))
+		return
+	}
+	value := e.getMemory32(e.linearAddress(inst.segment, inst.imm, 4, false))
 	// printf("value=0x%x\n", value)
 	e.setRegister32(EAX, value)
-	e.eip += 5
 }
 
-func (e *Emulator) movMoffs32Eax() {
+func (e *Emulator) movMoffs32Eax(inst *Instruction) {
+	if inst.opsize == 16 {
+		e.setMemory16(e.linearAddress(inst.segment, inst.imm, 2, true), e.getRegister16(AX))
+		return
+	}
 	value := e.getRegister32(EAX)
 	// printf("value=0x%x\n", value)
-	// e.setRegister32(EAX, value)
-	e.setMemory32(e.getCode32(1), value)
-	e.eip += 5
+	e.setMemory32(e.linearAddress(inst.segment, inst.imm, 4, true), value)
 }
 
-func (e *Emulator) movRm8Imm8() {
-	e.eip++
-	m := e.parseModRM()
-	value := e.getCode8(0)
-	e.eip ++
-	e.setRm8(m, value)
+func (e *Emulator) movRm8Imm8(inst *Instruction) {
+	e.setRm8(inst.modrm, uint8(inst.imm))
 }
 
-func (e *Emulator) movRm32Imm32() {
-	e.eip++
-	m := e.parseModRM()
-	value := e.getCode32(0)
-	e.eip += 4
-	e.setRm32(m, value)
+func (e *Emulator) movRm32Imm32(inst *Instruction) {
+	if inst.opsize == 16 {
+		e.setRm16(inst.modrm, uint16(inst.imm))
+	} else {
+		e.setRm32(inst.modrm, inst.imm)
+	}
 }
 
-func (e *Emulator) orEaxImm32() {
-	value := e.getCode32(1) | e.getRegister32(EAX)
-	e.setRegister32(EAX, value)
-	e.eip += 5
+func (e *Emulator) incRm32(inst *Instruction) {
+	if inst.opsize == 16 {
+		rm16 := uint32(e.getRm16(inst.modrm))
+		e.setRm16(inst.modrm, uint16(rm16+1))
+		e.eflags.updateByInc(rm16, rm16+1, 16)
+		return
+	}
+	rm32 := e.getRm32(inst.modrm)
+	e.setRm32(inst.modrm, rm32+1)
+	e.eflags.updateByInc(rm32, rm32+1, 32)
 }
 
-func (e *Emulator) addEaxImm32() {
-	value := e.getCode32(1) + e.getRegister32(EAX)
-	e.setRegister32(EAX, value)
-	e.eip += 5
+func (e *Emulator) decRm32(inst *Instruction) {
+	if inst.opsize == 16 {
+		rm16 := uint32(e.getRm16(inst.modrm))
+		e.setRm16(inst.modrm, uint16(rm16-1))
+		e.eflags.updateByDec(rm16, rm16-1, 16)
+		return
+	}
+	rm32 := e.getRm32(inst.modrm)
+	e.setRm32(inst.modrm, rm32-1)
+	e.eflags.updateByDec(rm32, rm32-1, 32)
 }
 
-func (e *Emulator) subEaxImm32() {
-	value := e.getCode32(1) - e.getRegister32(EAX)
-	e.setRegister32(EAX, value)
-	e.eip += 5
-}
-
-func (e *Emulator) code81() {
-	addRm32Imm32 := func(e *Emulator, m ModRM) {
-		rm32 := e.getRm32(m)
-		imm32 := e.getCode32(0)
-		e.eip += 4
-		result := uint64(rm32) + uint64(imm32)
-		e.setRm32(m, uint32(result))
-	}
-	andRm32Imm32 := func(e *Emulator, m ModRM) {
-		rm32 := e.getRm32(m)
-		imm32 := e.getCode32(0)
-		e.eip += 4
-		// printf("rm32 value=0x%x imm32 value=0x%x\n", rm32, imm32)
-		result := uint64(rm32) & uint64(imm32)
-		e.setRm32(m, uint32(result))
-	}
-	orRm32Imm32 := func(e *Emulator, m ModRM) {
-		rm32 := e.getRm32(m)
-		imm32 := e.getCode32(0)
-		e.eip += 4
-		// printf("rm32 value=0x%x imm32 value=0x%x\n", rm32, imm32)
-		result := uint64(rm32) | uint64(imm32)
-		e.setRm32(m, uint32(result))
-	}
-	cmpRm32Imm32 := func(e *Emulator, m ModRM) {
-		rm32 := e.getRm32(m)
-		imm32 := e.getCode32(0)
-		// printf("cmpRm32Imm32: eip=%x rm32 value=0x%x imm32 value=0x%x @emu\n", e.eip, rm32, imm32)
-		e.eip += 4
-		result := uint64(rm32) - uint64(imm32)
-		e.eflags.updateBySub(rm32, imm32, result)
-		// e.setRm32(m, uint32(result))
-	}
-
-	e.eip++
-	m := e.parseModRM()
-
-	if e.genuineProtectedEnable == false && e.operandSizeOverride == false ||
-		e.genuineProtectedEnable == true && e.operandSizeOverride == true {
-		panic("16bit mode is not implemented")
-	}
-
-	switch m.opecode {
-	case 0:
-		addRm32Imm32(e, m)
-	case 1:
-		orRm32Imm32(e, m)
-	case 4:
-		andRm32Imm32(e, m)
-	case 7:
-		cmpRm32Imm32(e, m)
-	default:
-		panic(fmt.Sprintf("EIP=0x%x code=81 opecode=%d ", e.eip, m.opecode) + "not implemented")
-	}
-}
-
-func (e *Emulator) code80() {
-	// cmpRm32Imm8 := func(e *Emulator, m ModRM) {
-	// 	rm32 := e.getRm32(m)
-	// 	imm8 := uint32(e.getSignCode8(0))
-	// 	e.eip++
-	// 	result := uint64(rm32) - uint64(imm8)
-	// 	e.eflags.updateBySub(rm32, imm8, result)
-	// }
-	orRm8Imm8 := func(e *Emulator, m ModRM) {
-		rm8 := e.getRm8(m)
-		imm8 := e.getCode8(0)
-		e.eip++
-		e.setRm8(m, rm8|imm8)
-		e.eflags.updateByAndOr8(rm8 | imm8)
-	}
-	andRm8Imm8 := func(e *Emulator, m ModRM) {
-		rm8 := e.getRm8(m)
-		imm8 := e.getCode8(0)
-		e.eip++
-		e.setRm8(m, rm8&imm8)
-		e.eflags.updateByAndOr8(rm8 & imm8)
-	}
-	cmpRm8Imm8 := func(e *Emulator, m ModRM) {
-		imm8 := e.getCode8(0)
-		rm8 := e.getRm8(m)
-		e.eip++
-		result := uint16(rm8) - uint16(imm8)
-		e.eflags.updateBySub8(rm8, imm8, result)
-	}
-
-	e.eip++
-	m := e.parseModRM()
-
-	if e.genuineProtectedEnable == false && e.operandSizeOverride == false ||
-		e.genuineProtectedEnable == true && e.operandSizeOverride == true {
-		panic("16bit mode is not implemented")
-	}
-
-	switch m.opecode {
-	case 1:
-		orRm8Imm8(e, m)
-	case 4:
-		andRm8Imm8(e, m)
-	case 7:
-		cmpRm8Imm8(e, m)
-	default:
-		panic(fmt.Sprintf("EIP=0x%x opecode = %d\n", e.eip, m.opecode) + "not implemented")
-	}
-}
-
-func (e *Emulator) code83() {
-	subRm32Imm8 := func(e *Emulator, m ModRM) {
-		rm32 := e.getRm32(m)
-		imm8 := uint32(e.getSignCode8(0))
-		e.eip++
-		result := uint64(rm32) - uint64(imm8)
-		e.setRm32(m, uint32(result))
-		e.eflags.updateBySub(rm32, imm8, result)
-	}
-	addRm32Imm8 := func(e *Emulator, m ModRM) {
-		rm32 := e.getRm32(m)
-		imm8 := uint32(e.getSignCode8(0))
-		e.eip++
-		e.setRm32(m, rm32+imm8)
-	}
-	andRm32Imm8 := func(e *Emulator, m ModRM) {
-		rm32 := e.getRm32(m)
-		imm8 := uint32(e.getSignCode8(0))
-		e.eip++
-		e.setRm32(m, rm32&uint32(imm8))
-	}
-	orRm32Imm8 := func(e *Emulator, m ModRM) {
-		rm32 := e.getRm32(m)
-		imm8 := uint32(e.getSignCode8(0))
-		e.eip++
-		e.setRm32(m, rm32|uint32(imm8))
-	}
-	cmpRm32Imm8 := func(e *Emulator, m ModRM) {
-		rm32 := e.getRm32(m)
-		imm8 := uint32(e.getSignCode8(0))
-		e.eip++
-		result := uint64(rm32) - uint64(imm8)
-		e.eflags.updateBySub(rm32, imm8, result)
-	}
-	e.eip++
-	m := e.parseModRM()
-
-	if e.genuineProtectedEnable == false && e.operandSizeOverride == false ||
-		e.genuineProtectedEnable == true && e.operandSizeOverride == true {
-		panic("16bit mode is not implemented")
-	}
-
-	switch m.opecode {
-	case 0:
-		addRm32Imm8(e, m)
-	case 1:
-		orRm32Imm8(e, m)
-	case 4:
-		andRm32Imm8(e, m)
-	case 5:
-		subRm32Imm8(e, m)
-	case 7:
-		cmpRm32Imm8(e, m)
-	default:
-		panic(fmt.Sprintf("opecode = %d\n", m.opecode) + "not implemented")
-	}
-}
-
-func (e *Emulator) codeC1() {
-	e.eip++
-	m := e.parseModRM()
-
-	shrRm32Imm8 := func(e *Emulator, m ModRM) {
-		rm32 := e.getRm32(m)
-		imm8 := uint32(e.getCode8(0))
-		e.eip++
-		e.setRm32(m, rm32>>imm8)
-		// TODO: change elfags
-	}
-
-	sarRm32Imm8 := func(e *Emulator, m ModRM) {
-		rm32 := e.getRm32(m)
-		sign := rm32 & 0x80000000
-		imm8 := uint32(e.getCode8(0))
-		e.eip++
-		e.setRm32(m, ((rm32>>imm8)&0x7FFFFFFF)|sign)
-		// TODO: change elfags
-	}
-
-	shlRm32Imm8 := func(e *Emulator, m ModRM) {
-		rm32 := e.getRm32(m)
-		imm8 := uint32(e.getCode8(0))
-		e.eip++
-		e.setRm32(m, rm32<<imm8)
-		// TODO: change elfags
-	}
-
-	switch m.opecode {
-	case 4:
-		shlRm32Imm8(e, m)
-	case 5:
-		shrRm32Imm8(e, m)
-	case 7:
-		sarRm32Imm8(e, m)
-	default:
-		panic(fmt.Sprintf("EIP=0x%x opecode=%d ", e.eip-2, m.opecode) + "not implemented at codeC1")
-	}
-}
-
-func (e *Emulator) codeFf() {
-	incRm32 := func(e *Emulator, m ModRM) {
-		rm32 := e.getRm32(m)
-		e.setRm32(m, rm32+1)
-	}
-	decRm32 := func(e *Emulator, m ModRM) {
-		rm32 := e.getRm32(m)
-		e.setRm32(m, rm32-1)
-	}
-	pushRm32 := func(e *Emulator, m ModRM) {
-		rm32 := e.getRm32(m)
-		e.push32(rm32)
-	}
-	callRm32 := func(e *Emulator, m ModRM) {
-		address := e.calcMemoryAddress32(m)
-		jmpAddress := e.getMemory32(address)
-		e.push32(e.eip + 6)
-		// printf("address=0x%x jmpAddress=0x%x\n", address, jmpAddress)
-		e.eip = jmpAddress
-	}
-	jmpRm32 := func(e *Emulator, m ModRM) {
-		address := e.getRm32(m)
-		// address := e.calcMemoryAddress32(m)
-		// printf("jmpRm32 address=0x%x address2=0x%x\n", address, e.getMemory32(address))
-		e.eip = address
-	}
-	e.eip++
-	m := e.parseModRM()
-	switch m.opecode {
-	case 0:
-		incRm32(e, m)
-	case 1:
-		decRm32(e, m)
-	case 2:
-		callRm32(e, m)
-	// case 3:
-	// 	callM16(e, m)
-	case 4:
-		jmpRm32(e, m)
-	// case 5:
-	// 	jmpM16(e, m)
-	case 6:
-		pushRm32(e, m)
-	default:
-		panic(fmt.Sprintf("opecode = %d\n", m.opecode) + "not implemented at codeFf")
-	}
-}
-
-func (e *Emulator) movRm8R8() {
-	e.eip++
-	m := e.parseModRM()
-	r8 := e.getR8(m)
-	e.setRm8(m, r8)
+func (e *Emulator) pushRm32(inst *Instruction) {
+	if inst.opsize == 16 {
+		e.push16(e.getRm16(inst.modrm))
+		return
+	}
+	rm32 := e.getRm32(inst.modrm)
+	e.push32(rm32)
 }
 
-func (e *Emulator) cmpRm8R8() {
-	e.eip++
-	m := e.parseModRM()
-	r8 := e.getR8(m)
-	rm8 := e.getRm8(m)
-	result := uint16(rm8) - uint16(r8)
-	e.eflags.updateBySub8(rm8, r8, result)
+func (e *Emulator) callRm32(inst *Instruction) {
+	if inst.opsize == 16 {
+		jmpAddress := e.getRm16(inst.modrm)
+		e.push16(uint16(e.eip))
+		e.eip = uint32(jmpAddress)
+		return
+	}
+	jmpAddress := e.getRm32(inst.modrm)
+	e.push32(e.eip)
+	e.eip = jmpAddress
 }
 
-func (e *Emulator) xorRm16R16() {
-	e.eip++
-	m := e.parseModRM()
-	e.setRm16(m, e.getRm16(m)^e.getR16(m))
+func (e *Emulator) jmpRm32(inst *Instruction) {
+	if inst.opsize == 16 {
+		e.eip = uint32(e.getRm16(inst.modrm))
+	} else {
+		e.eip = e.getRm32(inst.modrm)
+	}
 }
 
-func (e *Emulator) xorRm32R32() {
-	e.eip++
-	m := e.parseModRM()
-	e.setRm32(m, e.getRm32(m)^e.getR32(m))
+func (e *Emulator) movRm8R8(inst *Instruction) {
+	m := inst.modrm
+	r8 := e.getR8(m)
+	e.setRm8(m, r8)
 }
 
-func (e *Emulator) movRm32R32() {
-	e.eip++
-	m := e.parseModRM()
+func (e *Emulator) movRm32R32(inst *Instruction) {
+	m := inst.modrm
+	if inst.opsize == 16 {
+		e.setRm16(m, e.getR16(m))
+		return
+	}
 	r32 := e.getR32(m)
 	e.setRm32(m, r32)
 }
 
-func (e *Emulator) subRm32R32() {
-	e.eip++
-	m := e.parseModRM()
-	rm32 := e.getRm32(m)
-	r32 := e.getR32(m)
-	// printf("rm32=0x%x r32=0x%x\n", rm32, r32)
-	e.setRm32(m, rm32-r32)
-}
-
-func (e *Emulator) xchg() {
-	e.eip++
-	m := e.parseModRM()
+func (e *Emulator) xchg(inst *Instruction) {
+	m := inst.modrm
+	if inst.opsize == 16 {
+		r16 := e.getR16(m)
+		rm16 := e.getRm16(m)
+		e.setR16(m, rm16)
+		e.setRm16(m, r16)
+		return
+	}
 	r32 := e.getR32(m)
 	rm32 := e.getRm32(m)
 	e.setR32(m, rm32)
 	e.setRm32(m, r32)
 }
 
-func (e *Emulator) orRm32R32() {
-	e.eip++
-	m := e.parseModRM()
-	r32 := e.getR32(m)
-	rm32 := e.getRm32(m)
-	e.setRm32(m, r32|rm32)
-}
-
-func (e *Emulator) addRm32R32() {
-	e.eip++
-	m := e.parseModRM()
-	r32 := e.getR32(m)
-	rm32 := e.getRm32(m)
-	e.setRm32(m, r32+rm32)
-}
-
-func (e *Emulator) orR32Rm32() {
-	e.eip++
-	m := e.parseModRM()
-	r32 := e.getR32(m)
-	rm32 := e.getRm32(m)
-	e.setR32(m, r32|rm32)
-}
-
-func (e *Emulator) imulR32Rm32Imm32() {
-	e.eip++
-	m := e.parseModRM()
-	rm32 := e.getRm32(m)
-	imm32 := e.getCode32(0)
-	e.eip += 4
-	e.setR32(m, rm32*imm32)
-	// e.eflags.updateByImul(rm32, imm32, rm32*imm32) // FIXME
-}
-
-func (e *Emulator) addR32Rm32() {
-	e.eip++
-	m := e.parseModRM()
-	r32 := e.getR32(m)
-	rm32 := e.getRm32(m)
-	e.setR32(m, r32+rm32)
-}
-
-func (e *Emulator) leaR32Rm32() {
-	e.eip++
-	m := e.parseModRM()
+func (e *Emulator) leaR32Rm32(inst *Instruction) {
+	m := inst.modrm
 	// printf("leaR32Rm32 r=%d\n", m.opecode)
-	e.setR32(m, e.calcMemoryAddress32(m))
+	if inst.opsize == 16 {
+		e.setR16(m, uint16(e.calcMemoryAddress(m)))
+	} else {
+		e.setR32(m, e.calcMemoryAddress(m))
+	}
 }
 
-func (e *Emulator) movR32Rm32() {
-	e.eip++
-	m := e.parseModRM()
+func (e *Emulator) movR32Rm32(inst *Instruction) {
+	m := inst.modrm
+	if inst.opsize == 16 {
+		e.setR16(m, e.getRm16(m))
+		return
+	}
 	rm32 := e.getRm32(m)
 	e.setR32(m, rm32)
 }
 
 // 16 bit mode
-func (e *Emulator) movSregRm16() {
-	e.eip++
-	m := e.parseModRM()
+func (e *Emulator) movSregRm16(inst *Instruction) {
+	m := inst.modrm
+	if m.opecode == CS || m.opecode > GS {
+		raise(vectorUD)
+	}
 	rm16 := e.getRm16(m)
 	// printf("m.opecode=%d\n", m.opecode)
 	e.setSreg16(m.opecode, rm16)
 }
 
-func (e *Emulator) movsb() {
-	e.eip++
-	c := e.getMemory8(ESI)
-	e.setMemory8(EDI,c )
-
-	if e.eflags.isEnable(DirectionFlag) {
-		e.decRegister32(ESI, 1)
-		e.decRegister32(EDI, 1)
-	} else {
-		e.incRegister32(ESI, 1)
-		e.incRegister32(EDI, 1)
-	}
-}
-
-func (e *Emulator) movR8Rm8() {
-	e.eip++
-	m := e.parseModRM()
+func (e *Emulator) movR8Rm8(inst *Instruction) {
+	m := inst.modrm
 	rm8 := e.getRm8(m)
 	e.setR8(m, rm8)
 }
 
-func (e *Emulator) movR8Imm8() {
-	reg := e.getCode8(0) - 0xB0
-	e.setRegister8(reg, e.getCode8(1))
-	e.eip += 2
-}
-
-func (e *Emulator) cmpR32Rm32() {
-	e.eip++
-	m := e.parseModRM()
-	r32 := e.getR32(m)
-	rm32 := e.getRm32(m)
-	result := uint64(r32) - uint64(rm32)
-	e.eflags.updateBySub(r32, rm32, result)
-}
-
-func (e *Emulator) cmpRm32R32() {
-	e.eip++
-	m := e.parseModRM()
-	r32 := e.getR32(m)
-	rm32 := e.getRm32(m)
-	result := uint64(rm32) - uint64(r32)
-	e.eflags.updateBySub(rm32, r32, result)
-}
-
-func (e *Emulator) cmpEaxImm32() {
-	ax := e.getRegister32(EAX)
-	value := e.getCode32(1)
-	result := uint64(ax) - uint64(value)
-	e.eip += 5
-	e.eflags.updateBySub(ax, value, result)
+func (e *Emulator) movR8Imm8(inst *Instruction) {
+	reg := uint8(inst.opecode - 0xB0)
+	e.setRegister8(reg, uint8(inst.imm))
 }
 
-func (e *Emulator) testEaxImm32() {
-	ax := e.getRegister32(EAX)
-	value := e.getCode32(1)
-	result := ax & value
-	if result == 0 {
-		e.eflags.set(ZeroFlag)
+func (e *Emulator) testEaxImm(inst *Instruction) {
+	if inst.opsize == 16 {
+		e.eflags.updateByLogical(uint32(e.getRegister16(AX))&inst.imm, 16)
 	} else {
-		e.eflags.unset(ZeroFlag)
+		e.eflags.updateByLogical(e.getRegister32(EAX)&inst.imm, 32)
 	}
-	e.eflags.unset(CarryFlag)
-	e.eflags.unset(OverflowFlag)
-	e.eflags.updatePF(uint8(result & 0xFF))
-	e.eflags.setVal(SignFlag, result&0x80000000 != 0)
-	e.eip += 5
 }
 
-func (e *Emulator) testRm32R32() {
-	e.eip++
-	m := e.parseModRM()
-	result := e.getRm32(m) & e.getR32(m)
-	if result == 0 {
-		e.eflags.set(ZeroFlag)
-	} else {
-		e.eflags.unset(ZeroFlag)
+func (e *Emulator) testRm32R32(inst *Instruction) {
+	m := inst.modrm
+	if inst.opsize == 16 {
+		result := e.getRm16(m) & e.getR16(m)
+		e.eflags.updateByLogical(uint32(result), 16)
+		return
 	}
-	e.eflags.unset(CarryFlag)
-	e.eflags.unset(OverflowFlag)
-	e.eflags.updatePF(uint8(result & 0xFF))
-	e.eflags.setVal(SignFlag, result&0x80000000 != 0)
+	result := e.getRm32(m) & e.getR32(m)
+	e.eflags.updateByLogical(result, 32)
 }
 
-func (e *Emulator) testRm8R8() {
-	e.eip++
-	m := e.parseModRM()
+func (e *Emulator) testRm8R8(inst *Instruction) {
+	m := inst.modrm
 	result := e.getRm8(m) & e.getR8(m)
-	if result == 0 {
-		e.eflags.set(ZeroFlag)
-	} else {
-		e.eflags.unset(ZeroFlag)
-	}
-	e.eflags.unset(CarryFlag)
-	e.eflags.unset(OverflowFlag)
-	e.eflags.updatePF(uint8(result & 0xFF))
-	e.eflags.setVal(SignFlag, result&0x80 != 0)
+	e.eflags.updateByLogical(uint32(result), 8)
 }
 
-func (e *Emulator) testRm8Imm8() {
-	e.eip++
-	m := e.parseModRM()
-	rm8 := e.getRm8(m)
-	value := e.getCode8(0)
-	e.eip++
+func (e *Emulator) testRm8Imm8(inst *Instruction) {
+	rm8 := e.getRm8(inst.modrm)
+	value := uint8(inst.imm)
 
 	result := uint32(rm8 & value)
-	if result == 0 {
-		e.eflags.set(ZeroFlag)
-	} else {
-		e.eflags.unset(ZeroFlag)
-	}
-	e.eflags.unset(CarryFlag)
-	e.eflags.unset(OverflowFlag)
-	e.eflags.updatePF(uint8(result & 0xFF))
-	e.eflags.setVal(SignFlag, result&0x80 != 0)
-}
-
-// e.setRegister32(m.opecode, uint32(e.getMemory8(m.disp32)))
-func (e *Emulator) testAxImm16() {
-	ax := uint32(e.getRegister16(AX))
-	value := uint32(e.getCode16(1))
-	result := ax & value
-	if result == 0 {
-		e.eflags.set(ZeroFlag)
-	} else {
-		e.eflags.unset(ZeroFlag)
-	}
-	e.eflags.unset(CarryFlag)
-	e.eflags.unset(OverflowFlag)
-	e.eflags.updatePF(uint8(result & 0xFF))
-	e.eflags.setVal(SignFlag, result&0x8000 != 0)
-	e.eip += 3
-}
-
-func (e *Emulator) andEaxImm32() {
-	ax := e.getRegister32(EAX)
-	value := e.getCode32(1)
-	result := ax & value
-	if result == 0 {
-		e.eflags.set(ZeroFlag)
-	} else {
-		e.eflags.unset(ZeroFlag)
-	}
-	e.eflags.unset(CarryFlag)
-	e.eflags.unset(OverflowFlag)
-	e.eflags.updatePF(uint8(result & 0xFF))
-	e.setRegister32(EAX, result)
-	e.eip += 5
-}
-
-func (e *Emulator) andAxImm16() {
-	ax := uint32(e.getRegister16(AX))
-	value := uint32(e.getCode16(1))
-	result := ax & value
-	if result == 0 {
-		e.eflags.set(ZeroFlag)
-	} else {
-		e.eflags.unset(ZeroFlag)
-	}
-	e.eflags.unset(CarryFlag)
-	e.eflags.unset(OverflowFlag)
-	e.eflags.updatePF(uint8(result & 0xFF))
-	e.setRegister16(AX, uint16(result))
-	e.eip += 3
+	e.eflags.updateByLogical(result, 8)
 }
 
-func (e *Emulator) testAlImm8() {
+func (e *Emulator) testAlImm8(inst *Instruction) {
 	al := uint32(e.getRegister8(AL))
-	value := uint32(e.getCode8(1))
+	value := inst.imm
 	result := al & value
-	if result == 0 {
-		e.eflags.set(ZeroFlag)
-	} else {
-		e.eflags.unset(ZeroFlag)
-	}
-	e.eflags.unset(CarryFlag)
-	e.eflags.unset(OverflowFlag)
-	e.eflags.updatePF(uint8(result & 0xFF))
-	e.eflags.setVal(SignFlag, result&0x80 != 0)
-	e.eip += 2
-}
-
-func (e *Emulator) cmpAlImm8() {
-	al := uint32(e.getRegister8(AL))
-	value := uint32(e.getCode8(1))
-	result := uint64(al) - uint64(value)
-	e.eflags.updateBySub(al, value, result)
-	e.eip += 2
+	e.eflags.updateByLogical(result, 8)
 }
 
-func (e *Emulator) shortJmp() {
-	diff := int32(e.getSignCode8(1))
-	if diff < 0 {
-		e.eip = e.eip - uint32(-diff) + uint32(2)
-	} else {
-		e.eip = e.eip + uint32(diff) + uint32(2)
+func (e *Emulator) shortJmp(inst *Instruction) {
+	e.eip += uint32(int8(inst.imm))
+	if inst.opsize == 16 {
+		e.eip &= 0xFFFF
 	}
 }
 
-func (e *Emulator) farJmp() {
-	offset := e.getCode16(1)
-	segmentIndex := e.getCode16(3)
-	e.setSreg16(CS, segmentIndex)
-	e.eip = uint32(offset)
+func (e *Emulator) farJmp(inst *Instruction) {
+	e.loadCodeSegment(uint16(inst.imm2), e.cpl(), 0)
+	e.eip = inst.imm
 }
 
-func (e *Emulator) jmpRel32() {
-	diff := e.getSignCode32(1)
-	if diff < 0 {
-		e.eip = e.eip - uint32(-diff) + uint32(5)
+func (e *Emulator) jmpRel32(inst *Instruction) {
+	if inst.opsize == 16 {
+		e.eip = (e.eip + uint32(int16(inst.imm))) & 0xFFFF
 	} else {
-		e.eip = e.eip + uint32(diff) + uint32(5)
+		e.eip += inst.imm
 	}
 }
 
-func (e *Emulator) pushR32() {
-	reg := e.getCode8(0) - 0x50
-	e.push32(e.getRegister32(reg))
-	e.eip++
-}
-
-func (e *Emulator) pushf() {
-	e.eip++
-	e.push32(uint32(e.eflags))
-}
-
-func (e *Emulator) incR32() {
-	reg := e.getCode8(0) - 0x40
-	e.setRegister32(reg, e.getRegister32(reg)+1)
-	e.eip++
-}
-
-func (e *Emulator) decR32() {
-	reg := e.getCode8(0) - 0x48
-	e.setRegister32(reg, e.getRegister32(reg)-1)
-	e.eip++
-}
-
-func (e *Emulator) popR32() {
-	reg := e.getCode8(0) - 0x58
-	e.setRegister32(reg, e.pop32())
-	e.eip++
-}
-
-func (e *Emulator) pushImm8() {
-	value := uint32(e.getCode8(1))
-	e.push32(value)
-	e.eip += 2
-}
-
-func (e *Emulator) pushImm16() {
-	value := uint32(e.getCode16(1))
-	e.push32(value)
-	e.eip += 3
-}
-
-func (e *Emulator) pushImm32() {
-	value := e.getCode32(1)
-	e.push32(value)
-	e.eip += 5
-}
-
-func (e *Emulator) callRel16() {
-	diff := e.getSingedCode16(1)
-	e.push32(e.eip + 3)
-	if diff < 0 {
-		e.eip = e.eip - uint32(-diff) + uint32(3)
+func (e *Emulator) pushR32(inst *Instruction) {
+	reg := uint8(inst.opecode - 0x50)
+	if inst.opsize == 16 {
+		e.push16(e.getRegister16(reg))
 	} else {
-		e.eip = e.eip + uint32(diff) + uint32(3)
+		e.push32(e.getRegister32(reg))
 	}
 }
 
-func (e *Emulator) callRel32() {
-	diff := e.getSingedCode32(1)
-	e.push32(e.eip + 5)
-	if diff < 0 {
-		e.eip = e.eip - uint32(-diff) + uint32(5)
+func (e *Emulator) pushf(inst *Instruction) {
+	if inst.opsize == 16 {
+		e.push16(uint16(e.eflags.get()))
 	} else {
-		e.eip = e.eip + uint32(diff) + uint32(5)
+		e.push32(e.eflags.get())
 	}
 }
 
-func (e *Emulator) ret() {
-	e.eip = e.pop32()
-}
-
-func (e *Emulator) jnz() {
-	if e.eflags.isEnable(ZeroFlag) {
-		e.eip += uint32(2)
+func (e *Emulator) popf(inst *Instruction) {
+	// the flags which can not be changed in the current privilege level
+	// are kept
+	if inst.opsize == 16 {
+		flags := e.eflags.get()&0xFFFF0000 | uint32(e.pop16())
+		e.eflags.load(e.restrictFlags(flags))
 	} else {
-		e.eip += uint32(2) + uint32(e.getSignCode8(1))
+		e.eflags.load(e.restrictFlags(e.pop32()))
 	}
 }
 
-func (e *Emulator) ja() {
-	if e.eflags.isEnable(CarryFlag) || e.eflags.isEnable(ZeroFlag) {
-		e.eip += uint32(2)
-	} else {
-		e.eip += uint32(2) + uint32(e.getSignCode8(1))
+func (e *Emulator) incR32(inst *Instruction) {
+	reg := uint8(inst.opecode - 0x40)
+	if inst.opsize == 16 {
+		value := uint32(e.getRegister16(reg))
+		e.setRegister16(reg, uint16(value+1))
+		e.eflags.updateByInc(value, value+1, 16)
+		return
 	}
+	value := e.getRegister32(reg)
+	e.setRegister32(reg, value+1)
+	e.eflags.updateByInc(value, value+1, 32)
 }
 
-func (e *Emulator) jb() {
-	if e.eflags.isEnable(CarryFlag) {
-		e.eip += uint32(2) + uint32(e.getSignCode8(1))
-	} else {
-		e.eip += uint32(2)
+func (e *Emulator) decR32(inst *Instruction) {
+	reg := uint8(inst.opecode - 0x48)
+	if inst.opsize == 16 {
+		value := uint32(e.getRegister16(reg))
+		e.setRegister16(reg, uint16(value-1))
+		e.eflags.updateByDec(value, value-1, 16)
+		return
 	}
+	value := e.getRegister32(reg)
+	e.setRegister32(reg, value-1)
+	e.eflags.updateByDec(value, value-1, 32)
 }
 
-func (e *Emulator) jp() {
-	if e.eflags.isEnable(ParityFlag) {
-		e.eip += uint32(2) + uint32(e.getSignCode8(1))
+func (e *Emulator) popR32(inst *Instruction) {
+	reg := uint8(inst.opecode - 0x58)
+	if inst.opsize == 16 {
+		e.setRegister16(reg, e.pop16())
 	} else {
-		e.eip += uint32(2)
+		e.setRegister32(reg, e.pop32())
 	}
 }
 
-func (e *Emulator) jpo() {
-	if e.eflags.isEnable(ParityFlag) {
-		e.eip += uint32(2)
+func (e *Emulator) pushImm8(inst *Instruction) {
+	if inst.opsize == 16 {
+		e.push16(uint16(int8(inst.imm)))
 	} else {
-		e.eip += uint32(2) + uint32(e.getSignCode8(1))
+		e.push32(uint32(int8(inst.imm)))
 	}
 }
 
-func (e *Emulator) jc() {
-	if e.eflags.isEnable(CarryFlag) {
-		e.eip += uint32(2) + uint32(e.getSignCode8(1))
+func (e *Emulator) pushImm(inst *Instruction) {
+	if inst.opsize == 16 {
+		e.push16(uint16(inst.imm))
 	} else {
-		e.eip += uint32(2)
+		e.push32(inst.imm)
 	}
 }
 
-func (e *Emulator) jae() {
-	if e.eflags.isEnable(CarryFlag) {
-		e.eip += uint32(2)
+func (e *Emulator) callRel(inst *Instruction) {
+	if inst.opsize == 16 {
+		e.push16(uint16(e.eip))
+		e.eip = (e.eip + uint32(int16(inst.imm))) & 0xFFFF
 	} else {
-		e.eip += uint32(2) + uint32(e.getSignCode8(1))
+		e.push32(e.eip)
+		e.eip += inst.imm
 	}
 }
 
-func (e *Emulator) jno() {
-	if e.eflags.isEnable(OverflowFlag) {
-		e.eip += uint32(2)
+func (e *Emulator) ret(inst *Instruction) {
+	if inst.opsize == 16 {
+		e.eip = uint32(e.pop16())
 	} else {
-		e.eip += uint32(2) + uint32(e.getSignCode8(1))
+		e.eip = e.pop32()
 	}
 }
 
-func (e *Emulator) jna() {
-	if e.eflags.isEnable(CarryFlag) || e.eflags.isEnable(ZeroFlag) {
-		e.eip += uint32(2) + uint32(e.getSignCode8(1))
-	} else {
-		e.eip += uint32(2)
-	}
+func (e *Emulator) inAlDx(inst *Instruction) {
+	address := e.getRegister16(DX)
+	e.checkIOPermission(address, 8)
+	value := e.io.in8(address)
+	e.setRegister8(AL, value)
 }
 
-func (e *Emulator) jz() {
-	if e.eflags.isEnable(ZeroFlag) {
-		e.eip += uint32(2) + uint32(e.getSignCode8(1))
-	} else {
-		e.eip += uint32(2)
-	}
+func (e *Emulator) outAlDx(inst *Instruction) {
+	address := e.getRegister16(DX)
+	e.checkIOPermission(address, 8)
+	value := e.getRegister8(AL)
+	e.io.out8(address, value)
 }
 
-func (e *Emulator) js() {
-	if e.eflags.isEnable(SignFlag) {
-		e.eip += uint32(2) + uint32(e.getSignCode8(1))
-	} else {
-		e.eip += uint32(2)
-	}
+func (e *Emulator) outAxDx(inst *Instruction) {
+	e.outAx(inst, e.getRegister16(DX))
 }
 
-func (e *Emulator) jns() {
-	if e.eflags.isEnable(SignFlag) {
-		e.eip += uint32(2)
-	} else {
-		e.eip += uint32(2) + uint32(e.getSignCode8(1))
-	}
+func (e *Emulator) inAxDx(inst *Instruction) {
+	e.inAx(inst, e.getRegister16(DX))
 }
 
-func (e *Emulator) jg() {
-	if !e.eflags.isEnable(ZeroFlag) && e.eflags.isEnable(SignFlag) == e.eflags.isEnable(OverflowFlag) {
-		e.eip += uint32(2) + uint32(e.getSignCode8(1))
-	} else {
-		e.eip += uint32(2)
-	}
+func (e *Emulator) outAxImm8(inst *Instruction) {
+	e.outAx(inst, uint16(inst.imm))
 }
 
-func (e *Emulator) jng() {
-	if e.eflags.isEnable(ZeroFlag) || e.eflags.isEnable(SignFlag) != e.eflags.isEnable(OverflowFlag) {
-		e.eip += uint32(2) + uint32(e.getSignCode8(1))
-	} else {
-		e.eip += uint32(2)
-	}
+func (e *Emulator) inAxImm8(inst *Instruction) {
+	e.inAx(inst, uint16(inst.imm))
 }
 
-func (e *Emulator) jl() {
-	if e.eflags.isEnable(SignFlag) != e.eflags.isEnable(OverflowFlag) {
-		e.eip += uint32(e.getSignCode8(1))
-	} else {
-		e.eip += 2
+// write AX or EAX to the port
+func (e *Emulator) outAx(inst *Instruction, address uint16) {
+	if inst.opsize == 32 {
+		e.checkIOPermission(address, 32)
+		e.io.out32(address, e.getRegister32(EAX))
+		return
 	}
+	e.checkIOPermission(address, 16)
+	value := e.getRegister16(AX)
+	e.io.out16(address, value)
 }
 
-func (e *Emulator) jle() {
-	if e.eflags.isEnable(ZeroFlag) || e.eflags.isEnable(SignFlag) != e.eflags.isEnable(OverflowFlag) {
-		e.eip += uint32(e.getSignCode8(1))
-	} else {
-		e.eip += 2
+// read AX or EAX from the port
+func (e *Emulator) inAx(inst *Instruction, address uint16) {
+	if inst.opsize == 32 {
+		e.checkIOPermission(address, 32)
+		e.setRegister32(EAX, e.io.in32(address))
+		return
 	}
-}
-
-func (e *Emulator) inAlDx() {
-	address := e.getRegister16(DX)
-	value := e.io.in8(address)
-	e.setRegister8(AL, value)
-	e.eip++
-}
-
-func (e *Emulator) outAlDx() {
-	address := e.getRegister16(DX)
-	value := e.getRegister8(AL)
-	e.io.out8(address, value)
-	e.eip++
-}
-
-func (e *Emulator) outAxDx() {
-	address := e.getRegister16(DX)
-	value := e.getRegister16(AX)
-	e.io.out16(address, value)
-	e.eip++
+	e.checkIOPermission(address, 16)
+	e.setRegister16(AX, e.io.in16(address))
 }
 
 // util
@@ -1754,7 +932,7 @@ func (e *Emulator) setRm32(m ModRM, value uint32) {
 	if m.mod == 3 {
 		e.setRegister32(m.rm, value)
 	} else {
-		address := e.calcMemoryAddress32(m)
+		address := e.calcLinearAddress(m, 4, true)
 		e.setMemory32(address, value)
 	}
 }
@@ -1763,7 +941,7 @@ func (e *Emulator) getRm32(m ModRM) uint32 {
 	if m.mod == 3 {
 		return e.getRegister32(m.rm)
 	}
-	address := e.calcMemoryAddress32(m)
+	address := e.calcLinearAddress(m, 4, false)
 	// printf("rm32 address=0x%x\n", address)
 	return e.getMemory32(address)
 }
@@ -1772,7 +950,7 @@ func (e *Emulator) setRm16(m ModRM, value uint16) {
 	if m.mod == 3 {
 		e.setRegister16(m.rm, value)
 	} else {
-		address := uint32(e.calcMemoryAddress16(m))
+		address := e.calcLinearAddress(m, 2, true)
 		e.setMemory16(address, value)
 	}
 }
@@ -1781,7 +959,7 @@ func (e *Emulator) getRm16(m ModRM) uint16 {
 	if m.mod == 3 {
 		return e.getRegister16(m.rm) // TODO check OK?
 	}
-	address := e.calcMemoryAddress32(m)
+	address := e.calcLinearAddress(m, 2, false)
 	return e.getMemory16(address)
 }
 
@@ -1789,10 +967,7 @@ func (e *Emulator) getRm8(m ModRM) uint8 {
 	if m.mod == 3 {
 		return e.getRegister8(m.rm) // TODO check OK?
 	}
-	address := e.calcMemoryAddress32(m)
-	if e.cr[0]&1 == 0 {
-		address = uint32(e.calcMemoryAddress16(m))
-	}
+	address := e.calcLinearAddress(m, 1, false)
 	return e.getMemory8(address)
 }
 
@@ -1812,13 +987,8 @@ func (e *Emulator) setR32(m ModRM, value uint32) {
 	e.setRegister32(m.opecode, value)
 }
 
-func (e *Emulator) setSreg16(index uint8, value uint16) {
-	e.sreg[index] = uint32(value)
-	if e.cr[0]&1 == 0x1 {
-		e.genuineProtectedEnable = true
-	} else {
-		e.genuineProtectedEnable = false
-	}
+func (e *Emulator) setR16(m ModRM, value uint16) {
+	e.setRegister16(m.opecode, value)
 }
 
 func (e *Emulator) setR8(m ModRM, value uint8) {
@@ -1829,11 +999,25 @@ func (e *Emulator) setRm8(m ModRM, value uint8) {
 	if m.mod == 3 {
 		e.setRegister8(m.rm, value)
 	} else {
-		address := e.calcMemoryAddress32(m)
+		address := e.calcLinearAddress(m, 1, true)
 		e.setMemory8(address, value)
 	}
 }
 
+// linear address (segment base + effective address) of the memory operand
+// to access size bytes
+func (e *Emulator) calcLinearAddress(m ModRM, size uint32, write bool) uint32 {
+	return e.linearAddress(m.segment, e.calcMemoryAddress(m), size, write)
+}
+
+// effective address of the memory operand
+func (e *Emulator) calcMemoryAddress(m ModRM) uint32 {
+	if m.address16 {
+		return uint32(e.calcMemoryAddress16(m))
+	}
+	return e.calcMemoryAddress32(m)
+}
+
 func (e *Emulator) calcMemoryAddress16(m ModRM) uint16 {
 	if m.mod == 0 {
 		// [register + resiger]
@@ -1870,8 +1054,9 @@ func (e *Emulator) calcMemoryAddress16(m ModRM) uint16 {
 		m.mod = 0
 		return uint16(int32(e.calcMemoryAddress16(m)) + int32(m.getDisp16()))
 	}
-	// register
-	panic("ModRM mod = 4 is not implemented")
+	// register, the instruction needs a memory operand
+	raise(vectorUD)
+	return 0
 }
 
 func (e *Emulator) calcMemoryAddress32(m ModRM) uint32 {
@@ -1915,8 +1100,9 @@ func (e *Emulator) calcMemoryAddress32(m ModRM) uint32 {
 		result += m.disp32
 		return result
 	}
-	// register
-	panic("ModRM mod = 4 is not implemented")
+	// register, the instruction needs a memory operand
+	raise(vectorUD)
+	return 0
 }
 
 func (e *Emulator) setRegister32(rm uint8, value uint32) {
@@ -1958,131 +1144,57 @@ func (e *Emulator) decRegister32(rm uint8, value uint32) {
 	e.registers[rm] -= value
 }
 
-// virtual address -> segmentation -> linear address -> paging -> physical address
-func (e *Emulator) v2p(vaddress uint32) uint32 {
-	var paddress uint32
-	if (e.cr[0]&CR0PagingFlag != 0) && e.PageSizeExtensionEable {
-		// 4MB paging (super page)
-		var pdtEntry uint32
-		for i := uint32(0); i < 4; i++ {
-			pdtEntry |= uint32(e.memory[(e.cr[3]&0xFFC00000)+4*(vaddress>>22)+i]) << uint32(i*8)
-		}
-		paddress = pdtEntry&0xFFC00000 + vaddress&0x003FFFFF
-		if vaddress-paddress != 0 && vaddress-paddress != 0x80000000 {
-			printf("pdtEntry=0x%x index=%d offset=0x%x vaddress=0x%x paddress=pdtEntry+offset=0x%x\n",
-				pdtEntry, vaddress>>22, vaddress&0x003FFFFF, vaddress, paddress)
-		}
-	} else if e.cr[0]&CR0PagingFlag != 0 {
-		// 4KB paging
-		var pdtEntry uint32
-		for i := uint32(0); i < 4; i++ {
-			pdtEntry |= uint32(e.memory[(e.cr[3]&0xFFFFF000)+4*(vaddress>>22)+i]) << uint32(i*8)
-		}
-		var ptEntry uint32
-		for i := uint32(0); i < 4; i++ {
-			ptEntry |= uint32(e.memory[(pdtEntry&0xFFFFF000)+4*((vaddress>>12)&0x3FF)+i]) << uint32(i*8)
-		}
-		paddress = ptEntry&0xFFFFF000 + vaddress&0xFFF
-		if vaddress-paddress != 0 && vaddress-paddress != 0x80000000 {
-			// printf("PDE base=0x%x PTE base=0x%x PDT index=%d PT index=%d vaddress=0x%x paddress=0x%x\n",
-			// 	e.cr[3]&0xFFFFF000, pdtEntry&0xFFFFF000, vaddress>>22, (vaddress>>12)&0x3FF, vaddress, paddress)
-		}
-	} else {
-		// printf("PageSizeExtension is disabled.\n")
-		paddress = vaddress
-	}
-	return paddress
-}
-
-// Memory mapped I/O
-// TODO: Use paddr
-const (
-	ID    = 0x0020
-	SVR   = 0x00F0
-	ICRLO = 0x0300
-	TIMER = 0x0320
-	TICR  = 0x0380
-	TDCR  = 0x03E0
-)
-
-var (
-	ioapicData uint32
-)
-
 func (e *Emulator) setMemory8(address uint32, value uint8) {
-	paddr := e.v2p(address)
-
-	if address == LocalAPICBase+SVR+1 && value&0x01 == 0x01 {
-		printf("Local APIC Enabled vaddr=0x%x paddr=0x%x\n", address, paddr)
-		return
-	} else if address == LocalAPICBase+TIMER+2 && value&0x02 == 0x02 {
-		printf("Timer PERIODIC Enabled vaddr=0x%x paddr=0x%x\n", address, paddr)
-		return
-	} else if paddr > PHYSTOP {
-		// printf("Invalid paddress: 0x%x\n", paddr)
-		return
-	}
-
-	e.memory[paddr] = value
+	e.bus.write(e.translate(address, true), 8, uint32(value))
 }
 
 func (e *Emulator) setMemory16(address uint32, value uint16) {
-	for i := uint32(0); i < 2; i++ {
-		e.setMemory8(address+i, uint8(value>>uint32(i*8)&0xFF))
-	}
+	e.writeLinear(address, 16, uint32(value))
 }
 
 func (e *Emulator) setMemory32(address, value uint32) {
-	if address == IOAPICBase && value == 0x00 {
-		ioapicData = 1 << 24
-		printf("ioapic read is called. I have to return ioapicid\n")
-	}
-	for i := uint32(0); i < 4; i++ {
-		e.setMemory8(address+i, uint8(value>>uint32(i*8)&0xFF))
-	}
+	e.writeLinear(address, 32, value)
 }
 
-// TODO: consider linear address transformation using DS
 func (e *Emulator) getMemory8(address uint32) uint8 {
-	// printf("vaddr=%x paddr=%x\n", address, e.v2p(address))
-	paddr := e.v2p(address)
-
-	if LocalAPICBase+ICRLO <= address && address <= LocalAPICBase+ICRLO+3 {
-		printf("synched ICRLO = 0\n")
-		// e.memory[paddr] = 0
-		return 0
-	} else if LocalAPICBase+ID+3 == address {
-		// e.memory[paddr] = 1
-		return 1
-	} else if paddr > PHYSTOP {
-		// printf("Invalid paddress: 0x%x\n", paddr)
-		return 0
-	}
-
-	return e.memory[paddr]
+	return uint8(e.bus.read(e.v2p(address), 8))
 }
 
 func (e *Emulator) getMemory16(address uint32) uint16 {
-	var ret uint16
-	for i := uint32(0); i < 2; i++ {
-		ret |= uint16(e.getMemory8(address+i)) << uint32(i*8)
-	}
-	return ret
+	return uint16(e.readLinear(address, 16))
 }
 
 func (e *Emulator) getMemory32(address uint32) uint32 {
-	if address == IOAPICBase+4*4 {
-		printf("Return 0x%x as ioapic data\n", ioapicData)
-		return ioapicData
-	}
+	return e.readLinear(address, 32)
+}
 
+// whether the access of size bits at the linear address crosses the page
+// boundary, then it is split into bytes which may be in different pages
+func crossesPage(address uint32, size uint8) bool {
+	return address&0xFFF > 0x1000-uint32(size/8)
+}
+
+func (e *Emulator) readLinear(address uint32, size uint8) uint32 {
+	if !crossesPage(address, size) {
+		return e.bus.read(e.v2p(address), size)
+	}
 	var ret uint32
-	for i := uint32(0); i < 4; i++ {
-		ret |= uint32(e.getMemory8(address+i)) << uint32(i*8)
+	for i := uint32(0); i < uint32(size/8); i++ {
+		ret |= uint32(e.getMemory8(address+i)) << (i * 8)
 	}
 	return ret
 }
 
+func (e *Emulator) writeLinear(address uint32, size uint8, value uint32) {
+	if !crossesPage(address, size) {
+		e.bus.write(e.translate(address, true), size, value)
+		return
+	}
+	for i := uint32(0); i < uint32(size/8); i++ {
+		e.setMemory8(address+i, uint8(value>>(i*8)))
+	}
+}
+
 func (e *Emulator) getMemory64(address uint32) uint64 {
 	var ret uint64
 	for i := uint32(0); i < 8; i++ {
@@ -2091,28 +1203,59 @@ func (e *Emulator) getMemory64(address uint32) uint64 {
 	return ret
 }
 
+// SP or ESP moved by delta, depends on the size of the stack segment
+func (e *Emulator) stackPointer(delta int32) uint32 {
+	if e.segments[SS].big {
+		return e.getRegister32(ESP) + uint32(delta)
+	}
+	return uint32(e.getRegister16(SP) + uint16(delta))
+}
+
+func (e *Emulator) setStackPointer(value uint32) {
+	if e.segments[SS].big {
+		e.setRegister32(ESP, value)
+	} else {
+		e.setRegister16(SP, uint16(value))
+	}
+}
+
 func (e *Emulator) push32(value uint32) {
-	address := e.getRegister32(ESP) - 4
-	e.setMemory32(address, value)
-	e.setRegister32(ESP, address)
+	sp := e.stackPointer(-4)
+	e.setMemory32(e.linearAddress(SS, sp, 4, true), value)
+	e.setStackPointer(sp)
 }
 
 func (e *Emulator) pop32() uint32 {
-	value := e.getMemory32(e.getRegister32(ESP))
-	e.incRegister32(ESP, 4)
+	value := e.getMemory32(e.linearAddress(SS, e.stackPointer(0), 4, false))
+	e.setStackPointer(e.stackPointer(4))
 	return value
 }
 
-func (e *Emulator) halt() {
+func (e *Emulator) push16(value uint16) {
+	sp := e.stackPointer(-2)
+	e.setMemory16(e.linearAddress(SS, sp, 2, true), value)
+	e.setStackPointer(sp)
+}
+
+func (e *Emulator) pop16() uint16 {
+	value := e.getMemory16(e.linearAddress(SS, e.stackPointer(0), 2, false))
+	e.setStackPointer(e.stackPointer(2))
+	return value
+}
+
+func (e *Emulator) halt(inst *Instruction) {
 	fmt.Fprintf(e.writer, "The system has halted.\n")
 	e.eip = 0x7c00
 }
 
-func (e *Emulator) leave() {
-	ebp := e.getRegister32(EBP)
-	e.setRegister32(ESP, ebp)
-	e.setRegister32(EBP, e.pop32())
-	e.eip++
+func (e *Emulator) leave(inst *Instruction) {
+	// SP or ESP by the stack size, and BP or EBP by the operand size
+	e.setStackPointer(e.getRegister32(EBP))
+	if inst.opsize == 16 {
+		e.setRegister16(BP, e.pop16())
+	} else {
+		e.setRegister32(EBP, e.pop32())
+	}
 }
 
 func (e *Emulator) dump(index int) {
@@ -2154,20 +1297,14 @@ func (e *Emulator) dump(index int) {
 		e.cr[3],
 		e.cr[4],
 	)
+	printf("TLB hits=%d misses=%d\n", e.tlb.Hits, e.tlb.Misses)
 	e.eflags.dump()
 }
 
-// get from eip
-
-// TODO: consider linear address transformation using CS
+// get from CS:eip
 func (e *Emulator) getCode8(index int32) uint8 {
-	var addr uint32
-	if index < 0 {
-		addr = e.eip - uint32(-index)
-	} else {
-		addr = e.eip + uint32(index)
-	}
-	return e.memory[e.v2p(addr)]
+	addr := e.codeAddress(e.eip + uint32(index))
+	return uint8(e.bus.read(e.v2p(addr), 8))
 }
 
 func (e *Emulator) getSignCode8(index int32) int8 {
@@ -2214,6 +1351,8 @@ type ModRM struct {
 	disp32  uint32 // This can be regarded as (disp8, signed int8, disp16 signed int16).
 	sib     uint8  // sib byte
 	// disp32Sib uint32 // disp32 for sib
+	address16 bool  // 16bit addressing ([bx+si] etc.)
+	segment   uint8 // segment register of the memory operand
 }
 
 func (m *ModRM) getSib(e *Emulator) uint32 { // Indicate [--][--]
@@ -2265,60 +1404,3 @@ func (m *ModRM) setDisp8(disp8 int8) {
 func (m *ModRM) setDisp16(disp16 int16) {
 	m.disp32 = (m.disp32 & 0xFFFF0000) | uint32(disp16)
 }
-
-// load ModR/M & increment eip
-func (e *Emulator) parseModRM() ModRM {
-	code := e.getCode8(0)
-	// printf("modrm=0x%x\n", code)
-
-	// 76  543                210
-	// mod regIndex(opecode) r/m
-	m := ModRM{
-		mod:     (code >> 6) & 0x03,
-		opecode: (code >> 3) & 0x07,
-		rm:      code & 0x07,
-	}
-
-	e.eip++
-	// printf("get mod=0x%x opecode=0x%x rm=0x%x\n", m.mod, m.opecode, m.rm)
-
-	if e.cr[0]&1 == 0 {
-		// 16 bit mode
-		if m.mod == 1 {
-			m.setDisp8(e.getSignCode8(0))
-			e.eip++
-		} else if m.rm == 6 || m.mod == 2 {
-			m.setDisp16(e.getSignCode16(0))
-			e.eip += 2
-			// printf("set disp16 eip=0x%x\n", e.eip)
-		}
-	} else {
-		// 32 bit mode
-		if m.mod != 3 && m.rm == 4 {
-			m.sib = e.getCode8(0)
-			e.eip++
-			// if m.mod == 2 || (m.mod == 0 && (m.sib&0x7 == 5)) {
-			// 	m.disp32Sib = e.getCode32(0)
-			// 	e.eip += 4
-			// } else if m.mod == 1 {
-			// 	m.disp32Sib = uint32(e.getCode8(0))
-			// 	e.eip++
-			// }
-			// printf("get sib=0x%x disp32Sib=0x%x\n", m.sib, m.disp32Sib)
-		}
-
-		if (m.mod == 0 && m.rm == 5) || m.mod == 2 || (m.mod == 0 && m.rm == 4 && m.sib&0x7 == 0x5) || (m.mod == 2 && m.rm == 4 && m.sib&0x7 == 0x5) {
-			// The last two condition are as below:
-			// [scaled index] + disp32
-			// [scaled index] + disp32 + [EBP]
-			// printf("get disp32 from eip=0x%x\n", e.eip)
-			m.disp32 = e.getCode32(0)
-			e.eip += 4
-		} else if m.mod == 1 || (m.mod == 1 && m.rm == 4 && m.sib&0x7 == 0x5) {
-			m.setDisp8(e.getSignCode8(0))
-			e.eip++
-		}
-	}
-
-	return m
-}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+)
+
+// bits of the page fault error code
+const (
+	pfProtection = 1 << 0 // 0: not-present page, 1: protection violation
+	pfWrite      = 1 << 1 // 0: read, 1: write
+	pfUser       = 1 << 2 // 0: supervisor mode, 1: user mode
+)
+
+// Fault is a CPU exception raised while executing an instruction. Instruction
+// handlers raise it by panic, and execInst recovers it and delivers it to the
+// guest through the IDT. execInst returns it only when the guest can not
+// handle it (triple fault), or the cause of it such as UnsupportedOpcodeError.
+type Fault struct {
+	Vector       uint8  // exception vector
+	HasErrorCode bool   // the error code is pushed on the stack
+	ErrorCode    uint32 // error code
+	EIP          uint32 // address of the faulting instruction
+	cause        error  // error which causes the fault, if any
+}
+
+func (f *Fault) Error() string {
+	names := map[uint8]string{
+		vectorDE: "#DE", vectorUD: "#UD", vectorDF: "#DF", vectorTS: "#TS",
+		vectorNP: "#NP", vectorSS: "#SS", vectorGP: "#GP", vectorPF: "#PF",
+	}
+	name, ok := names[f.Vector]
+	if !ok {
+		name = fmt.Sprintf("vector %d", f.Vector)
+	}
+	s := fmt.Sprintf("eip=0x%x %s", f.EIP, name)
+	if f.HasErrorCode {
+		s += fmt.Sprintf("(0x%x)", f.ErrorCode)
+	}
+	return s
+}
+
+// raise the exception without error code
+func raise(vector uint8) {
+	panic(&Fault{Vector: vector})
+}
+
+// raise the exception with error code
+func raiseWithErrorCode(vector uint8, errorCode uint32) {
+	panic(&Fault{Vector: vector, HasErrorCode: true, ErrorCode: errorCode})
+}
+
+// raise #PF for the linear address, which is saved in CR2
+func (e *Emulator) raisePageFault(address, errorCode uint32) {
+	e.cr[2] = address
+	raiseWithErrorCode(vectorPF, errorCode)
+}
+
+// call fn, and return the fault raised in it
+func catchFault(fn func()) (f *Fault) {
+	defer func() {
+		if r := recover(); r != nil {
+			var ok bool
+			if f, ok = r.(*Fault); !ok {
+				panic(r)
+			}
+		}
+	}()
+	fn()
+	return nil
+}
+
+// classes of exceptions for double fault detection
+const (
+	faultBenign = iota
+	faultContributory
+	faultPage
+)
+
+func faultClass(vector uint8) int {
+	switch vector {
+	case vectorDE, vectorTS, vectorNP, vectorSS, vectorGP:
+		return faultContributory
+	case vectorPF:
+		return faultPage
+	}
+	return faultBenign
+}
+
+// whether the second exception during delivering the first one is #DF
+func isDoubleFault(first, second uint8) bool {
+	switch faultClass(first) {
+	case faultContributory:
+		return faultClass(second) == faultContributory
+	case faultPage:
+		return faultClass(second) != faultBenign
+	}
+	return false
+}
+
+// deliver the fault (or the external interrupt) to the guest. If another fault is raised during the
+// delivery, it is delivered instead (or #DF), and nil is returned. If #DF can
+// not be delivered either, the CPU shuts down and the first fault is returned.
+func (e *Emulator) handleFault(f *Fault) error {
+	first := f
+	for {
+		registers, sreg, segments, taskState, eflags := e.registers, e.sreg, e.segments, e.taskState, e.eflags
+		next := catchFault(func() {
+			e.deliver(f.Vector, f.EIP, f.HasErrorCode, f.ErrorCode, true)
+		})
+		if next == nil {
+			return nil
+		}
+
+		// restore the state changed in the failed delivery
+		e.registers, e.sreg, e.segments, e.taskState, e.eflags = registers, sreg, segments, taskState, eflags
+		e.eip = f.EIP
+		next.EIP = f.EIP
+		if f.Vector == vectorDF {
+			if first.cause != nil {
+				return first.cause
+			}
+			return first
+		}
+		if isDoubleFault(f.Vector, next.Vector) {
+			next = &Fault{Vector: vectorDF, HasErrorCode: true, EIP: f.EIP}
+		}
+		f = next
+	}
+}
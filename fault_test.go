@@ -0,0 +1,179 @@
+package main
+
+import (
+	"testing"
+)
+
+// set the interrupt gate for the vector to 0x0008:handler, IDT is at 0x1000
+func setInterruptGate(e *Emulator, vector uint8, handler uint32) {
+	e.idtrBase = 0x1000
+	e.idtrSize = 0x7FF
+	copy(e.memory[0x1000+8*uint32(vector):], []byte{
+		uint8(handler), uint8(handler >> 8), 0x08, 0x00, 0x00, 0x8E, uint8(handler >> 16), uint8(handler >> 24),
+	})
+}
+
+func TestFault(t *testing.T) {
+	tests := []struct {
+		name      string
+		code      []byte
+		gates     []uint8 // vectors which have the handler at 0x9000+0x100*vector
+		absent    []uint8 // vectors which have the gate, but it is not present
+		vector    uint8   // delivered vector
+		errorCode int64   // pushed error code, -1 if none
+	}{
+		{"ud2", []byte{0x0F, 0x0B}, []uint8{vectorUD}, nil, vectorUD, -1},
+		{"div ecx", []byte{0xF7, 0xF1}, []uint8{vectorDE}, nil, vectorDE, -1},
+		{"int 0x30 (not present)", []byte{0xCD, 0x30}, []uint8{vectorNP}, []uint8{0x30}, vectorNP, 0x30<<3 | 2},
+		{"int 0xff (IDT limit)", []byte{0xCD, 0xFF}, []uint8{vectorGP}, nil, vectorGP, 0xFF<<3 | 2},
+		{"ud2 (#UD not present)", []byte{0x0F, 0x0B}, []uint8{vectorNP}, []uint8{vectorUD}, vectorNP, vectorUD<<3 | 3},
+		{"div ecx (#DE invalid)", []byte{0xF7, 0xF1}, []uint8{vectorDF}, nil, vectorDF, 0},
+		{"lea eax, ecx", []byte{0x8D, 0xC1}, []uint8{vectorUD}, nil, vectorUD, -1},
+		{"lgdt eax", []byte{0x0F, 0x01, 0xD0}, []uint8{vectorUD}, nil, vectorUD, -1},
+		{"lidt eax", []byte{0x0F, 0x01, 0xD8}, []uint8{vectorUD}, nil, vectorUD, -1},
+		{"invlpg eax", []byte{0x0F, 0x01, 0xF8}, []uint8{vectorUD}, nil, vectorUD, -1},
+	}
+
+	for _, test := range tests {
+		e := newTestEmulator(test.code, true)
+		e.sreg[CS] = 0x08
+		e.setRegister32(ESP, 0x8000)
+		for _, vector := range test.gates {
+			setInterruptGate(e, vector, 0x9000+0x100*uint32(vector))
+		}
+		for _, vector := range test.absent {
+			setInterruptGate(e, vector, 0x9000)
+			e.memory[0x1000+8*uint32(vector)+5] &^= 0x80
+		}
+
+		if err := e.execInst(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if e.eip != 0x9000+0x100*uint32(test.vector) {
+			t.Fatalf("%s: eip=0x%x", test.name, e.eip)
+		}
+
+		// the handler returns to the faulting instruction
+		esp := uint32(0x8000 - 12)
+		if test.errorCode >= 0 {
+			esp -= 4
+			if e.getMemory32(esp) != uint32(test.errorCode) {
+				t.Fatalf("%s: error code=0x%x", test.name, e.getMemory32(esp))
+			}
+		}
+		if e.getRegister32(ESP) != esp || e.getMemory32(0x8000-12) != 0x7c00 {
+			t.Fatalf("%s: esp=0x%x eip=0x%x", test.name, e.getRegister32(ESP), e.getMemory32(0x8000-12))
+		}
+	}
+}
+
+func TestPageFault(t *testing.T) {
+	tests := []struct {
+		name      string
+		code      []byte
+		address   uint32
+		errorCode uint32
+	}{
+		{"mov eax, [0x400000]", []byte{0xA1, 0x00, 0x00, 0x40, 0x00}, 0x400000, 0},
+		{"mov [0x6004], eax", []byte{0xA3, 0x04, 0x60, 0x00, 0x00}, 0x6004, pfWrite},
+		{"push dword [0x5ffe]", []byte{0xFF, 0x35, 0xFE, 0x5F, 0x00, 0x00}, 0x6000, 0},
+	}
+
+	for _, test := range tests {
+		e := newTestEmulator(test.code, true)
+		e.sreg[CS] = 0x08
+		e.setRegister32(ESP, 0x8000)
+		setInterruptGate(e, vectorPF, 0x9000)
+
+		// page directory at 0x10000, page table at 0x11000 maps 0-4MB
+		// except 0x6000-0x6fff
+		e.setMemory32(0x10000, 0x11000|PagePresent)
+		for i := uint32(0); i < 1024; i++ {
+			if i != 6 {
+				e.setMemory32(0x11000+4*i, i<<12|PagePresent)
+			}
+		}
+		e.cr[3] = 0x10000
+		e.cr[0] |= CR0PagingFlag
+		e.setRegister32(EAX, 0x12345678)
+
+		if err := e.execInst(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if e.eip != 0x9000 || e.cr[2] != test.address {
+			t.Fatalf("%s: eip=0x%x cr2=0x%x", test.name, e.eip, e.cr[2])
+		}
+		if e.getMemory32(0x8000-16) != test.errorCode || e.getMemory32(0x8000-12) != 0x7c00 {
+			t.Fatalf("%s: error code=0x%x eip=0x%x", test.name, e.getMemory32(0x8000-16), e.getMemory32(0x8000-12))
+		}
+		if e.getRegister32(EAX) != 0x12345678 {
+			t.Fatalf("%s: eax=0x%x", test.name, e.getRegister32(EAX))
+		}
+	}
+}
+
+func TestTripleFault(t *testing.T) {
+	// no handler for #UD, #GP and #DF
+	e := newTestEmulator([]byte{0x0F, 0x0B}, true)
+	e.sreg[CS] = 0x08
+	e.setRegister32(ESP, 0x8000)
+	e.idtrBase = 0x1000
+	e.idtrSize = 0x7FF
+
+	err := e.execInst()
+	if _, ok := err.(*UnsupportedOpcodeError); !ok {
+		t.Fatalf("err=%v", err)
+	}
+	if e.eip != 0x7c00 || e.getRegister32(ESP) != 0x8000 {
+		t.Fatalf("eip=0x%x esp=0x%x", e.eip, e.getRegister32(ESP))
+	}
+}
+
+func TestIDTBeyondRAM(t *testing.T) {
+	for _, base := range []uint32{PHYSTOP, 0xFFFFF000} {
+		// int 0x40
+		e := newTestEmulator([]byte{0xCD, 0x40}, true)
+		e.sreg[CS] = 0x08
+		e.setRegister32(ESP, 0x8000)
+		e.idtrBase = base
+		e.idtrSize = 0x7FF
+
+		err := e.execInst()
+		if f, ok := err.(*Fault); !ok || f.Vector != vectorGP {
+			t.Fatalf("base=0x%x: err=%v", base, err)
+		}
+		if e.eip != 0x7c00 || e.getRegister32(ESP) != 0x8000 {
+			t.Fatalf("base=0x%x: eip=0x%x esp=0x%x", base, e.eip, e.getRegister32(ESP))
+		}
+	}
+}
+
+func TestFailedDeliveryRestoresSegments(t *testing.T) {
+	// hlt from ring 3 raises #GP(0), whose ring 0 stack is the code segment
+	e := newTestEmulator([]byte{0xF4}, true)
+	e.sreg[CS] = 0x1B
+	e.sreg[SS] = 0x23
+	e.setRegister32(ESP, 0x8000)
+
+	// TSS: esp0=0x6000, ss0=0x08
+	e.tr.TSSBase = 0x3000
+	e.setMemory32(0x3004, 0x6000)
+	e.setMemory16(0x3008, 0x08)
+
+	// interrupt gate for #GP: 0x0008:0x00009000
+	e.idtrBase = 0x1000
+	e.idtrSize = 0x7FF
+	copy(e.memory[0x1000+8*vectorGP:], []byte{0x00, 0x90, 0x08, 0x00, 0x00, 0x8E, 0x00, 0x00})
+
+	segments, taskState := e.segments, e.taskState
+	err := e.execInst()
+	if f, ok := err.(*Fault); !ok || f.Vector != vectorGP {
+		t.Fatalf("err=%v", err)
+	}
+	if e.sreg[CS] != 0x1B || e.sreg[SS] != 0x23 || e.getRegister32(ESP) != 0x8000 {
+		t.Fatalf("cs=0x%x ss=0x%x esp=0x%x", e.sreg[CS], e.sreg[SS], e.getRegister32(ESP))
+	}
+	if e.segments != segments || e.taskState != taskState {
+		t.Fatalf("segments=%+v taskState=%+v", e.segments, e.taskState)
+	}
+}
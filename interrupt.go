@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+)
+
+// exception vectors
+const (
+	vectorDE = 0  // divide error
+	vectorBP = 3  // breakpoint (INT3)
+	vectorOF = 4  // overflow (INTO)
+	vectorUD = 6  // invalid opecode
+	vectorDF = 8  // double fault
+	vectorTS = 10 // invalid TSS
+	vectorNP = 11 // segment not present
+	vectorSS = 12 // stack segment fault
+	vectorGP = 13 // general protection
+	vectorPF = 14 // page fault
+)
+
+// gate types in IDT
+const (
+	gateInterrupt32 = 0xE // IF is cleared
+	gateTrap32      = 0xF // IF is not changed
+)
+
+// current privilege level
+func (e *Emulator) cpl() uint8 {
+	if e.cr[0]&1 == 0 {
+		return 0
+	}
+	return uint8(e.sreg[CS] & 3)
+}
+
+// read SS0 and ESP0 from the current TSS
+func (e *Emulator) loadTaskState() {
+	e.taskState.esp0 = e.getMemory32(e.tr.TSSBase + 4)
+	e.taskState.ss0 = e.getMemory16(e.tr.TSSBase + 8)
+	e.taskState.iomb = e.getMemory16(e.tr.TSSBase + 102)
+}
+
+// deliver the software interrupt through IDT (IVT in real mode), and the
+// handler returns to returnAddress
+func (e *Emulator) interrupt(vector uint8, returnAddress uint32) {
+	e.deliver(vector, returnAddress, false, 0, false)
+}
+
+// external is true for exceptions and hardware interrupts, and it is set to
+// the EXT bit of the error code of the faults raised during the delivery.
+func (e *Emulator) deliver(vector uint8, returnAddress uint32, hasErrorCode bool, errorCode uint32, external bool) {
+	flags := e.eflags.get()
+
+	// error code for the faults which refer to the IDT entry
+	idtErrorCode := uint32(vector)<<3 | 2
+	if external {
+		idtErrorCode |= 1
+	}
+
+	if e.cr[0]&1 == 0 {
+		// real mode: IVT entry is offset:segment at 4*vector
+		entry := uint32(vector) * 4
+		if entry+3 > uint32(e.idtrSize) {
+			raiseWithErrorCode(vectorGP, idtErrorCode)
+		}
+		// the table is read through the bus, #GP(0) is raised beyond RAM
+		ivt := e.readPhysical32(e.idtrBase + entry)
+		offset, segment := uint16(ivt), uint16(ivt>>16)
+		e.push16(uint16(flags))
+		e.push16(uint16(e.sreg[CS]))
+		e.push16(uint16(returnAddress))
+		e.eflags.unset(InterruptFlag | TrapFlag)
+		e.setSreg16(CS, segment)
+		e.eip = uint32(offset)
+		return
+	}
+
+	if 8*uint32(vector)+7 > uint32(e.idtrSize) {
+		raiseWithErrorCode(vectorGP, idtErrorCode)
+	}
+	gate := uint64(e.readPhysical32(e.idtrBase+8*uint32(vector))) |
+		uint64(e.readPhysical32(e.idtrBase+8*uint32(vector)+4))<<32
+	offset := uint32(gate>>48)<<16 | uint32(gate&0xFFFF)
+	selector := uint16(gate >> 16)
+	gatetype := (gate >> 40) & 0xF
+	if gatetype != gateInterrupt32 && gatetype != gateTrap32 {
+		raiseWithErrorCode(vectorGP, idtErrorCode)
+	}
+	if !external && uint8(gate>>45&3) < e.cpl() {
+		// INT n from the outer level than the gate
+		raiseWithErrorCode(vectorGP, idtErrorCode)
+	}
+	if gate&(1<<47) == 0 {
+		raiseWithErrorCode(vectorNP, idtErrorCode)
+	}
+
+	// DPL of the handler's code segment is the new CPL, and the TSS and the
+	// new stack are accessed in it
+	ext := idtErrorCode & 1
+	cpl := e.cpl()
+	newCPL := cpl
+	if selector&^3 != 0 {
+		code := e.descriptor(selector, ext)
+		if code.dpl() > cpl {
+			raiseWithErrorCode(vectorGP, selectorErrorCode(selector, ext))
+		}
+		if !code.conforming() {
+			newCPL = code.dpl()
+		}
+	}
+	cs, ss, esp := e.sreg[CS], e.sreg[SS], e.getRegister32(ESP)
+	e.loadCodeSegment(selector, newCPL, ext)
+	if newCPL < cpl {
+		// switch to the stack of the inner privilege level in TSS
+		e.loadTaskState()
+		e.setSreg16(SS, e.taskState.ss0)
+		e.setRegister32(ESP, e.taskState.esp0)
+		e.push32(ss)
+		e.push32(esp)
+	}
+
+	e.push32(flags)
+	e.push32(cs)
+	e.push32(returnAddress)
+	if hasErrorCode {
+		e.push32(errorCode)
+	}
+	if gatetype == gateInterrupt32 {
+		e.eflags.unset(InterruptFlag)
+	}
+	e.eflags.unset(TrapFlag)
+	e.eip = offset
+}
+
+// IRQLines is the interrupt controllers which the devices are connected to
+type IRQLines interface {
+	RaiseIRQ(irq uint8)
+	LowerIRQ(irq uint8)
+}
+
+// RaiseIRQ sets the ISA IRQ line high, which is connected to both PIC and
+// I/O APIC
+func (e *Emulator) RaiseIRQ(irq uint8) {
+	e.io.pic.RaiseIRQ(irq)
+	e.ioapic.RaiseIRQ(irq)
+}
+
+// LowerIRQ sets the ISA IRQ line low
+func (e *Emulator) LowerIRQ(irq uint8) {
+	e.io.pic.LowerIRQ(irq)
+	e.ioapic.LowerIRQ(irq)
+}
+
+// int imm8 (0xCD)
+func (e *Emulator) intImm8(inst *Instruction) {
+	vector := uint8(inst.imm)
+	if e.cr[0]&1 == 0 && e.bios(vector) {
+		return
+	}
+	e.interrupt(vector, e.eip)
+}
+
+// int3 (0xCC)
+func (e *Emulator) int3(inst *Instruction) {
+	e.interrupt(vectorBP, e.eip)
+}
+
+// into (0xCE)
+func (e *Emulator) into(inst *Instruction) {
+	if e.eflags.isEnable(OverflowFlag) {
+		e.interrupt(vectorOF, e.eip)
+	}
+}
+
+// iret (0xCF)
+func (e *Emulator) iret(inst *Instruction) {
+	pop := e.pop32
+	if inst.opsize == 16 {
+		pop = func() uint32 { return uint32(e.pop16()) }
+	}
+
+	// pop everything in the current privilege level, then return
+	cpl := e.cpl()
+	sp := e.stackPointer(0)
+	eip := pop()
+	cs := uint16(pop())
+	flags := pop()
+	if inst.opsize == 16 {
+		flags |= e.eflags.get() & 0xFFFF0000
+	}
+	flags = e.restrictFlags(flags)
+	rpl := cpl
+	if e.cr[0]&1 != 0 {
+		rpl = uint8(cs & 3)
+	}
+	if rpl < cpl {
+		// can not return to the inner privilege level
+		e.setStackPointer(sp)
+		raiseWithErrorCode(vectorGP, selectorErrorCode(cs, 0))
+	}
+	if rpl > cpl {
+		// return to the outer privilege level
+		esp := pop()
+		ss := uint16(pop())
+		e.loadCodeSegment(cs, rpl, 0)
+		e.setSreg16(SS, ss)
+		if inst.opsize == 16 {
+			e.setRegister16(SP, uint16(esp))
+		} else {
+			e.setRegister32(ESP, esp)
+		}
+		e.invalidateSegments()
+	} else {
+		e.loadCodeSegment(cs, cpl, 0)
+	}
+	e.eflags.load(flags)
+	e.eip = eip
+}
+
+// emulate BIOS services in real mode, return false if not implemented
+func (e *Emulator) bios(vector uint8) bool {
+	if vector == 0x10 && e.getRegister8(AH) == 0x00 {
+		// set video mode
+		mode := e.getRegister8(AL)
+		e.vga.SetMode(mode)
+		if mode&0x7F != vgaModeGraphic && mode&0x80 == 0 {
+			e.cga.clear()
+		}
+		return true
+	} else if vector == 0x10 && e.getRegister8(AH) == 0x0f {
+		// get video mode, the number of columns and the page
+		columns := uint8(cgaColumns)
+		if e.vga.Mode() == vgaModeGraphic {
+			columns = vgaWidth / 8
+		}
+		e.setRegister8(AL, e.vga.Mode())
+		e.setRegister8(AH, columns)
+		e.setRegister8(BH, 0)
+		return true
+	} else if vector == 0x10 && e.getRegister8(AH) == 0x0e {
+		charCode := e.getRegister8(AL)
+		fmt.Fprintf(e.writer, "%c", charCode)
+		return true
+	}
+	return false
+}
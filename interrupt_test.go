@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestInterruptPrivilegeChange(t *testing.T) {
+	// int 0x40 from ring 3
+	e := newTestEmulator([]byte{0xCD, 0x40}, true)
+	e.sreg[CS] = 0x1B
+	e.sreg[SS] = 0x23
+	e.setRegister32(ESP, 0x8000)
+	e.eflags.set(InterruptFlag)
+
+	// TSS: esp0=0x6000, ss0=0x10
+	e.tr.TSSBase = 0x3000
+	e.setMemory32(0x3004, 0x6000)
+	e.setMemory16(0x3008, 0x10)
+
+	// trap gate (DPL 3) for vector 0x40: 0x0008:0x00009000
+	e.idtrBase = 0x1000
+	copy(e.memory[0x1000+8*0x40:], []byte{0x00, 0x90, 0x08, 0x00, 0x00, 0xEF, 0x00, 0x00})
+
+	if err := e.execInst(); err != nil {
+		t.Fatal(err)
+	}
+	if e.eip != 0x9000 || e.sreg[CS] != 0x08 || e.sreg[SS] != 0x10 || e.getRegister32(ESP) != 0x6000-20 {
+		t.Fatalf("eip=0x%x cs=0x%x ss=0x%x esp=0x%x", e.eip, e.sreg[CS], e.sreg[SS], e.getRegister32(ESP))
+	}
+	if !e.eflags.isEnable(InterruptFlag) {
+		t.Fatalf("trap gate must not clear IF")
+	}
+	stack := []uint32{0x7c02, 0x1B, 0, 0x8000, 0x23}
+	for i, expected := range stack {
+		actual := e.getMemory32(0x6000 - 20 + uint32(i)*4)
+		if i == 2 {
+			if actual&InterruptFlag == 0 {
+				t.Fatalf("pushed eflags=0x%x", actual)
+			}
+			continue
+		}
+		if actual != expected {
+			t.Fatalf("stack[%d]=0x%x, expected 0x%x", i, actual, expected)
+		}
+	}
+
+	// iret returns to ring 3 with the user stack
+	e.memory[0x9000] = 0xCF
+	if err := e.execInst(); err != nil {
+		t.Fatal(err)
+	}
+	if e.eip != 0x7c02 || e.sreg[CS] != 0x1B || e.sreg[SS] != 0x23 || e.getRegister32(ESP) != 0x8000 {
+		t.Fatalf("eip=0x%x cs=0x%x ss=0x%x esp=0x%x", e.eip, e.sreg[CS], e.sreg[SS], e.getRegister32(ESP))
+	}
+	// DS of the kernel is not accessible from ring 3
+	if !e.segments[DS].unusable || e.sreg[DS] != 0 {
+		t.Fatalf("ds=0x%x", e.sreg[DS])
+	}
+}
+
+func TestInt3Into(t *testing.T) {
+	// int3; into; into
+	e := newTestEmulator([]byte{0xCC, 0xCE, 0xCE}, true)
+	e.sreg[CS] = 0x08
+	e.setRegister32(ESP, 0x8000)
+	e.eflags.set(InterruptFlag)
+
+	// interrupt gates for vector 3 and 4: 0x0008:0x00009000, 0x0008:0x0000A000
+	e.idtrBase = 0x1000
+	copy(e.memory[0x1000+8*3:], []byte{0x00, 0x90, 0x08, 0x00, 0x00, 0x8E, 0x00, 0x00})
+	copy(e.memory[0x1000+8*4:], []byte{0x00, 0xA0, 0x08, 0x00, 0x00, 0x8E, 0x00, 0x00})
+	e.memory[0x9000] = 0xCF
+
+	// int3 returns to the next instruction
+	e.execInst()
+	if e.eip != 0x9000 || e.eflags.isEnable(InterruptFlag) || e.getMemory32(0x8000-12) != 0x7c01 {
+		t.Fatalf("int3: eip=0x%x eflags=0x%x", e.eip, e.eflags.get())
+	}
+	e.execInst()
+	if e.eip != 0x7c01 || !e.eflags.isEnable(InterruptFlag) || e.getRegister32(ESP) != 0x8000 {
+		t.Fatalf("iret: eip=0x%x eflags=0x%x esp=0x%x", e.eip, e.eflags.get(), e.getRegister32(ESP))
+	}
+
+	// into does nothing without OF
+	e.execInst()
+	if e.eip != 0x7c02 {
+		t.Fatalf("into: eip=0x%x", e.eip)
+	}
+
+	e.eflags.set(OverflowFlag)
+	e.execInst()
+	if e.eip != 0xA000 || e.getMemory32(0x8000-12) != 0x7c03 {
+		t.Fatalf("into: eip=0x%x", e.eip)
+	}
+}
+
+func TestRealModeInterrupt(t *testing.T) {
+	// int 0x21
+	e := newTestEmulator([]byte{0xCD, 0x21}, false)
+	e.setRegister32(ESP, 0x7000)
+	e.eflags.set(InterruptFlag | CarryFlag)
+
+	// IVT entry for vector 0x21: 0x0100:0x1234
+	copy(e.memory[0x21*4:], []byte{0x34, 0x12, 0x00, 0x01})
+	e.memory[0x2234] = 0xCF
+
+	e.execInst()
+	if e.eip != 0x1234 || e.sreg[CS] != 0x100 || e.eflags.isEnable(InterruptFlag) {
+		t.Fatalf("int: eip=0x%x cs=0x%x eflags=0x%x", e.eip, e.sreg[CS], e.eflags.get())
+	}
+	if e.getMemory16(0x7000-6) != 0x7c02 || e.getMemory16(0x7000-4) != 0 {
+		t.Fatalf("stack=0x%x 0x%x", e.getMemory16(0x7000-6), e.getMemory16(0x7000-4))
+	}
+
+	e.execInst()
+	if e.eip != 0x7c02 || e.sreg[CS] != 0 || e.getRegister16(SP) != 0x7000 ||
+		!e.eflags.isEnable(InterruptFlag) || !e.eflags.isEnable(CarryFlag) {
+		t.Fatalf("iret: eip=0x%x cs=0x%x sp=0x%x eflags=0x%x", e.eip, e.sreg[CS], e.getRegister16(SP), e.eflags.get())
+	}
+}
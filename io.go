@@ -1,10 +1,8 @@
 package main
 
 import (
-	// "bufio"
-	// "fmt"
+	"fmt"
 	"io"
-	// "os"
 )
 
 const (
@@ -12,111 +10,112 @@ const (
 	SectorSize = 512
 )
 
-// ReaderSeeker interface contains Seek and Read function
-type ReaderSeeker interface {
-	Seek(offset int64, whence int) (int64, error)
-	Read(p []byte) (n int, err error)
+// PortDevice is a device which claims a range of I/O ports. port is the I/O
+// port number, and size is the width of the access in bits (8, 16 or 32).
+type PortDevice interface {
+	In(port uint16, size uint8) uint32
+	Out(port uint16, size uint8, value uint32)
 }
 
-// IO has I/O port and emulate I/O device
+type portRegion struct {
+	first  uint16
+	last   uint16
+	device PortDevice
+}
+
+// IO is the I/O port space, which the devices claim ranges of
 type IO struct {
-	memory [65536]uint8 // I/O port
-	reader *io.Reader
-	writer *io.Writer
-	hdds   [10]ReaderSeeker
+	ports        []portRegion
+	reader       *io.Reader
+	writer       *io.Writer
+	hdds         [10]BlockDevice
+	pic          PIC  // 8259A PICs
+	LogUnclaimed bool // log the accesses to the ports which no device claims
 }
 
 // NewIO creates New IO
-func NewIO(reader *io.Reader, writer *io.Writer) IO {
-	return IO{
+func NewIO(reader *io.Reader, writer *io.Writer) *IO {
+	io := &IO{
 		reader: reader,
 		writer: writer,
+		pic:    NewPIC(),
 	}
+	for _, r := range []portRegion{
+		{picMasterCommand, picMasterData, &io.pic},
+		{picSlaveCommand, picSlaveData, &io.pic},
+	} {
+		if err := io.Claim(r.first, r.last, r.device); err != nil {
+			panic(err)
+		}
+	}
+	return io
 }
 
-var times0x01f7 = 0
-
-func (io *IO) in8(address uint16) uint8 {
-	//printf("io.in8 from 0x%x\n", address)
-	switch address {
-	case 0x0064: // Keyboard Controller Read Status
-		io.memory[address] = 0x1c
-	case 0x01f0: // Data Register (Read sector 32bit-chunk, 128 times)
-		b := make([]byte, 1)
-		io.hdds[0].Read(b)
-		io.memory[address] = b[0]
-	case 0x01f7: // 1st Hark Disk Status (4th bit means drive ready)
-		if times0x01f7&0x01 == 0 {
-			io.memory[address] = 0x50
-		} else {
-			io.memory[address] = 0x58
+// Claim the ports from first to last for the device
+func (io *IO) Claim(first, last uint16, device PortDevice) error {
+	for _, r := range io.ports {
+		if first <= r.last && r.first <= last {
+			return fmt.Errorf("ports 0x%x-0x%x overlap 0x%x-0x%x", first, last, r.first, r.last)
 		}
-		times0x01f7++
-	case 0x03f8: // COM1+0: Reciever Buffer Register
-		// reader := bufio.NewReader(os.Stdin)
-		// input, _ := reader.ReadString('\n') // TODO: fixme
-		input := "\n"
-		io.memory[address] = input[0]
-	case 0x03f8 + 5: // COM1+5: Line Status Register
-		io.memory[address] = 0x20
 	}
-	return io.memory[address]
+	io.ports = append(io.ports, portRegion{first, last, device})
+	return nil
 }
 
-func (io *IO) in32(address uint16) uint32 {
-	var ret uint32
-	for i := uint16(0); i < 4; i++ {
-		ret |= uint32(io.in8(address)) << uint32(i*8)
+// the device which claims the port, or nil
+func (io *IO) device(port uint16) PortDevice {
+	for _, r := range io.ports {
+		if r.first <= port && port <= r.last {
+			return r.device
+		}
 	}
-	return ret
+	return nil
 }
 
-func (io *IO) out16(address, value uint16) {
-	io.out8(address, uint8(value&0xFF))
-	io.out8(address+1, uint8((value&0xFF00)>>8))
+// read size bits from the port, all bits are 1 if no device claims it
+func (io *IO) in(port uint16, size uint8) uint32 {
+	device := io.device(port)
+	if device == nil {
+		if io.LogUnclaimed {
+			printf("in%d from unclaimed port 0x%x\n", size, port)
+		}
+		return sizeMask(size)
+	}
+	return device.In(port, size) & sizeMask(size)
 }
 
-func (io *IO) out8(address uint16, value uint8) {
-	// printf("io.out8 address=0x%x value=0x%x\n", address, value)
-	io.memory[address] = value
-	switch address {
-	case 0x01f2: // Secter Count
-		// printf("Secter Count=%d\n", io.memory[address])
-		return
-	case 0x01f3: // Secter Number
-		io.hdds[0].Seek(0, 0) // Read a entire sector (TODO: check)
-		io.hdds[0].Seek(int64(value)*SectorSize, 1)
-		// printf("Secter Number=%d offset=%d\n", io.memory[address], offset)
-		return
-	case 0x01f4: // Cylinder low
-		io.hdds[0].Seek(int64(uint32(value)<<8)*SectorSize, 1)
-		// printf("Sylinder Low=%d offset=%d\n", io.memory[address], offset)
-		return
-	case 0x01f5: // Cylinder High
-		io.hdds[0].Seek(int64(uint32(value)<<16)*SectorSize, 1)
-		// printf("Sylinder High=%d offset=%d\n", io.memory[address], offset)
-		return
-	case 0x01f6: // Drive/Head
-		io.hdds[0].Seek(int64((uint32(value)&0x1F)<<24)*SectorSize, 1)
-		// printf("Drive Number=%d offset=%d\n", (io.memory[address]&0x8)>>4, offset)
-		return
-	case 0x01f7: // Command Register
-		// printf("Command Register=%d\n", io.memory[address])
-		switch io.memory[address] {
-		case 0x20:
-			// printf("Read sectors with Retry command is sent.\n")
-			return
-		default:
-			return
+// write size bits to the port, it is ignored if no device claims it
+func (io *IO) out(port uint16, size uint8, value uint32) {
+	device := io.device(port)
+	if device == nil {
+		if io.LogUnclaimed {
+			printf("out%d 0x%x to unclaimed port 0x%x\n", size, value, port)
 		}
-	case 0x0060: // Keyboard Input Register
-		return
-	case 0x0064: // Keyboard Input Buffer
-		return
-	case 0x03f8: // COM1+0: Transmitter Holding Register
-		// fmt.Fprint(*io.writer, string(io.memory[address]))
-		printf("%s", string(io.memory[address]))
-	default:
 		return
 	}
+	device.Out(port, size, value&sizeMask(size))
+}
+
+func (io *IO) in8(address uint16) uint8 {
+	return uint8(io.in(address, 8))
+}
+
+func (io *IO) in16(address uint16) uint16 {
+	return uint16(io.in(address, 16))
+}
+
+func (io *IO) in32(address uint16) uint32 {
+	return io.in(address, 32)
+}
+
+func (io *IO) out8(address uint16, value uint8) {
+	io.out(address, 8, uint32(value))
+}
+
+func (io *IO) out16(address, value uint16) {
+	io.out(address, 16, uint32(value))
+}
+
+func (io *IO) out32(address uint16, value uint32) {
+	io.out(address, 32, value)
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+)
+
+// testPortDevice records the last access
+type testPortDevice struct {
+	port  uint16
+	size  uint8
+	value uint32
+}
+
+func (d *testPortDevice) In(port uint16, size uint8) uint32 {
+	d.port, d.size = port, size
+	return d.value
+}
+
+func (d *testPortDevice) Out(port uint16, size uint8, value uint32) {
+	d.port, d.size, d.value = port, size, value
+}
+
+func TestIO(t *testing.T) {
+	e := newTestEmulator([]byte{}, true)
+	d := &testPortDevice{}
+	if err := e.io.Claim(0x100, 0x107, d); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.io.Claim(0x107, 0x108, d); err == nil {
+		t.Fatal("overlapped ports must not be claimed")
+	}
+
+	// the device gets the access of the full width
+	e.io.out32(0x104, 0x12345678)
+	if d.port != 0x104 || d.size != 32 || d.value != 0x12345678 {
+		t.Fatalf("device=%+v", *d)
+	}
+	if v := e.io.in16(0x106); v != 0x5678 || d.port != 0x106 || d.size != 16 {
+		t.Fatalf("value=0x%x device=%+v", v, *d)
+	}
+
+	// unclaimed
+	e.io.out8(0x108, 0x12)
+	if e.io.in8(0x108) != 0xFF || e.io.in16(0x108) != 0xFFFF || e.io.in32(0x108) != 0xFFFFFFFF {
+		t.Fatalf("unclaimed port=0x%x", e.io.in32(0x108))
+	}
+
+	// mask of the master PIC
+	e.io.out8(picMasterData, 0xFB)
+	if e.io.in8(picMasterData) != 0xFB {
+		t.Fatalf("imr=0x%x", e.io.in8(picMasterData))
+	}
+}
+
+func TestInOutAx(t *testing.T) {
+	e := newTestEmulator([]byte{
+		0xE7, 0xF0, // out 0xf0, eax
+		0x66, 0xE7, 0xF2, // out 0xf2, ax
+		0xED,             // in eax, dx
+		0x66, 0xE5, 0xF6, // in ax, 0xf6
+	}, true)
+	d := &testPortDevice{}
+	if err := e.io.Claim(0xF0, 0xF7, d); err != nil {
+		t.Fatal(err)
+	}
+	e.setRegister32(EAX, 0x12345678)
+	e.setRegister32(EDX, 0xF4)
+
+	for _, want := range []testPortDevice{{0xF0, 32, 0x12345678}, {0xF2, 16, 0x5678}} {
+		if err := e.execInst(); err != nil {
+			t.Fatal(err)
+		}
+		if *d != want {
+			t.Fatalf("device=%+v, want %+v", *d, want)
+		}
+	}
+
+	d.value = 0x9ABCDEF0
+	if err := e.execInst(); err != nil {
+		t.Fatal(err)
+	}
+	if d.port != 0xF4 || d.size != 32 || e.getRegister32(EAX) != 0x9ABCDEF0 {
+		t.Fatalf("device=%+v eax=0x%x", *d, e.getRegister32(EAX))
+	}
+	d.value = 0x1234
+	if err := e.execInst(); err != nil {
+		t.Fatal(err)
+	}
+	if d.port != 0xF6 || d.size != 16 || e.getRegister32(EAX) != 0x9ABC1234 {
+		t.Fatalf("device=%+v eax=0x%x", *d, e.getRegister32(EAX))
+	}
+}
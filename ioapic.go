@@ -0,0 +1,164 @@
+package main
+
+// IOAPIC is the 82093AA I/O APIC at ICH (South Bridge). Registers are accessed indirectly: the
+// index is written to IOREGSEL, then the register is read or written through
+// IOWIN. Each IRQ pin has a redirection entry which steers it to the vector of
+// the local APIC.
+type IOAPIC struct {
+	id       uint8              // APIC ID
+	selector uint8              // IOREGSEL
+	redirect [ioapicPins]uint64 // redirection table
+	lines    uint32             // levels of the IRQ pins
+	lapic    *LocalAPIC         // destination of the interrupts
+}
+
+// number of IRQ pins
+const ioapicPins = 24
+
+// memory mapped registers, from IOAPICBase
+const (
+	ioapicRegisterSelect = 0x00 // IOREGSEL
+	ioapicWindow         = 0x10 // IOWIN
+	ioapicSize           = 0x20
+)
+
+// registers selected by IOREGSEL
+const (
+	ioapicID      = 0x00
+	ioapicVersion = 0x01
+	ioapicArbID   = 0x02
+	ioapicTable   = 0x10 // redirection table, 2 registers per pin
+)
+
+// bits of the redirection entry
+const (
+	redirectVector   = 0xFF
+	redirectPending  = 1 << 12 // delivery status
+	redirectRemoteIR = 1 << 14 // level triggered interrupt is accepted, until EOI
+	redirectLevel    = 1 << 15 // trigger mode, 0: edge, 1: level
+	redirectMasked   = 1 << 16
+	redirectReadOnly = redirectPending | redirectRemoteIR
+)
+
+// NewIOAPIC returns the I/O APIC with the ID, which sends interrupts to lapic.
+// All the pins are masked.
+func NewIOAPIC(id uint8, lapic *LocalAPIC) IOAPIC {
+	a := IOAPIC{id: id, lapic: lapic}
+	for i := range a.redirect {
+		a.redirect[i] = redirectMasked
+	}
+	return a
+}
+
+// Read the memory mapped register at offset from IOAPICBase
+func (a *IOAPIC) Read(offset uint32, size uint8) uint32 {
+	return readRegister32(a.read32, offset, size)
+}
+
+// Write the memory mapped register at offset from IOAPICBase
+func (a *IOAPIC) Write(offset uint32, size uint8, value uint32) {
+	writeRegister32(a.read32, a.write32, offset, size, value)
+}
+
+func (a *IOAPIC) read32(offset uint32) uint32 {
+	switch offset {
+	case ioapicRegisterSelect:
+		return uint32(a.selector)
+	case ioapicWindow:
+		return a.readRegister(a.selector)
+	}
+	return 0
+}
+
+func (a *IOAPIC) write32(offset, value uint32) {
+	switch offset {
+	case ioapicRegisterSelect:
+		a.selector = uint8(value)
+	case ioapicWindow:
+		a.writeRegister(a.selector, value)
+	}
+}
+
+func (a *IOAPIC) readRegister(index uint8) uint32 {
+	switch {
+	case index == ioapicID, index == ioapicArbID:
+		return uint32(a.id&0xF) << 24
+	case index == ioapicVersion:
+		return (ioapicPins-1)<<16 | 0x11
+	case ioapicTable <= index && index < ioapicTable+2*ioapicPins:
+		return uint32(a.redirect[(index-ioapicTable)/2] >> (32 * (index & 1)))
+	}
+	return 0
+}
+
+func (a *IOAPIC) writeRegister(index uint8, value uint32) {
+	switch {
+	case index == ioapicID:
+		a.id = uint8(value>>24) & 0xF
+	case ioapicTable <= index && index < ioapicTable+2*ioapicPins:
+		pin := (index - ioapicTable) / 2
+		entry := &a.redirect[pin]
+		if index&1 == 0 {
+			*entry = *entry&(0xFFFFFFFF00000000|redirectReadOnly) | uint64(value)&^redirectReadOnly
+		} else {
+			*entry = *entry&0xFFFFFFFF | uint64(value)<<32
+		}
+		// the level triggered IRQ, which is held while masked, is delivered
+		// when it is unmasked
+		a.deliver(pin)
+	}
+}
+
+// RaiseIRQ sets the IRQ pin high
+func (a *IOAPIC) RaiseIRQ(irq uint8) {
+	if irq >= ioapicPins {
+		return
+	}
+	rising := a.lines&(1<<irq) == 0
+	a.lines |= 1 << irq
+	if rising || a.redirect[irq]&redirectLevel != 0 {
+		a.send(irq)
+	}
+}
+
+// LowerIRQ sets the IRQ pin low
+func (a *IOAPIC) LowerIRQ(irq uint8) {
+	if irq < ioapicPins {
+		a.lines &^= 1 << irq
+	}
+}
+
+// deliver the level triggered IRQ if the pin is high
+func (a *IOAPIC) deliver(pin uint8) {
+	if a.lines&(1<<pin) != 0 && a.redirect[pin]&redirectLevel != 0 {
+		a.send(pin)
+	}
+}
+
+// send the interrupt of the pin to the local APIC. There is only one local
+// APIC, so the destination is not checked.
+func (a *IOAPIC) send(pin uint8) {
+	entry := &a.redirect[pin]
+	if *entry&redirectMasked != 0 {
+		return
+	}
+	if *entry&redirectLevel != 0 {
+		if *entry&redirectRemoteIR != 0 {
+			return
+		}
+		*entry |= redirectRemoteIR
+	}
+	a.lapic.accept(uint8(*entry & redirectVector))
+}
+
+// EOI of the vector from the local APIC, the level triggered IRQs are
+// delivered again if the pins are still high
+func (a *IOAPIC) endOfInterrupt(vector uint8) {
+	for pin := range a.redirect {
+		entry := &a.redirect[pin]
+		if *entry&redirectRemoteIR != 0 && uint8(*entry&redirectVector) == vector {
+			*entry &^= redirectRemoteIR
+			a.deliver(uint8(pin))
+		}
+	}
+}
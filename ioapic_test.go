@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestIOAPIC(t *testing.T) {
+	e := newTestEmulator([]byte{}, true)
+	e.lapic.write32(lapicSVR, lapicEnable|0x3F)
+	write := func(index uint8, value uint32) {
+		e.setMemory32(IOAPICBase+ioapicRegisterSelect, uint32(index))
+		e.setMemory32(IOAPICBase+ioapicWindow, value)
+	}
+	read := func(index uint8) uint32 {
+		e.setMemory32(IOAPICBase+ioapicRegisterSelect, uint32(index))
+		return e.getMemory32(IOAPICBase + ioapicWindow)
+	}
+
+	// as xv6's ioapicinit
+	if id := read(ioapicID) >> 24; id != 1 {
+		t.Fatalf("id=%d", id)
+	}
+	if maxintr := read(ioapicVersion) >> 16 & 0xFF; maxintr != 23 {
+		t.Fatalf("maxintr=%d", maxintr)
+	}
+	for irq := uint8(0); irq < ioapicPins; irq++ {
+		write(ioapicTable+2*irq, redirectMasked|uint32(0x20+irq))
+		write(ioapicTable+2*irq+1, 0)
+	}
+
+	// masked
+	e.RaiseIRQ(1)
+	e.LowerIRQ(1)
+	if e.lapic.hasInterrupt() {
+		t.Fatal("IRQ1 is masked")
+	}
+
+	// ioapicenable(IRQ_KBD, 0)
+	write(ioapicTable+2*1, 0x21)
+	write(ioapicTable+2*1+1, 0)
+	if read(ioapicTable+2*1) != 0x21 {
+		t.Fatalf("entry=0x%x", read(ioapicTable+2*1))
+	}
+	e.RaiseIRQ(1)
+	if !e.lapic.hasInterrupt() || e.lapic.acknowledge() != 0x21 {
+		t.Fatal("IRQ1 must be delivered as 0x21")
+	}
+	e.lapic.endOfInterrupt()
+
+	// edge triggered: once per rising edge
+	e.RaiseIRQ(1)
+	if e.lapic.hasInterrupt() {
+		t.Fatal("IRQ1 is still high")
+	}
+
+	// level triggered: remote IRR is set until EOI, then delivered again
+	write(ioapicTable+2*14, redirectLevel|0x2E)
+	e.RaiseIRQ(14)
+	if read(ioapicTable+2*14)&redirectRemoteIR == 0 || e.lapic.acknowledge() != 0x2E {
+		t.Fatal("IRQ14 must be delivered as 0x2E")
+	}
+	e.RaiseIRQ(14)
+	if e.lapic.hasInterrupt() {
+		t.Fatal("IRQ14 is waiting for EOI")
+	}
+	vector, _ := e.lapic.endOfInterrupt()
+	e.ioapic.endOfInterrupt(vector)
+	if !e.lapic.hasInterrupt() {
+		t.Fatal("IRQ14 is still high")
+	}
+}
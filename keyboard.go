@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"io"
+)
+
+// I/O ports and IRQ of the keyboard controller
+const (
+	kbdData   = 0x60 // read: output buffer, write: data to the keyboard or the controller
+	kbdStatus = 0x64 // read: status, write: command to the controller
+	kbdIRQ    = 1
+)
+
+// bits of the status register
+const (
+	kbdOBF     = 0x01 // output buffer full
+	kbdSYS     = 0x04 // system flag
+	kbdCommand = 0x08 // the last write was to the command port
+	kbdUnlock  = 0x10 // keyboard is not inhibited
+)
+
+// bits of the controller command byte
+const (
+	kbdCCBInterrupt = 0x01 // IRQ1 is raised when the output buffer is full
+	kbdCCBSystem    = 0x04 // system flag
+	kbdCCBDisable   = 0x10 // keyboard interface is disabled
+	kbdCCBTranslate = 0x40 // translation to scancode set 1
+)
+
+// responses of the keyboard
+const (
+	kbdACK      = 0xFA
+	kbdSelfTest = 0xAA // self test passed
+	kbdEcho     = 0xEE
+	kbdResend   = 0xFE
+)
+
+// size of the queue of the keyboard
+const kbdQueueSize = 16
+
+// Key is a key in scancode set 1. The keys with the 0xE0 prefix are 0xE0xx.
+type Key uint16
+
+// scancode set 1 of the keys
+const (
+	KeyEscape    Key = 0x01
+	KeyBackspace Key = 0x0E
+	KeyTab       Key = 0x0F
+	KeyEnter     Key = 0x1C
+	KeyCtrl      Key = 0x1D
+	KeyShift     Key = 0x2A
+	KeyAlt       Key = 0x38
+	KeySpace     Key = 0x39
+	KeyCapsLock  Key = 0x3A
+	KeyUp        Key = 0xE048
+	KeyLeft      Key = 0xE04B
+	KeyRight     Key = 0xE04D
+	KeyDown      Key = 0xE050
+	KeyDelete    Key = 0xE053
+)
+
+// characters of the keys in the US layout, indexed by the scancode
+const (
+	normalKeys  = "\x00\x1b1234567890-=\b\tqwertyuiop[]\n\x00asdfghjkl;'`\x00\\zxcvbnm,./\x00*\x00 "
+	shiftedKeys = "\x00\x1b!@#$%^&*()_+\b\tQWERTYUIOP{}\n\x00ASDFGHJKL:\"~\x00|ZXCVBNM<>?\x00*\x00 "
+)
+
+// keys by the code of KeyboardEvent of DOM, except letters and digits
+var domKeys = map[string]Key{
+	"Escape": KeyEscape, "Minus": 0x0C, "Equal": 0x0D, "Backspace": KeyBackspace,
+	"Tab": KeyTab, "BracketLeft": 0x1A, "BracketRight": 0x1B, "Enter": KeyEnter,
+	"ControlLeft": KeyCtrl, "Semicolon": 0x27, "Quote": 0x28, "Backquote": 0x29,
+	"ShiftLeft": KeyShift, "Backslash": 0x2B, "Comma": 0x33, "Period": 0x34,
+	"Slash": 0x35, "ShiftRight": 0x36, "NumpadMultiply": 0x37, "AltLeft": KeyAlt,
+	"Space": KeySpace, "CapsLock": KeyCapsLock, "NumLock": 0x45, "ScrollLock": 0x46,
+	"F11": 0x57, "F12": 0x58, "NumpadEnter": 0xE01C, "ControlRight": 0xE01D,
+	"NumpadDivide": 0xE035, "AltRight": 0xE038, "Home": 0xE047, "ArrowUp": KeyUp,
+	"PageUp": 0xE049, "ArrowLeft": KeyLeft, "ArrowRight": KeyRight, "End": 0xE04F,
+	"ArrowDown": KeyDown, "PageDown": 0xE051, "Insert": 0xE052, "Delete": KeyDelete,
+}
+
+// KeyByCode returns the key of the code of KeyboardEvent of DOM (ex. "KeyA")
+func KeyByCode(code string) (Key, bool) {
+	if key, ok := domKeys[code]; ok {
+		return key, true
+	}
+	var c byte
+	switch {
+	case len(code) == 4 && code[:3] == "Key" && 'A' <= code[3] && code[3] <= 'Z':
+		c = code[3] - 'A' + 'a'
+	case len(code) == 6 && code[:5] == "Digit" && '0' <= code[5] && code[5] <= '9':
+		c = code[5]
+	case len(code) == 2 && code[0] == 'F' && '1' <= code[1] && code[1] <= '9':
+		return Key(0x3B + code[1] - '1'), true
+	case code == "F10":
+		return 0x44, true
+	default:
+		return 0, false
+	}
+	for i := 0; i < len(normalKeys); i++ {
+		if normalKeys[i] == c {
+			return Key(i), true
+		}
+	}
+	return 0, false
+}
+
+// the key and whether shift is needed to type the character
+func keyByRune(r rune) (key Key, shift bool, ok bool) {
+	switch r {
+	case '\r':
+		return KeyEnter, false, true
+	case 0x7F:
+		return KeyBackspace, false, true
+	case 0:
+		return 0, false, false
+	}
+	for i := 0; i < len(normalKeys); i++ {
+		if rune(normalKeys[i]) == r {
+			return Key(i), false, true
+		}
+		if rune(shiftedKeys[i]) == r {
+			return Key(i), true, true
+		}
+	}
+	return 0, false, false
+}
+
+// scancodes of the key, the break code is the make code with bit 7 set
+func (k Key) scancodes(release bool) []byte {
+	code := uint8(k)
+	if release {
+		code |= 0x80
+	}
+	if k > 0xFF {
+		return []byte{uint8(k >> 8), code}
+	}
+	return []byte{code}
+}
+
+// Keyboard is the 8042 keyboard controller and the keyboard. It produces
+// scancode set 1 regardless of the translation. Commands complete immediately,
+// and there is no auxiliary device. The host sends the keys through KeyDown,
+// KeyUp and TypeRune, which may be called from other goroutines.
+type Keyboard struct {
+	irq    IRQLines
+	events chan []byte // scancodes from the host
+
+	output  uint8 // output buffer
+	status  uint8
+	ccb     uint8  // controller command byte
+	port    uint8  // output port
+	pending uint8  // command which waits for the data, 0 if none
+	device  uint8  // keyboard command which waits for the data, 0 if none
+	enabled bool   // keyboard scans the keys
+	replies []byte // responses to the commands, before keys
+	keys    []byte // scancodes of the keys
+	raised  bool   // level of IRQ1
+}
+
+// NewKeyboard returns the keyboard controller which raises IRQ1 on irq
+func NewKeyboard(irq IRQLines) *Keyboard {
+	return &Keyboard{
+		irq:     irq,
+		events:  make(chan []byte, 1024),
+		status:  kbdSYS | kbdUnlock,
+		ccb:     kbdCCBInterrupt | kbdCCBSystem | kbdCCBTranslate,
+		port:    0x03, // A20 is enabled, and the system is not reset
+		enabled: true,
+	}
+}
+
+// KeyDown sends the make code of the key
+func (k *Keyboard) KeyDown(key Key) {
+	k.send(key.scancodes(false))
+}
+
+// KeyUp sends the break code of the key
+func (k *Keyboard) KeyUp(key Key) {
+	k.send(key.scancodes(true))
+}
+
+// TypeRune presses and releases the keys of the character in the US layout.
+// The control characters are typed with Ctrl. It returns false if no key
+// types the character.
+func (k *Keyboard) TypeRune(r rune) bool {
+	key, shift, ok := keyByRune(r)
+	var modifier Key
+	switch {
+	case ok && shift:
+		modifier = KeyShift
+	case !ok && 1 <= r && r <= 26:
+		// Ctrl-A to Ctrl-Z
+		key, _, ok = keyByRune(r - 1 + 'a')
+		modifier = KeyCtrl
+	}
+	if !ok {
+		return false
+	}
+	var codes []byte
+	if modifier != 0 {
+		codes = append(codes, modifier.scancodes(false)...)
+	}
+	codes = append(codes, key.scancodes(false)...)
+	codes = append(codes, key.scancodes(true)...)
+	if modifier != 0 {
+		codes = append(codes, modifier.scancodes(true)...)
+	}
+	k.send(codes)
+	return true
+}
+
+// TypeFrom types the characters read from reader until EOF
+func (k *Keyboard) TypeFrom(reader io.Reader) {
+	go func() {
+		r := bufio.NewReader(reader)
+		for {
+			c, _, err := r.ReadRune()
+			if err != nil {
+				return
+			}
+			k.TypeRune(c)
+		}
+	}()
+}
+
+// send the scancodes from the host, they are lost if too many are pending
+func (k *Keyboard) send(codes []byte) {
+	select {
+	case k.events <- codes:
+	default:
+	}
+}
+
+// poll moves the scancodes from the host into the queue while it has space
+func (k *Keyboard) poll() {
+	for len(k.keys) < kbdQueueSize {
+		select {
+		case codes := <-k.events:
+			if k.enabled {
+				k.keys = append(k.keys, codes...)
+			}
+		default:
+			k.update()
+			return
+		}
+	}
+	k.update()
+}
+
+// fill the output buffer, and set IRQ1 to its state
+func (k *Keyboard) update() {
+	if k.status&kbdOBF == 0 {
+		if len(k.replies) > 0 {
+			k.output, k.replies = k.replies[0], k.replies[1:]
+			k.status |= kbdOBF
+		} else if len(k.keys) > 0 && k.ccb&kbdCCBDisable == 0 {
+			k.output, k.keys = k.keys[0], k.keys[1:]
+			k.status |= kbdOBF
+		}
+	}
+	pending := k.status&kbdOBF != 0 && k.ccb&kbdCCBInterrupt != 0
+	if pending == k.raised {
+		return
+	}
+	k.raised = pending
+	if pending {
+		k.irq.RaiseIRQ(kbdIRQ)
+	} else {
+		k.irq.LowerIRQ(kbdIRQ)
+	}
+}
+
+func (k *Keyboard) reply(data ...byte) {
+	k.replies = append(k.replies, data...)
+}
+
+// In reads the output buffer or the status
+func (k *Keyboard) In(port uint16, size uint8) uint32 {
+	if port == kbdStatus {
+		k.poll()
+		return uint32(k.status)
+	}
+	data := k.output
+	k.status &^= kbdOBF
+	// IRQ1 falls, and rises again if the next data is ready
+	if k.raised {
+		k.raised = false
+		k.irq.LowerIRQ(kbdIRQ)
+	}
+	k.update()
+	return uint32(data)
+}
+
+// Out writes the command to the controller, or the data to the keyboard or
+// the command waiting for it
+func (k *Keyboard) Out(port uint16, size uint8, value uint32) {
+	defer k.update()
+	v := uint8(value)
+	if port == kbdStatus {
+		k.status |= kbdCommand
+		k.controllerCommand(v)
+		return
+	}
+	k.status &^= kbdCommand
+	command := k.pending
+	k.pending = 0
+	switch command {
+	case 0x60: // write the command byte
+		k.ccb = v
+		k.status = k.status&^kbdSYS | v&kbdCCBSystem
+	case 0xD1: // write the output port
+		k.port = v
+	case 0xD2: // write the keyboard output buffer
+		k.reply(v)
+	default:
+		k.keyboardCommand(v)
+	}
+}
+
+func (k *Keyboard) controllerCommand(command uint8) {
+	switch command {
+	case 0x20: // read the command byte
+		k.reply(k.ccb)
+	case 0x60, 0xD1, 0xD2:
+		k.pending = command
+	case 0xA7, 0xA8: // disable or enable the auxiliary device
+	case 0xA9: // test the auxiliary interface, the clock line is stuck low
+		k.reply(0x01)
+	case 0xAA: // self test
+		k.reply(0x55)
+	case 0xAB: // test the keyboard interface
+		k.reply(0x00)
+	case 0xAD: // disable the keyboard interface
+		k.ccb |= kbdCCBDisable
+	case 0xAE: // enable the keyboard interface
+		k.ccb &^= kbdCCBDisable
+	case 0xD0: // read the output port
+		k.reply(k.port)
+	}
+}
+
+func (k *Keyboard) keyboardCommand(v uint8) {
+	if command := k.device; command != 0 {
+		// the data of the command
+		k.device = 0
+		if command == 0xF0 && v == 0 {
+			// get the scancode set
+			k.reply(kbdACK, 0x01)
+			return
+		}
+		k.reply(kbdACK)
+		return
+	}
+	switch v {
+	case 0xED, 0xF0, 0xF3: // set LEDs, scancode set, typematic rate
+		k.device = v
+		k.reply(kbdACK)
+	case 0xEE:
+		k.reply(kbdEcho)
+	case 0xF2: // identify
+		k.reply(kbdACK, 0xAB, 0x83)
+	case 0xF4: // enable scanning
+		k.enabled = true
+		k.reply(kbdACK)
+	case 0xF5: // disable scanning and reset
+		k.enabled = false
+		k.keys = nil
+		k.reply(kbdACK)
+	case 0xF6: // reset
+		k.keys = nil
+		k.reply(kbdACK)
+	case 0xFF: // reset and self test
+		k.enabled = true
+		k.keys = nil
+		k.reply(kbdACK, kbdSelfTest)
+	default:
+		k.reply(kbdResend)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// read the output buffer while it is full
+func readKeyboard(k *Keyboard) []byte {
+	var data []byte
+	for k.In(kbdStatus, 8)&kbdOBF != 0 {
+		data = append(data, uint8(k.In(kbdData, 8)))
+	}
+	return data
+}
+
+func TestKeyboardController(t *testing.T) {
+	k := NewKeyboard(&irqRecorder{})
+	if status := k.In(kbdStatus, 8); status != kbdSYS|kbdUnlock {
+		t.Fatalf("status=0x%x", status)
+	}
+
+	for _, tt := range []struct {
+		writes [][2]uint32
+		want   []byte
+	}{
+		{[][2]uint32{{kbdStatus, 0xAA}}, []byte{0x55}},
+		{[][2]uint32{{kbdStatus, 0x20}}, []byte{kbdCCBInterrupt | kbdCCBSystem | kbdCCBTranslate}},
+		{[][2]uint32{{kbdStatus, 0x60}, {kbdData, kbdCCBSystem}, {kbdStatus, 0x20}}, []byte{kbdCCBSystem}},
+		{[][2]uint32{{kbdStatus, 0xD1}, {kbdData, 0xDF}, {kbdStatus, 0xD0}}, []byte{0xDF}},
+		{[][2]uint32{{kbdData, 0xFF}}, []byte{kbdACK, kbdSelfTest}},
+		{[][2]uint32{{kbdData, 0xF0}, {kbdData, 0}}, []byte{kbdACK, kbdACK, 0x01}},
+		{[][2]uint32{{kbdData, 0xED}, {kbdData, 0x07}}, []byte{kbdACK, kbdACK}},
+		{[][2]uint32{{kbdData, 0xF2}}, []byte{kbdACK, 0xAB, 0x83}},
+		{[][2]uint32{{kbdData, 0xEE}}, []byte{kbdEcho}},
+	} {
+		for _, w := range tt.writes {
+			k.Out(uint16(w[0]), 8, w[1])
+		}
+		if data := readKeyboard(k); !bytes.Equal(data, tt.want) {
+			t.Errorf("%v: data=%x, want %x", tt.writes, data, tt.want)
+		}
+	}
+}
+
+func TestKeyboardKeys(t *testing.T) {
+	irq := &irqRecorder{}
+	k := NewKeyboard(irq)
+
+	k.KeyDown(KeyUp)
+	k.KeyUp(KeyUp)
+	k.TypeRune('A')
+	k.TypeRune(3) // Ctrl-C
+	k.TypeRune('\n')
+
+	// IRQ1 is raised for each byte
+	k.poll()
+	if !irq.lines[kbdIRQ] {
+		t.Fatal("IRQ1 must be raised")
+	}
+	want := []byte{0xE0, 0x48, 0xE0, 0xC8, 0x2A, 0x1E, 0x9E, 0xAA, 0x1D, 0x2E, 0xAE, 0x9D, 0x1C, 0x9C}
+	if data := readKeyboard(k); !bytes.Equal(data, want) {
+		t.Fatalf("data=%x, want %x", data, want)
+	}
+	if irq.raised != len(want) || irq.lines[kbdIRQ] {
+		t.Fatalf("raised=%d", irq.raised)
+	}
+
+	// the keys wait while the interface is disabled
+	k.Out(kbdStatus, 8, 0xAD)
+	k.KeyDown(KeySpace)
+	if data := readKeyboard(k); len(data) != 0 {
+		t.Fatalf("data=%x", data)
+	}
+	k.Out(kbdStatus, 8, 0xAE)
+	if data := readKeyboard(k); !bytes.Equal(data, []byte{0x39}) {
+		t.Fatalf("data=%x", data)
+	}
+
+	// the keys are lost while scanning is disabled
+	k.Out(kbdData, 8, 0xF5)
+	k.KeyDown(KeySpace)
+	if data := readKeyboard(k); !bytes.Equal(data, []byte{kbdACK}) {
+		t.Fatalf("data=%x", data)
+	}
+}
+
+func TestKeyByCode(t *testing.T) {
+	for code, want := range map[string]Key{"KeyA": 0x1E, "KeyZ": 0x2C, "Digit1": 0x02, "Digit0": 0x0B, "Enter": KeyEnter, "F1": 0x3B, "F10": 0x44, "ArrowLeft": KeyLeft} {
+		if key, ok := KeyByCode(code); !ok || key != want {
+			t.Errorf("%s: key=0x%x, want 0x%x", code, key, want)
+		}
+	}
+	if _, ok := KeyByCode("MetaLeft"); ok {
+		t.Error("MetaLeft must not be a key")
+	}
+	for _, c := range "azAZ09!)[]{};:'\"`~\\|,<.>/? \t\b\x1b" {
+		if key, shift, ok := keyByRune(c); !ok || rune(map[bool]string{false: normalKeys, true: shiftedKeys}[shift][key]) != c {
+			t.Errorf("%q: key=0x%x", c, key)
+		}
+	}
+}
+
+func TestKeyboardTypeFrom(t *testing.T) {
+	k := NewKeyboard(&irqRecorder{})
+	k.TypeFrom(strings.NewReader("ls\n"))
+
+	var data []byte
+	for deadline := time.Now().Add(time.Second); len(data) < 6 && time.Now().Before(deadline); {
+		data = append(data, readKeyboard(k)...)
+	}
+	if want := []byte{0x26, 0xA6, 0x1F, 0x9F, 0x1C, 0x9C}; !bytes.Equal(data, want) {
+		t.Fatalf("data=%x, want %x", data, want)
+	}
+}
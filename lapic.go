@@ -0,0 +1,268 @@
+package main
+
+// LocalAPIC is ..
+// in CPU
+// - Select Interrupt Vector Number
+// - End of Interrupt
+// - Timer, Thermo sensor, Performance counter
+// - API IDs are unique in CPUs.
+type LocalAPIC struct {
+	id     uint8
+	irr    [8]uint32 // Interrupt Request Register: CPUが未処理のベクタ番号にビットが立つ
+	isr    [8]uint32 // In-Service Register: CPUが処理中のベクタ番号にビットが立ち、EOIで下りる
+	tpr    uint32    // task priority
+	svr    uint32    // spurious interrupt vector, and the APIC software enable
+	ldr    uint32    // logical destination
+	dfr    uint32    // destination format
+	icr    uint64    // interrupt command
+	lvt    [lapicLVTs]uint32
+	ioapic *IOAPIC // EOI is broadcast to
+
+	// timer
+	initialCount uint32
+	currentCount uint32
+	divide       uint32 // TDCR
+	clock        uint32 // bus cycles not counted yet by the divider
+}
+
+// memory mapped registers, from LocalAPICBase
+const (
+	lapicID       = 0x020
+	lapicVersion  = 0x030
+	lapicTPR      = 0x080 // task priority
+	lapicEOI      = 0x0B0
+	lapicLDR      = 0x0D0 // logical destination
+	lapicDFR      = 0x0E0 // destination format
+	lapicSVR      = 0x0F0 // spurious interrupt vector
+	lapicISR      = 0x100 // 8 registers for 256 vectors
+	lapicTMR      = 0x180
+	lapicIRR      = 0x200
+	lapicESR      = 0x280 // error status
+	lapicICRLow   = 0x300 // interrupt command
+	lapicICRHigh  = 0x310
+	lapicLVTTimer = 0x320 // local vector table, 0x10 bytes per entry
+	lapicLVTError = 0x370
+	lapicTICR     = 0x380 // timer initial count
+	lapicTCCR     = 0x390 // timer current count
+	lapicTDCR     = 0x3E0 // timer divide configuration
+	lapicSize     = 0x1000
+)
+
+// entries of the local vector table: timer, thermal sensor, performance
+// counter, LINT0, LINT1 and error
+const lapicLVTs = (lapicLVTError-lapicLVTTimer)/0x10 + 1
+
+// bits of the registers
+const (
+	lapicEnable     = 1 << 8  // SVR: APIC software enable
+	lvtMasked       = 1 << 16 // LVT
+	lvtPeriodic     = 1 << 17 // LVT timer
+	icrDeliveryMode = 7 << 8  // ICR: 0 is fixed
+	icrShorthand    = 3 << 18 // ICR: destination shorthand
+	icrSelf         = 1 << 18
+	icrAllSelf      = 2 << 18
+)
+
+// NewLocalAPIC returns the local APIC with the ID, which broadcasts EOI to
+// ioapic
+func NewLocalAPIC(id uint8, ioapic *IOAPIC) LocalAPIC {
+	l := LocalAPIC{id: id, svr: 0xFF, dfr: 0xFFFFFFFF, ioapic: ioapic}
+	for i := range l.lvt {
+		l.lvt[i] = lvtMasked
+	}
+	return l
+}
+
+func (l *LocalAPIC) enabled() bool {
+	return l.svr&lapicEnable != 0
+}
+
+func (l *LocalAPIC) read32(offset uint32) uint32 {
+	switch {
+	case offset == lapicID:
+		return uint32(l.id) << 24
+	case offset == lapicVersion:
+		// version, and the index of the last LVT entry
+		return 0x14 | (lapicLVTs-1)<<16
+	case offset == lapicTPR:
+		return l.tpr
+	case offset == lapicLDR:
+		return l.ldr
+	case offset == lapicDFR:
+		return l.dfr
+	case offset == lapicSVR:
+		return l.svr
+	case lapicISR <= offset && offset < lapicTMR:
+		return l.isr[(offset-lapicISR)/0x10]
+	case lapicIRR <= offset && offset < lapicESR:
+		return l.irr[(offset-lapicIRR)/0x10]
+	case offset == lapicICRLow:
+		// the IPI is sent immediately, and the delivery status is always idle
+		return uint32(l.icr)
+	case offset == lapicICRHigh:
+		return uint32(l.icr >> 32)
+	case lapicLVTTimer <= offset && offset <= lapicLVTError:
+		return l.lvt[(offset-lapicLVTTimer)/0x10]
+	case offset == lapicTICR:
+		return l.initialCount
+	case offset == lapicTCCR:
+		return l.currentCount
+	case offset == lapicTDCR:
+		return l.divide
+	}
+	return 0
+}
+
+// Read the memory mapped register at offset from LocalAPICBase
+func (l *LocalAPIC) Read(offset uint32, size uint8) uint32 {
+	return readRegister32(l.read32, offset, size)
+}
+
+// Write the memory mapped register at offset from LocalAPICBase
+func (l *LocalAPIC) Write(offset uint32, size uint8, value uint32) {
+	writeRegister32(l.read32, l.write32, offset, size, value)
+}
+
+func (l *LocalAPIC) write32(offset, value uint32) {
+	switch {
+	case offset == lapicID:
+		l.id = uint8(value >> 24)
+	case offset == lapicTPR:
+		l.tpr = value & 0xFF
+	case offset == lapicEOI:
+		if vector, ok := l.endOfInterrupt(); ok && l.ioapic != nil {
+			l.ioapic.endOfInterrupt(vector)
+		}
+	case offset == lapicLDR:
+		l.ldr = value & 0xFF000000
+	case offset == lapicDFR:
+		l.dfr = value | 0x0FFFFFFF
+	case offset == lapicSVR:
+		l.svr = value & 0x3FF
+		if !l.enabled() {
+			for i := range l.lvt {
+				l.lvt[i] |= lvtMasked
+			}
+		}
+	case offset == lapicICRLow:
+		l.icr = l.icr&0xFFFFFFFF00000000 | uint64(value)
+		l.sendIPI()
+	case offset == lapicICRHigh:
+		l.icr = l.icr&0xFFFFFFFF | uint64(value)<<32
+	case lapicLVTTimer <= offset && offset <= lapicLVTError:
+		if !l.enabled() {
+			value |= lvtMasked
+		}
+		l.lvt[(offset-lapicLVTTimer)/0x10] = value
+	case offset == lapicTICR:
+		l.initialCount = value
+		l.currentCount = value
+		l.clock = 0
+	case offset == lapicTDCR:
+		l.divide = value & 0xB
+	}
+}
+
+// send the fixed IPI to itself. There is no other CPU, and the other IPIs
+// such as INIT and STARTUP are ignored.
+func (l *LocalAPIC) sendIPI() {
+	shorthand := l.icr & icrShorthand
+	if l.icr&icrDeliveryMode == 0 && (shorthand == icrSelf || shorthand == icrAllSelf) {
+		l.accept(uint8(l.icr))
+	}
+}
+
+// bus cycles per timer count
+func (l *LocalAPIC) divider() uint32 {
+	d := l.divide&3 | l.divide>>1&4
+	if d == 7 {
+		return 1
+	}
+	return 2 << d
+}
+
+// advance the timer by bus cycles, and the interrupt of LVT timer is raised
+// when the count reaches 0
+func (l *LocalAPIC) tick(cycles uint32) {
+	if l.currentCount == 0 {
+		return
+	}
+	l.clock += cycles
+	count := l.clock / l.divider()
+	l.clock %= l.divider()
+	for count > 0 && l.currentCount > 0 {
+		if count < l.currentCount {
+			l.currentCount -= count
+			return
+		}
+		count -= l.currentCount
+		l.currentCount = 0
+		timer := l.lvt[0]
+		if timer&lvtMasked == 0 {
+			l.accept(uint8(timer))
+		}
+		if timer&lvtPeriodic != 0 {
+			l.currentCount = l.initialCount
+		}
+	}
+}
+
+// accept the interrupt from I/O APIC, the timer or the IPI
+func (l *LocalAPIC) accept(vector uint8) {
+	l.irr[vector/32] |= 1 << (vector % 32)
+}
+
+// the highest vector in the 256bit register
+func highestVector(register *[8]uint32) (uint8, bool) {
+	for i := 7; i >= 0; i-- {
+		for bit := 31; bit >= 0; bit-- {
+			if register[i]&(1<<uint(bit)) != 0 {
+				return uint8(i*32 + bit), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// the requested vector of the higher priority class than the processor
+// priority, which is TPR or the class of the in-service vector
+func (l *LocalAPIC) pending() (uint8, bool) {
+	if !l.enabled() {
+		return 0, false
+	}
+	vector, ok := highestVector(&l.irr)
+	if !ok {
+		return 0, false
+	}
+	priority := uint8(l.tpr) >> 4
+	if inService, ok := highestVector(&l.isr); ok && inService>>4 > priority {
+		priority = inService >> 4
+	}
+	if vector>>4 <= priority {
+		return 0, false
+	}
+	return vector, true
+}
+
+// whether an interrupt is delivered to the CPU
+func (l *LocalAPIC) hasInterrupt() bool {
+	_, ok := l.pending()
+	return ok
+}
+
+// the CPU takes the interrupt, and it is in service until EOI
+func (l *LocalAPIC) acknowledge() uint8 {
+	vector, _ := l.pending()
+	l.irr[vector/32] &^= 1 << (vector % 32)
+	l.isr[vector/32] |= 1 << (vector % 32)
+	return vector
+}
+
+// end of the highest in-service interrupt, return its vector
+func (l *LocalAPIC) endOfInterrupt() (uint8, bool) {
+	vector, ok := highestVector(&l.isr)
+	if ok {
+		l.isr[vector/32] &^= 1 << (vector % 32)
+	}
+	return vector, ok
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLocalAPICTimer(t *testing.T) {
+	// jmp $
+	e := newTestEmulator([]byte{0xEB, 0xFE}, true)
+	e.sreg[CS] = 0x08
+	e.setRegister32(ESP, 0x8000)
+	setInterruptGate(e, 0x20, 0x9000)
+	e.memory[0x9000] = 0xCF // iret
+	e.eflags.set(InterruptFlag)
+
+	// as xv6's lapicinit
+	for _, w := range [][2]uint32{
+		{lapicSVR, lapicEnable | 0x3F},
+		{lapicTDCR, 0xB}, // divide by 1
+		{lapicLVTTimer, lvtPeriodic | 0x20},
+		{lapicTICR, 100},
+		{lapicEOI, 0},
+		{lapicTPR, 0},
+	} {
+		e.setMemory32(LocalAPICBase+w[0], w[1])
+	}
+	if id := e.getMemory32(LocalAPICBase+lapicID) >> 24; id != 1 {
+		t.Fatalf("id=%d", id)
+	}
+	if e.getMemory32(LocalAPICBase+lapicVersion)>>16&0xFF < 4 {
+		t.Fatalf("version=0x%x", e.getMemory32(LocalAPICBase+lapicVersion))
+	}
+
+	// an instruction is a bus cycle, and the interrupt is taken every 100
+	// cycles. iret of the previous tick is the 1st cycle of the next one.
+	for tick := 0; tick < 3; tick++ {
+		cycles := 99
+		if tick > 0 {
+			cycles = 98
+		}
+		for i := 0; i < cycles; i++ {
+			if err := e.execInst(); err != nil || e.eip != 0x7c00 {
+				t.Fatalf("tick %d: eip=0x%x err=%v", tick, e.eip, err)
+			}
+		}
+		if e.getMemory32(LocalAPICBase+lapicTCCR) != 1 {
+			t.Fatalf("tick %d: tccr=%d", tick, e.getMemory32(LocalAPICBase+lapicTCCR))
+		}
+		// the timer interrupt is taken before the 100th instruction
+		if err := e.execInst(); err != nil || e.eip != 0x9000 {
+			t.Fatalf("tick %d: eip=0x%x err=%v", tick, e.eip, err)
+		}
+		if e.getMemory32(LocalAPICBase+lapicISR+0x10) != 1 {
+			t.Fatalf("tick %d: isr=0x%x", tick, e.getMemory32(LocalAPICBase+lapicISR+0x10))
+		}
+		e.setMemory32(LocalAPICBase+lapicEOI, 0)
+		if err := e.execInst(); err != nil || e.eip != 0x7c00 {
+			t.Fatalf("tick %d: eip=0x%x err=%v", tick, e.eip, err)
+		}
+	}
+
+	// TPR blocks the timer interrupt
+	e.setMemory32(LocalAPICBase+lapicTPR, 0x20)
+	for i := 0; i < 200; i++ {
+		e.execInst()
+	}
+	if e.eip != 0x7c00 || e.getMemory32(LocalAPICBase+lapicIRR+0x10) != 1 {
+		t.Fatalf("eip=0x%x irr=0x%x", e.eip, e.getMemory32(LocalAPICBase+lapicIRR+0x10))
+	}
+}
+
+func TestLocalAPIC(t *testing.T) {
+	ioapic := NewIOAPIC(1, nil)
+	l := NewLocalAPIC(1, &ioapic)
+	l.write32(lapicSVR, lapicEnable|0x3F)
+
+	// divide configuration
+	for _, test := range []struct{ tdcr, divider uint32 }{
+		{0x0, 2}, {0x1, 4}, {0x2, 8}, {0x3, 16}, {0x8, 32}, {0x9, 64}, {0xA, 128}, {0xB, 1},
+	} {
+		l.write32(lapicTDCR, test.tdcr)
+		if l.divider() != test.divider {
+			t.Fatalf("tdcr=0x%x divider=%d", test.tdcr, l.divider())
+		}
+	}
+
+	// one-shot timer
+	l.write32(lapicTDCR, 0x0)
+	l.write32(lapicLVTTimer, 0x30)
+	l.write32(lapicTICR, 3)
+	l.tick(5)
+	if l.read32(lapicTCCR) != 1 || l.hasInterrupt() {
+		t.Fatalf("tccr=%d", l.read32(lapicTCCR))
+	}
+	l.tick(1)
+	if l.read32(lapicTCCR) != 0 || !l.hasInterrupt() || l.acknowledge() != 0x30 {
+		t.Fatalf("tccr=%d", l.read32(lapicTCCR))
+	}
+
+	// self IPI
+	l.write32(lapicICRLow, icrSelf|0x40)
+	if !l.hasInterrupt() || l.acknowledge() != 0x40 {
+		t.Fatal("self IPI must be accepted")
+	}
+	l.write32(lapicEOI, 0)
+	if l.read32(lapicISR+0x20) != 0 || l.read32(lapicISR+0x10) != 1<<16 {
+		t.Fatalf("isr=0x%x", l.read32(lapicISR+0x10))
+	}
+
+	// LVT can not be unmasked while the APIC is disabled
+	l.write32(lapicSVR, 0x3F)
+	l.write32(lapicLVTTimer, 0x30)
+	if l.read32(lapicLVTTimer)&lvtMasked == 0 || l.hasInterrupt() {
+		t.Fatalf("lvt=0x%x", l.read32(lapicLVTTimer))
+	}
+}
@@ -9,6 +9,8 @@ import (
 	// "github.com/hajimehoshi/ebiten"
 	// "github.com/hajimehoshi/ebiten/ebitenutil"
 	"image"
+	"image/draw"
+	"io"
 	"io/ioutil"
 	// "log"
 	// "math/rand"
@@ -22,8 +24,8 @@ import (
 )
 
 const (
-	height = 120
-	width  = 160
+	height = vgaHeight
+	width  = vgaWidth
 )
 
 var (
@@ -35,12 +37,6 @@ func printf(format string, a ...interface{}) {
 }
 
 // func update(screen *ebiten.Image) error {
-// 	for i := 0; i < width*height; i++ {
-// 		vram.Pix[4*i] = uint8(rand.Int() & 0xFF)
-// 		vram.Pix[4*i+1] = uint8(rand.Int() & 0xFF)
-// 		vram.Pix[4*i+2] = uint8(rand.Int() & 0xFF)
-// 		vram.Pix[4*i+3] = 0xff
-// 	}
 // 	if ebiten.IsRunningSlowly() {
 // 	}
 // 	screen.ReplacePixels(vram.Pix)
@@ -53,6 +49,10 @@ func main() {
 	filename := flag.String("f", "", "binary filename (*.bin)")
 	// enableGUI := flag.Bool("gui", false, "gui mode")
 	silent := flag.Bool("silent", false, "silent mode")
+	fsname := flag.String("fs", "", "disk image of the slave drive (fs.img)")
+	snapshot := flag.Bool("snapshot", false, "discard the changes of the disk images")
+	keyboard := flag.Bool("kbd", false, "type the standard input on the keyboard instead of COM1")
+	console := flag.Bool("cga", false, "draw the CGA text screen instead of printing COM1")
 	flag.Parse()
 
 	// load binary
@@ -103,11 +103,35 @@ func main() {
 	// printf("bytes =\n%s", hex.Dump(bytes))
 
 	// setup emulator
-	e := NewEmulator(0x7c00+0x10240000, 0x7c00, 0x6f04, false, *silent, os.Stdin, os.Stdout, disasm)
+	var input io.Reader = os.Stdin
+	if *keyboard {
+		input = nil
+	}
+	var output io.Writer = os.Stdout
+	if *console {
+		output = ioutil.Discard
+	}
+	e := NewEmulator(0x7c00+0x10240000, 0x7c00, 0x6f04, false, *silent, input, output, disasm)
+	if *keyboard {
+		e.keyboard.TypeFrom(os.Stdin)
+	}
 	for i := 0; i < len(bytes); i++ {
 		e.memory[uint32(i+0x7c00)] = bytes[i]
 	}
-	e.io.hdds[0], _ = os.Open(*filename)
+	for i, name := range []string{*filename, *fsname} {
+		if name == "" {
+			continue
+		}
+		disk, err := OpenRawDisk(name, i == 0 || *snapshot)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		e.io.hdds[i] = disk
+		if *snapshot {
+			e.io.hdds[i] = NewOverlayDisk(disk)
+		}
+	}
 
 	// emulate
 	// chFinished := make(chan bool)
@@ -126,12 +150,21 @@ func main() {
 			printf(err.Error())
 			os.Exit(1)
 		}
+		if *console && i%100000 == 0 && e.cga.Dirty() {
+			e.cga.Render(os.Stdout)
+		}
+		if e.vga.Mode() == vgaModeGraphic && i%100000 == 0 && e.vga.Dirty() {
+			draw.Draw(vram, vram.Bounds(), e.vga.Frame(), image.Point{}, draw.Src)
+		}
 
 		if e.eip == 0 || e.eip == 0x7c00 {
 			break
 		}
 		i++
 	}
+	if *console {
+		e.cga.Render(os.Stdout)
+	}
 	if !*silent {
 		e.dump(i)
 	}
@@ -44,7 +44,23 @@ func main() {
 	for i := 0; i < len(bytes); i++ {
 		e.memory[uint32(i+0x7c00)] = bytes[i]
 	}
-	e.io.hdds[0], _ = Assets.Open("/xv6-public/xv6.img")
+	e.io.hdds[0] = NewMemoryDisk(bytes)
+	for event, down := range map[string]bool{"keydown": true, "keyup": false} {
+		down := down
+		js.Global().Get("document").Call("addEventListener", event, js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			key, ok := KeyByCode(args[0].Get("code").String())
+			if !ok {
+				return nil
+			}
+			args[0].Call("preventDefault")
+			if down {
+				e.keyboard.KeyDown(key)
+			} else {
+				e.keyboard.KeyUp(key)
+			}
+			return nil
+		}))
+	}
 	f, err = Assets.Open("/xv6-public/xv6.img")
 
 	// emulate
@@ -66,6 +82,12 @@ func main() {
 			break
 		}
 		i++
+
+		// yield to the event loop of JavaScript, so that the key events
+		// are handled
+		if i%100000 == 0 {
+			time.Sleep(time.Millisecond)
+		}
 	}
 	e.dump(i)
 	printf("End of program\n")
@@ -0,0 +1,112 @@
+package main
+
+// Page Directory / Page Table Entry
+const (
+	PagePresent  = 0x1
+	PageWrite    = 0x2  // writable
+	PageUser     = 0x4  // accessible in user mode
+	PageAccessed = 0x20 // set by the CPU when the page is accessed
+	PageDirty    = 0x40 // set by the CPU when the page is written
+	PageSize     = 0x80 // 4MB page in PDE (CR4PageSizeExtension)
+)
+
+func (e *Emulator) readPhysical32(paddr uint32) uint32 {
+	return e.bus.read(paddr, 32)
+}
+
+func (e *Emulator) writePhysical32(paddr, value uint32) {
+	e.bus.write(paddr, 32, value)
+}
+
+// virtual address -> segmentation -> linear address -> paging -> physical address
+func (e *Emulator) v2p(vaddress uint32) uint32 {
+	return e.translate(vaddress, false)
+}
+
+// translate the linear address for read or write by the current privilege
+// level
+func (e *Emulator) translate(vaddress uint32, write bool) uint32 {
+	return e.translateFor(vaddress, write, e.cpl() == 3)
+}
+
+// translate the linear address for read or write in user or supervisor mode.
+// #PF is raised if the page is not present or the access is not permitted,
+// otherwise accessed and dirty bits are updated.
+func (e *Emulator) translateFor(vaddress uint32, write, user bool) uint32 {
+	if e.cr[0]&CR0PagingFlag == 0 {
+		return vaddress
+	}
+
+	if entry, offset, ok := e.tlb.lookup(vaddress); ok {
+		// otherwise, walk the page tables to set the dirty bit or raise #PF
+		if e.permitted(entry.flags, write, user) && (entry.dirty || !write) {
+			e.tlb.Hits++
+			return entry.frame + offset
+		}
+	}
+	e.tlb.Misses++
+
+	var errorCode uint32
+	if write {
+		errorCode |= pfWrite
+	}
+	if user {
+		errorCode |= pfUser
+	}
+
+	pdeAddress := e.cr[3]&0xFFFFF000 + 4*(vaddress>>22)
+	pde := e.readPhysical32(pdeAddress)
+	if pde&PagePresent == 0 {
+		e.raisePageFault(vaddress, errorCode)
+	}
+
+	if pde&PageSize != 0 && e.cr[4]&CR4PageSizeExtension != 0 {
+		// 4MB page
+		if !e.permitted(pde, write, user) {
+			e.raisePageFault(vaddress, errorCode|pfProtection)
+		}
+		e.updatePageEntry(pdeAddress, pde, write)
+		frame := pde & 0xFFC00000
+		e.tlb.insert(vaddress, tlbEntry{frame, pde, write || pde&PageDirty != 0}, true)
+		return frame + vaddress&0x003FFFFF
+	}
+
+	// 4KB page
+	pteAddress := pde&0xFFFFF000 + 4*((vaddress>>12)&0x3FF)
+	pte := e.readPhysical32(pteAddress)
+	if pte&PagePresent == 0 {
+		e.raisePageFault(vaddress, errorCode)
+	}
+	// the permission is the intersection of PDE and PTE
+	if !e.permitted(pde&pte, write, user) {
+		e.raisePageFault(vaddress, errorCode|pfProtection)
+	}
+	e.updatePageEntry(pdeAddress, pde, false)
+	e.updatePageEntry(pteAddress, pte, write)
+	frame := pte & 0xFFFFF000
+	e.tlb.insert(vaddress, tlbEntry{frame, pde & pte, write || pte&PageDirty != 0}, false)
+	return frame + vaddress&0xFFF
+}
+
+// whether the access is permitted by the flags of the page entry
+func (e *Emulator) permitted(flags uint32, write, user bool) bool {
+	if user && flags&PageUser == 0 {
+		return false
+	}
+	if write && flags&PageWrite == 0 {
+		// supervisor can write read-only pages unless CR0.WP is set
+		return !user && e.cr[0]&CR0WriteProtect == 0
+	}
+	return true
+}
+
+// set the accessed bit, and the dirty bit if written
+func (e *Emulator) updatePageEntry(address, entry uint32, write bool) {
+	flags := uint32(PageAccessed)
+	if write {
+		flags |= PageDirty
+	}
+	if entry&flags != flags {
+		e.writePhysical32(address, entry|flags)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTranslate(t *testing.T) {
+	const (
+		pd = 0x10000 // page directory
+		pt = 0x11000 // page table for 0x00400000-0x007FFFFF
+	)
+	tests := []struct {
+		name      string
+		pde       uint32 // PDE[1]
+		pte       uint32 // PTE[0x23] in pt (for 0x00423000)
+		cr0       uint32
+		cr4       uint32
+		user      bool
+		write     bool
+		paddress  uint32 // translated 0x00423456
+		errorCode int64  // #PF error code, -1 if no fault
+		pdeAfter  uint32
+		pteAfter  uint32
+	}{
+		{"4KB read", pt | 0x7, 0x5000 | 0x7, 0, 0, false, false, 0x5456, -1, pt | 0x27, 0x5000 | 0x27},
+		{"4KB write", pt | 0x7, 0x5000 | 0x7, 0, 0, false, true, 0x5456, -1, pt | 0x27, 0x5000 | 0x67},
+		{"4KB not present PDE", 0, 0x5000 | 0x7, 0, 0, false, false, 0, 0, 0, 0x5000 | 0x7},
+		{"4KB not present PTE", pt | 0x7, 0x5000, 0, 0, true, true, 0, pfWrite | pfUser, pt | 0x7, 0x5000},
+		{"4KB user read supervisor page", pt | 0x7, 0x5000 | 0x3, 0, 0, true, false, 0, pfProtection | pfUser, pt | 0x7, 0x5000 | 0x3},
+		{"4KB user read supervisor PDE", pt | 0x3, 0x5000 | 0x7, 0, 0, true, false, 0, pfProtection | pfUser, pt | 0x3, 0x5000 | 0x7},
+		{"4KB user write read-only page", pt | 0x7, 0x5000 | 0x5, 0, 0, true, true, 0, pfProtection | pfWrite | pfUser, pt | 0x7, 0x5000 | 0x5},
+		{"4KB supervisor write read-only page", pt | 0x7, 0x5000 | 0x5, 0, 0, false, true, 0x5456, -1, pt | 0x27, 0x5000 | 0x65},
+		{"4KB supervisor write read-only page (WP)", pt | 0x7, 0x5000 | 0x5, CR0WriteProtect, 0, false, true, 0, pfProtection | pfWrite, pt | 0x7, 0x5000 | 0x5},
+		{"4MB read", 0x00C00000 | 0x87, 0, 0, CR4PageSizeExtension, true, false, 0x00C23456, -1, 0x00C00000 | 0xA7, 0},
+		{"4MB write", 0x00C00000 | 0x87, 0, 0, CR4PageSizeExtension, true, true, 0x00C23456, -1, 0x00C00000 | 0xE7, 0},
+		{"4MB user write read-only page", 0x00C00000 | 0x85, 0, 0, CR4PageSizeExtension, true, true, 0, pfProtection | pfWrite | pfUser, 0x00C00000 | 0x85, 0},
+		{"PS without PSE", pt | 0x87, 0x5000 | 0x7, 0, 0, false, false, 0x5456, -1, pt | 0xA7, 0x5000 | 0x27},
+	}
+
+	e := newTestEmulator([]byte{}, true)
+	for _, test := range tests {
+		e.writePhysical32(pd+4*1, test.pde)
+		e.writePhysical32(pt+4*0x23, test.pte)
+		e.cr[0] = 0x11 | CR0PagingFlag | test.cr0
+		e.cr[2] = 0
+		e.cr[3] = pd
+		e.cr[4] = test.cr4
+		e.tlb.flush()
+		e.sreg[CS] = 0x08
+		if test.user {
+			e.sreg[CS] = 0x1B
+		}
+
+		var paddress uint32
+		f := catchFault(func() { paddress = e.translate(0x00423456, test.write) })
+		if test.errorCode < 0 {
+			if f != nil || paddress != test.paddress {
+				t.Fatalf("%s: paddress=0x%x fault=%v", test.name, paddress, f)
+			}
+		} else if f == nil || f.Vector != vectorPF || f.ErrorCode != uint32(test.errorCode) || e.cr[2] != 0x00423456 {
+			t.Fatalf("%s: fault=%v cr2=0x%x", test.name, f, e.cr[2])
+		}
+		if pde := e.readPhysical32(pd + 4*1); pde != test.pdeAfter {
+			t.Fatalf("%s: pde=0x%x", test.name, pde)
+		}
+		if pte := e.readPhysical32(pt + 4*0x23); pte != test.pteAfter {
+			t.Fatalf("%s: pte=0x%x", test.name, pte)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+// group 3: test r/m, imm (0xF7 /0)
+func (e *Emulator) testRmImm(inst *Instruction) {
+	if inst.opsize == 16 {
+		e.eflags.updateByLogical(uint32(e.getRm16(inst.modrm))&inst.imm, 16)
+	} else {
+		e.eflags.updateByLogical(e.getRm32(inst.modrm)&inst.imm, 32)
+	}
+}
+
+// group 3: not r/m8 (0xF6 /2)
+func (e *Emulator) notRm8(inst *Instruction) {
+	e.setRm8(inst.modrm, ^e.getRm8(inst.modrm))
+}
+
+// group 3: not r/m (0xF7 /2)
+func (e *Emulator) notRm(inst *Instruction) {
+	if inst.opsize == 16 {
+		e.setRm16(inst.modrm, ^e.getRm16(inst.modrm))
+	} else {
+		e.setRm32(inst.modrm, ^e.getRm32(inst.modrm))
+	}
+}
+
+// group 3: neg r/m8 (0xF6 /3)
+func (e *Emulator) negRm8(inst *Instruction) {
+	value := e.getRm8(inst.modrm)
+	e.setRm8(inst.modrm, -value)
+	e.eflags.updateBySubtraction(0, uint32(value), 0, uint32(-value), 8)
+}
+
+// group 3: neg r/m (0xF7 /3)
+func (e *Emulator) negRm(inst *Instruction) {
+	if inst.opsize == 16 {
+		value := e.getRm16(inst.modrm)
+		e.setRm16(inst.modrm, -value)
+		e.eflags.updateBySubtraction(0, uint32(value), 0, uint32(-value), 16)
+	} else {
+		value := e.getRm32(inst.modrm)
+		e.setRm32(inst.modrm, -value)
+		e.eflags.updateBySubtraction(0, value, 0, -value, 32)
+	}
+}
+
+// group 3: AX = AL * r/m8 (0xF6 /4)
+func (e *Emulator) mulRm8(inst *Instruction) {
+	result := uint16(e.getRegister8(AL)) * uint16(e.getRm8(inst.modrm))
+	e.setRegister16(AX, result)
+	e.eflags.updateByMul(uint32(result), result>>8 != 0, 8)
+}
+
+// group 3: DX:AX = AX * r/m16, EDX:EAX = EAX * r/m32 (0xF7 /4)
+func (e *Emulator) mulRm(inst *Instruction) {
+	if inst.opsize == 16 {
+		result := uint32(e.getRegister16(AX)) * uint32(e.getRm16(inst.modrm))
+		e.setRegister16(AX, uint16(result))
+		e.setRegister16(DX, uint16(result>>16))
+		e.eflags.updateByMul(result, result>>16 != 0, 16)
+	} else {
+		result := uint64(e.getRegister32(EAX)) * uint64(e.getRm32(inst.modrm))
+		e.setRegister32(EAX, uint32(result))
+		e.setRegister32(EDX, uint32(result>>32))
+		e.eflags.updateByMul(uint32(result), result>>32 != 0, 32)
+	}
+}
+
+// group 3: AX = AL * r/m8, signed (0xF6 /5)
+func (e *Emulator) imulRm8(inst *Instruction) {
+	result := int16(int8(e.getRegister8(AL))) * int16(int8(e.getRm8(inst.modrm)))
+	e.setRegister16(AX, uint16(result))
+	e.eflags.updateByMul(uint32(result), result != int16(int8(result)), 8)
+}
+
+// group 3: DX:AX = AX * r/m16, EDX:EAX = EAX * r/m32, signed (0xF7 /5)
+func (e *Emulator) imulRm(inst *Instruction) {
+	if inst.opsize == 16 {
+		result := int32(int16(e.getRegister16(AX))) * int32(int16(e.getRm16(inst.modrm)))
+		e.setRegister16(AX, uint16(result))
+		e.setRegister16(DX, uint16(result>>16))
+		e.eflags.updateByMul(uint32(result), result != int32(int16(result)), 16)
+	} else {
+		result := int64(int32(e.getRegister32(EAX))) * int64(int32(e.getRm32(inst.modrm)))
+		e.setRegister32(EAX, uint32(result))
+		e.setRegister32(EDX, uint32(result>>32))
+		e.eflags.updateByMul(uint32(result), result != int64(int32(result)), 32)
+	}
+}
+
+// group 3: AL, AH = AX / r/m8, AX % r/m8 (0xF6 /6)
+func (e *Emulator) divRm8(inst *Instruction) {
+	x := uint32(e.getRegister16(AX))
+	y := uint32(e.getRm8(inst.modrm))
+	if y == 0 || x/y > 0xFF {
+		raise(vectorDE)
+	}
+	e.setRegister8(AL, uint8(x/y))
+	e.setRegister8(AH, uint8(x%y))
+}
+
+// group 3: AX, DX = DX:AX / r/m16, DX:AX % r/m16
+// and EAX, EDX = EDX:EAX / r/m32, EDX:EAX % r/m32 (0xF7 /6)
+func (e *Emulator) divRm(inst *Instruction) {
+	if inst.opsize == 16 {
+		x := uint32(e.getRegister16(DX))<<16 | uint32(e.getRegister16(AX))
+		y := uint32(e.getRm16(inst.modrm))
+		if y == 0 || x/y > 0xFFFF {
+			raise(vectorDE)
+		}
+		e.setRegister16(AX, uint16(x/y))
+		e.setRegister16(DX, uint16(x%y))
+	} else {
+		x := uint64(e.getRegister32(EDX))<<32 | uint64(e.getRegister32(EAX))
+		y := uint64(e.getRm32(inst.modrm))
+		if y == 0 || x/y > 0xFFFFFFFF {
+			raise(vectorDE)
+		}
+		e.setRegister32(EAX, uint32(x/y))
+		e.setRegister32(EDX, uint32(x%y))
+	}
+}
+
+// group 3: AL, AH = AX / r/m8, AX % r/m8, signed (0xF6 /7)
+func (e *Emulator) idivRm8(inst *Instruction) {
+	x := int32(int16(e.getRegister16(AX)))
+	y := int32(int8(e.getRm8(inst.modrm)))
+	if y == 0 || x/y != int32(int8(x/y)) {
+		raise(vectorDE)
+	}
+	e.setRegister8(AL, uint8(x/y))
+	e.setRegister8(AH, uint8(x%y))
+}
+
+// group 3: signed version of divRm (0xF7 /7)
+func (e *Emulator) idivRm(inst *Instruction) {
+	if inst.opsize == 16 {
+		x := int32(uint32(e.getRegister16(DX))<<16 | uint32(e.getRegister16(AX)))
+		y := int32(int16(e.getRm16(inst.modrm)))
+		if y == 0 || x/y != int32(int16(x/y)) {
+			raise(vectorDE)
+		}
+		e.setRegister16(AX, uint16(x/y))
+		e.setRegister16(DX, uint16(x%y))
+	} else {
+		x := int64(uint64(e.getRegister32(EDX))<<32 | uint64(e.getRegister32(EAX)))
+		y := int64(int32(e.getRm32(inst.modrm)))
+		if y == 0 || x/y != int64(int32(x/y)) {
+			raise(vectorDE)
+		}
+		e.setRegister32(EAX, uint32(x/y))
+		e.setRegister32(EDX, uint32(x%y))
+	}
+}
+
+// r = r * r/m, signed (0x0F 0xAF)
+func (e *Emulator) imulRRm(inst *Instruction) {
+	m := inst.modrm
+	if inst.opsize == 16 {
+		e.imul16(m, e.getR16(m), e.getRm16(m))
+	} else {
+		e.imul32(m, e.getR32(m), e.getRm32(m))
+	}
+}
+
+// r = r/m * imm16/32 (0x69), or sign-extended imm8 (0x6B), signed
+func (e *Emulator) imulRRmImm(inst *Instruction) {
+	m := inst.modrm
+	imm := inst.imm
+	if inst.opecode == 0x6B {
+		imm = uint32(int8(imm))
+	}
+	if inst.opsize == 16 {
+		e.imul16(m, e.getRm16(m), uint16(imm))
+	} else {
+		e.imul32(m, e.getRm32(m), imm)
+	}
+}
+
+func (e *Emulator) imul16(m ModRM, v1, v2 uint16) {
+	result := int32(int16(v1)) * int32(int16(v2))
+	e.setR16(m, uint16(result))
+	e.eflags.updateByMul(uint32(result), result != int32(int16(result)), 16)
+}
+
+func (e *Emulator) imul32(m ModRM, v1, v2 uint32) {
+	result := int64(int32(v1)) * int64(int32(v2))
+	e.setR32(m, uint32(result))
+	e.eflags.updateByMul(uint32(result), result != int64(int32(result)), 32)
+}
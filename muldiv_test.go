@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMulDiv(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     []byte
+		real     bool // 16bit mode
+		eax      uint32
+		ecx      uint32
+		edx      uint32
+		eaxAfter uint32
+		edxAfter uint32
+		cf       bool // CF and OF
+	}{
+		{"mul cl", []byte{0xF6, 0xE1}, false, 0x12340080, 0x02, 0, 0x12340100, 0, true},
+		{"mul ecx", []byte{0xF7, 0xE1}, false, 0x80000000, 4, 0xFFFF, 0, 2, true},
+		{"mul cx", []byte{0xF7, 0xE1}, true, 0x1234, 2, 0xAAAA5555, 0x2468, 0xAAAA0000, false},
+		{"imul cl", []byte{0xF6, 0xE9}, false, 0xFF, 0x02, 0, 0xFFFE, 0, false},
+		{"imul ecx", []byte{0xF7, 0xE9}, false, 0xFFFFFFFF, 0xFFFFFFFF, 0, 1, 0, false},
+		{"imul eax, ecx", []byte{0x0F, 0xAF, 0xC1}, false, 0x10000, 0x10000, 0, 0, 0, true},
+		{"imul eax, ecx, -2", []byte{0x6B, 0xC1, 0xFE}, false, 0, 3, 0, 0xFFFFFFFA, 0, false},
+		{"imul ax, cx, 0x100", []byte{0x69, 0xC1, 0x00, 0x01}, true, 0xFFFF0000, 0x0101, 0, 0xFFFF0100, 0, true},
+		{"div cl", []byte{0xF6, 0xF1}, false, 0x0107, 0x10, 0, 0x0710, 0, false},
+		{"div ecx", []byte{0xF7, 0xF1}, false, 0x00000005, 0x10, 1, 0x10000000, 5, false},
+		{"div cx", []byte{0xF7, 0xF1}, true, 0x0003, 0x100, 0x0001, 0x0100, 0x0003, false},
+		{"idiv cl", []byte{0xF6, 0xF9}, false, 0xFFF9, 0x02, 0, 0xFFFD, 0, false},
+		{"idiv ecx", []byte{0xF7, 0xF9}, false, 0xFFFFFFF9, 2, 0xFFFFFFFF, 0xFFFFFFFD, 0xFFFFFFFF, false},
+	}
+
+	for _, test := range tests {
+		e := execOne(t, test.code, !test.real, 0, map[uint8]uint32{EAX: test.eax, ECX: test.ecx, EDX: test.edx})
+		if e.getRegister32(EAX) != test.eaxAfter || e.getRegister32(EDX) != test.edxAfter {
+			t.Fatalf("%s: EAX=0x%x EDX=0x%x expected EAX=0x%x EDX=0x%x", test.name,
+				e.getRegister32(EAX), e.getRegister32(EDX), test.eaxAfter, test.edxAfter)
+		}
+		if e.eflags.isEnable(CarryFlag) != test.cf || e.eflags.isEnable(OverflowFlag) != test.cf {
+			t.Fatalf("%s: eflags=0x%x", test.name, e.eflags.get())
+		}
+	}
+}
+
+func TestDivideError(t *testing.T) {
+	tests := []struct {
+		name string
+		code []byte
+		eax  uint32
+		ecx  uint32
+		edx  uint32
+	}{
+		{"div ecx (zero)", []byte{0xF7, 0xF1}, 1, 0, 0},
+		{"div ecx (overflow)", []byte{0xF7, 0xF1}, 0, 1, 1},
+		{"div cl (overflow)", []byte{0xF6, 0xF1}, 0x100, 1, 0},
+		{"idiv ecx (overflow)", []byte{0xF7, 0xF9}, 0, 0xFFFFFFFF, 0x80000000},
+		{"idiv cl (overflow)", []byte{0xF6, 0xF9}, 0x8000, 0xFF, 0},
+	}
+
+	for _, test := range tests {
+		e := newTestEmulator(test.code, true)
+		e.setRegister32(EAX, test.eax)
+		e.setRegister32(ECX, test.ecx)
+		e.setRegister32(EDX, test.edx)
+		e.setRegister32(ESP, 0x8000)
+		e.sreg[CS] = 0x08
+		e.eflags.set(InterruptFlag)
+
+		// interrupt gate for vector 0: 0x0008:0x00009000
+		e.idtrBase = 0x1000
+		copy(e.memory[0x1000:], []byte{0x00, 0x90, 0x08, 0x00, 0x00, 0x8E, 0x00, 0x00})
+
+		if err := e.execInst(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if e.eip != 0x9000 || e.sreg[CS] != 0x08 || e.eflags.isEnable(InterruptFlag) {
+			t.Fatalf("%s: eip=0x%x cs=0x%x eflags=0x%x", test.name, e.eip, e.sreg[CS], e.eflags.get())
+		}
+		// the handler returns to the faulting instruction
+		if e.getMemory32(0x8000-12) != 0x7c00 || e.getMemory32(0x8000-8) != 0x08 ||
+			e.getMemory32(0x8000-4)&InterruptFlag == 0 {
+			t.Fatalf("%s: stack=0x%x 0x%x 0x%x", test.name,
+				e.getMemory32(0x8000-12), e.getMemory32(0x8000-8), e.getMemory32(0x8000-4))
+		}
+		assetRegister32(t, e, "EAX", EAX, test.eax)
+		assetRegister32(t, e, "EDX", EDX, test.edx)
+	}
+}
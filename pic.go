@@ -5,23 +5,278 @@ package main
 // PIC(8259)は、IOAPIC（またはcpu0のlocal APIC）に接続されている
 // xv6では、レガシーデバイス（PS/2 keyboard, IDE, COM0）のために、PIC->IOAPICの順で割り込み設定をする
 
-// LocalAPIC is ..
-// in CPU
-// - Select Interrupt Vector Number
-// - End of Interrupt
-// - Timer, Thermo sensor, Performance counter
-// - API IDs are unique in CPUs.
-type LocalAPIC struct {
-	IRR uint8 // Interrupt Request Register: CPUが未処理のベクタ番号にビットが立つ
-	ISR uint8 // In-Service Register：次に割り込む候補、EOIへ書き込まれると、IRR->ISRへビットが更新
-	IMR uint8 // Interrupt Mask Register, the bit is 0 only when the IRQ is enabled.
+// PIC is the pair of 8259A programmable interrupt controllers. The slave is
+// cascaded to IRQ2 of the master, and they are at I/O ports 0x20-0x21 and
+// 0xA0-0xA1. Devices raise and lower the IRQ lines 0-15, and the CPU takes the
+// vector of the highest priority request by acknowledge when INTR is high.
+type PIC struct {
+	master i8259
+	slave  i8259
+}
+
+// I/O ports of the PICs
+const (
+	picMasterCommand = 0x20
+	picMasterData    = 0x21
+	picSlaveCommand  = 0xA0
+	picSlaveData     = 0xA1
+)
+
+// IRQ of the master which the slave is connected to
+const picCascadeIRQ = 2
+
+// NewPIC returns the PICs initialized as BIOS does: vectors 0x08-0x0F for the
+// master, 0x70-0x77 for the slave, and all IRQs are masked.
+func NewPIC() PIC {
+	return PIC{
+		master: i8259{vectorBase: 0x08, cascade: 1 << picCascadeIRQ, imr: 0xFF},
+		slave:  i8259{vectorBase: 0x70, cascade: picCascadeIRQ, imr: 0xFF},
+	}
 }
 
-// IOAPIC is ...
-// at ICH (South Bridge)
-type IOAPIC struct {
+// RaiseIRQ sets the IRQ line high
+func (p *PIC) RaiseIRQ(irq uint8) {
+	p.setIRQ(irq, true)
 }
 
-// PIC is ...
-type PIC struct {
+// LowerIRQ sets the IRQ line low
+func (p *PIC) LowerIRQ(irq uint8) {
+	p.setIRQ(irq, false)
+}
+
+func (p *PIC) setIRQ(irq uint8, level bool) {
+	if irq < 8 {
+		p.master.setLine(irq, level)
+		return
+	}
+	p.slave.setLine(irq-8, level)
+	p.updateCascade()
+}
+
+// INT output of the slave is IRQ2 of the master
+func (p *PIC) updateCascade() {
+	if !p.master.single {
+		p.master.setLine(picCascadeIRQ, p.slave.hasInterrupt())
+	}
+}
+
+// whether INTR of the CPU is high
+func (p *PIC) hasInterrupt() bool {
+	return p.master.hasInterrupt()
+}
+
+// interrupt acknowledge cycle, return the vector of the interrupt. The vector
+// of IRQ7 (or IRQ15 by the slave) is returned if there is no request.
+func (p *PIC) acknowledge() uint8 {
+	irq := p.master.acknowledge()
+	if irq != picCascadeIRQ || p.master.single || p.master.cascade&(1<<picCascadeIRQ) == 0 {
+		return p.master.vectorBase | irq
+	}
+	irq = p.slave.acknowledge()
+	p.updateCascade()
+	return p.slave.vectorBase | irq
+}
+
+// In reads the register of the PICs, they are 8bit
+func (p *PIC) In(port uint16, size uint8) uint32 {
+	return uint32(p.in8(port))
+}
+
+// Out writes the register of the PICs
+func (p *PIC) Out(port uint16, size uint8, value uint32) {
+	p.out8(port, uint8(value))
+}
+
+func (p *PIC) in8(port uint16) uint8 {
+	switch port {
+	case picMasterCommand:
+		return p.master.readCommand()
+	case picMasterData:
+		return p.master.imr
+	case picSlaveCommand:
+		return p.slave.readCommand()
+	default:
+		return p.slave.imr
+	}
+}
+
+func (p *PIC) out8(port uint16, value uint8) {
+	switch port {
+	case picMasterCommand:
+		p.master.writeCommand(value)
+	case picMasterData:
+		p.master.writeData(value)
+	case picSlaveCommand:
+		p.slave.writeCommand(value)
+		p.updateCascade()
+	default:
+		p.slave.writeData(value)
+		p.updateCascade()
+	}
+}
+
+// i8259 is a 8259A PIC
+type i8259 struct {
+	irr        uint8 // interrupt request register
+	isr        uint8 // in-service register
+	imr        uint8 // interrupt mask register
+	lines      uint8 // levels of the IRQ lines
+	vectorBase uint8 // vector of IRQ0 (ICW2)
+	cascade    uint8 // IRQs with the slave (master), or the ID (slave) (ICW3)
+	priority   uint8 // IRQ of the highest priority
+	initStep   uint8 // next ICW to be written, 0 if initialized
+	needICW4   bool
+	single     bool // no slave
+	level      bool // level triggered mode
+	autoEOI    bool
+	readISR    bool // ISR is read from the command port instead of IRR
+}
+
+// steps of the initialization sequence
+const (
+	picReady = iota
+	picICW2
+	picICW3
+	picICW4
+)
+
+func (c *i8259) setLine(irq uint8, level bool) {
+	bit := uint8(1) << irq
+	if level {
+		if c.lines&bit == 0 || c.level {
+			// rising edge in the edge triggered mode
+			c.irr |= bit
+		}
+		c.lines |= bit
+	} else {
+		// the request must be held until it is acknowledged
+		c.lines &^= bit
+		c.irr &^= bit
+	}
+}
+
+// IRQ of the highest priority in bits
+func (c *i8259) highest(bits uint8) (uint8, bool) {
+	for i := uint8(0); i < 8; i++ {
+		irq := (c.priority + i) & 7
+		if bits&(1<<irq) != 0 {
+			return irq, true
+		}
+	}
+	return 0, false
+}
+
+// the unmasked request which has the higher priority than in-service IRQs
+func (c *i8259) pending() (uint8, bool) {
+	irq, ok := c.highest(c.irr &^ c.imr)
+	if !ok {
+		return 0, false
+	}
+	if inService, ok := c.highest(c.isr); ok && (inService-c.priority)&7 <= (irq-c.priority)&7 {
+		// fully nested mode
+		return 0, false
+	}
+	return irq, true
+}
+
+func (c *i8259) hasInterrupt() bool {
+	_, ok := c.pending()
+	return ok
+}
+
+// return the IRQ to be serviced, or 7 as a spurious interrupt
+func (c *i8259) acknowledge() uint8 {
+	irq, ok := c.pending()
+	if !ok {
+		return 7
+	}
+	bit := uint8(1) << irq
+	if !c.level {
+		c.irr &^= bit
+	}
+	if !c.autoEOI {
+		c.isr |= bit
+	}
+	return irq
+}
+
+func (c *i8259) readCommand() uint8 {
+	if c.readISR {
+		return c.isr
+	}
+	return c.irr
+}
+
+func (c *i8259) writeCommand(value uint8) {
+	switch {
+	case value&0x10 != 0:
+		// ICW1
+		*c = i8259{
+			lines:      c.lines,
+			vectorBase: c.vectorBase,
+			cascade:    c.cascade,
+			initStep:   picICW2,
+			needICW4:   value&0x01 != 0,
+			single:     value&0x02 != 0,
+			level:      value&0x08 != 0,
+		}
+	case value&0x08 != 0:
+		// OCW3
+		if value&0x02 != 0 {
+			c.readISR = value&0x01 != 0
+		}
+	default:
+		// OCW2
+		c.endOfInterrupt(value)
+	}
+}
+
+// OCW2: EOI and priority rotation
+func (c *i8259) endOfInterrupt(value uint8) {
+	rotate := value&0x80 != 0
+	specific := value&0x40 != 0
+	eoi := value&0x20 != 0
+	irq := value & 7
+
+	if !eoi {
+		if rotate && specific {
+			// set priority, irq becomes the lowest
+			c.priority = (irq + 1) & 7
+		}
+		return
+	}
+	if !specific {
+		var ok bool
+		if irq, ok = c.highest(c.isr); !ok {
+			return
+		}
+	}
+	c.isr &^= 1 << irq
+	if rotate {
+		c.priority = (irq + 1) & 7
+	}
+}
+
+func (c *i8259) writeData(value uint8) {
+	switch c.initStep {
+	case picICW2:
+		c.vectorBase = value & 0xF8
+		c.initStep = picICW3
+		if c.single {
+			c.initStep = picICW4
+		}
+	case picICW3:
+		c.cascade = value
+		c.initStep = picICW4
+	case picICW4:
+		c.autoEOI = value&0x02 != 0
+		c.initStep = picReady
+	default:
+		// OCW1
+		c.imr = value
+		return
+	}
+	if c.initStep == picICW4 && !c.needICW4 {
+		c.initStep = picReady
+	}
 }
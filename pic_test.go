@@ -1 +1,157 @@
 package main
+
+import (
+	"testing"
+)
+
+// initialize the PICs as xv6 does: vectors 0x20-0x2F, auto EOI off
+func initPIC(p *PIC, autoEOI bool) {
+	icw4 := uint8(0x01)
+	if autoEOI {
+		icw4 |= 0x02
+	}
+	for _, w := range []struct {
+		port  uint16
+		value uint8
+	}{
+		{picMasterCommand, 0x11}, {picMasterData, 0x20}, {picMasterData, 1 << picCascadeIRQ}, {picMasterData, icw4},
+		{picSlaveCommand, 0x11}, {picSlaveData, 0x28}, {picSlaveData, picCascadeIRQ}, {picSlaveData, icw4},
+		{picMasterData, 0x00}, {picSlaveData, 0x00},
+	} {
+		p.out8(w.port, w.value)
+	}
+}
+
+func TestPIC(t *testing.T) {
+	p := NewPIC()
+	p.RaiseIRQ(1)
+	if p.hasInterrupt() {
+		t.Fatal("IRQ1 must be masked after reset")
+	}
+
+	// the request is held while masked, and the initialization clears it
+	initPIC(&p, false)
+	if p.hasInterrupt() {
+		t.Fatal("ICW1 must clear IRR")
+	}
+	p.LowerIRQ(1)
+
+	// priority: IRQ0 > IRQ1 > IRQ8-15 (via IRQ2) > IRQ3
+	p.RaiseIRQ(3)
+	p.RaiseIRQ(9)
+	p.RaiseIRQ(1)
+	for _, vector := range []uint8{0x21, 0x29, 0x23} {
+		if !p.hasInterrupt() {
+			t.Fatalf("no interrupt for 0x%x", vector)
+		}
+		if v := p.acknowledge(); v != vector {
+			t.Fatalf("vector=0x%x, expected 0x%x", v, vector)
+		}
+		// nested: lower priority requests wait for EOI
+		if p.hasInterrupt() {
+			t.Fatalf("interrupt while 0x%x is in service", vector)
+		}
+		if vector >= 0x28 {
+			p.out8(picSlaveCommand, 0x20)
+		}
+		p.out8(picMasterCommand, 0x20)
+	}
+	if p.hasInterrupt() {
+		t.Fatal("edge triggered IRQ must be delivered once")
+	}
+
+	// higher priority IRQ preempts the in-service one
+	p.LowerIRQ(3)
+	p.RaiseIRQ(3)
+	if v := p.acknowledge(); v != 0x23 {
+		t.Fatalf("vector=0x%x", v)
+	}
+	p.LowerIRQ(1)
+	p.RaiseIRQ(1)
+	if v := p.acknowledge(); v != 0x21 {
+		t.Fatalf("vector=0x%x", v)
+	}
+	p.out8(picMasterCommand, 0x20) // EOI for IRQ1
+	p.out8(picMasterCommand, 0x0B) // read ISR
+	if isr := p.in8(picMasterCommand); isr != 0x08 {
+		t.Fatalf("isr=0x%x", isr)
+	}
+	p.out8(picMasterCommand, 0x63) // specific EOI for IRQ3
+	if isr := p.in8(picMasterCommand); isr != 0 {
+		t.Fatalf("isr=0x%x", isr)
+	}
+
+	// masking by OCW1
+	p.out8(picMasterData, 0x10)
+	if p.in8(picMasterData) != 0x10 {
+		t.Fatalf("imr=0x%x", p.in8(picMasterData))
+	}
+	p.RaiseIRQ(4)
+	if p.hasInterrupt() {
+		t.Fatal("IRQ4 is masked")
+	}
+	p.out8(picMasterData, 0x00)
+	if v := p.acknowledge(); v != 0x24 {
+		t.Fatalf("vector=0x%x", v)
+	}
+	p.out8(picMasterCommand, 0x20)
+
+	// spurious interrupts
+	if v := p.acknowledge(); v != 0x27 {
+		t.Fatalf("spurious vector=0x%x", v)
+	}
+	p.out8(picMasterCommand, 0x0B)
+	if isr := p.in8(picMasterCommand); isr != 0 {
+		t.Fatalf("spurious IRQ7 must not be in service: isr=0x%x", isr)
+	}
+	p.RaiseIRQ(12)
+	p.LowerIRQ(12)
+	p.master.setLine(picCascadeIRQ, true)
+	if v := p.acknowledge(); v != 0x2F {
+		t.Fatalf("spurious vector=0x%x", v)
+	}
+}
+
+func TestPICRotation(t *testing.T) {
+	p := NewPIC()
+	initPIC(&p, true)
+
+	// auto EOI, and IRQ5 becomes the lowest priority by rotation
+	p.out8(picMasterCommand, 0xC5)
+	p.RaiseIRQ(5)
+	p.RaiseIRQ(6)
+	for _, vector := range []uint8{0x26, 0x25} {
+		if v := p.acknowledge(); v != vector {
+			t.Fatalf("vector=0x%x, expected 0x%x", v, vector)
+		}
+	}
+	p.out8(picMasterCommand, 0x0B)
+	if isr := p.in8(picMasterCommand); isr != 0 {
+		t.Fatalf("isr=0x%x", isr)
+	}
+}
+
+func TestExternalInterrupt(t *testing.T) {
+	// nop; nop
+	e := newTestEmulator([]byte{0x90, 0x90}, true)
+	e.sreg[CS] = 0x08
+	e.setRegister32(ESP, 0x8000)
+	setInterruptGate(e, 0x20, 0x9000)
+	initPIC(&e.io.pic, false)
+	e.io.pic.RaiseIRQ(0)
+
+	// not taken while IF=0
+	if err := e.execInst(); err != nil || e.eip != 0x7c01 {
+		t.Fatalf("eip=0x%x err=%v", e.eip, err)
+	}
+	e.eflags.set(InterruptFlag)
+	if err := e.execInst(); err != nil {
+		t.Fatal(err)
+	}
+	if e.eip != 0x9000 || e.eflags.isEnable(InterruptFlag) || e.getMemory32(0x8000-12) != 0x7c01 {
+		t.Fatalf("eip=0x%x eflags=0x%x", e.eip, e.eflags.get())
+	}
+	if e.io.pic.hasInterrupt() || e.io.in8(picMasterCommand) != 0 {
+		t.Fatal("IRQ0 must be acknowledged")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+// I/O privilege level
+func (e *Emulator) iopl() uint8 {
+	return uint8(e.eflags.get() & IOPLMask >> 12)
+}
+
+// cli and sti are allowed if CPL <= IOPL in protected mode
+func (e *Emulator) checkInterruptFlagPrivilege() {
+	if e.cr[0]&1 != 0 && e.cpl() > e.iopl() {
+		raiseWithErrorCode(vectorGP, 0)
+	}
+}
+
+// the port of size bits is accessible if CPL <= IOPL, or all the bits for it
+// in the I/O permission bitmap of TSS are clear. #GP(0) is raised otherwise.
+func (e *Emulator) checkIOPermission(port uint16, size uint8) {
+	if e.cr[0]&1 == 0 || e.cpl() <= e.iopl() {
+		return
+	}
+	// the bitmap is accessed in supervisor mode
+	iomb := uint32(e.readSystem8(e.tr.TSSBase+102)) | uint32(e.readSystem8(e.tr.TSSBase+103))<<8
+	first := iomb + uint32(port)/8
+	last := iomb + (uint32(port)+uint32(size)/8-1)/8
+	if e.tr.TSSLimit < 103 || last > e.tr.TSSLimit {
+		raiseWithErrorCode(vectorGP, 0)
+	}
+	var bitmap uint32
+	for i := first; i <= last; i++ {
+		bitmap |= uint32(e.readSystem8(e.tr.TSSBase+i)) << ((i - first) * 8)
+	}
+	mask := uint32(1)<<(size/8) - 1
+	if bitmap>>(port%8)&mask != 0 {
+		raiseWithErrorCode(vectorGP, 0)
+	}
+}
+
+// read the byte of the system structure at the linear address in supervisor
+// mode regardless of CPL
+func (e *Emulator) readSystem8(address uint32) uint8 {
+	return uint8(e.bus.read(e.translateFor(address, false, false), 8))
+}
+
+// the flags which can be loaded by iret in the current privilege level. IOPL
+// is changed only in ring 0, and IF only if CPL <= IOPL.
+func (e *Emulator) restrictFlags(flags uint32) uint32 {
+	if e.cr[0]&1 == 0 {
+		return flags
+	}
+	current := e.eflags.get()
+	keep := uint32(0)
+	if e.cpl() > 0 {
+		keep |= IOPLMask
+	}
+	if e.cpl() > e.iopl() {
+		keep |= InterruptFlag
+	}
+	return flags&^keep | current&keep
+}
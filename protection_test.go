@@ -0,0 +1,184 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPrivilegedInstruction(t *testing.T) {
+	tests := []struct {
+		name      string
+		code      []byte
+		iopl      uint32
+		errorCode int64 // #GP error code, -1 if no fault
+	}{
+		{"cli", []byte{0xFA}, 0, 0},
+		{"sti", []byte{0xFB}, 0, 0},
+		{"cli (IOPL 3)", []byte{0xFA}, 3, -1},
+		{"hlt", []byte{0xF4}, 3, 0},
+		{"lgdt [0]", []byte{0x0F, 0x01, 0x15, 0x00, 0x00, 0x00, 0x00}, 3, 0},
+		{"lidt [0]", []byte{0x0F, 0x01, 0x1D, 0x00, 0x00, 0x00, 0x00}, 3, 0},
+		{"invlpg [0]", []byte{0x0F, 0x01, 0x3D, 0x00, 0x00, 0x00, 0x00}, 3, 0},
+		{"mov cr3, eax", []byte{0x0F, 0x22, 0xD8}, 3, 0},
+		{"mov eax, cr0", []byte{0x0F, 0x20, 0xC0}, 3, 0},
+		{"ltr ax", []byte{0x0F, 0x00, 0xD8}, 3, 0},
+		{"int 0x20 (DPL 0 gate)", []byte{0xCD, 0x20}, 3, 0x20<<3 | 2},
+		{"int 0x40 (DPL 3 gate)", []byte{0xCD, 0x40}, 3, -1},
+	}
+
+	for _, test := range tests {
+		e := newTestEmulator(test.code, true)
+		e.sreg[CS] = 0x1B
+		e.sreg[SS] = 0x23
+		e.setRegister32(ESP, 0x8000)
+		e.eflags.load(test.iopl << 12)
+		setInterruptGate(e, 0x20, 0x9000)
+		setInterruptGate(e, 0x40, 0x9000)
+		e.memory[0x1000+8*0x40+5] = 0xEE
+		e.tr.TSSBase = 0x3000
+		e.setMemory32(0x3004, 0x6000)
+		e.setMemory16(0x3008, 0x10)
+
+		f := catchFault(func() { e.exec(&e.inst) })
+		if test.errorCode < 0 {
+			if f != nil {
+				t.Fatalf("%s: %v", test.name, f)
+			}
+		} else if f == nil || f.Vector != vectorGP || f.ErrorCode != uint32(test.errorCode) {
+			t.Fatalf("%s: fault=%v", test.name, f)
+		}
+	}
+}
+
+func TestIOPermission(t *testing.T) {
+	tests := []struct {
+		name  string
+		code  []byte
+		iopl  uint32
+		fault bool
+	}{
+		{"out 0x80, al", []byte{0xE6, 0x80}, 0, false},
+		{"out 0x81, al", []byte{0xE6, 0x81}, 0, true},
+		{"in al, 0x81 (IOPL 3)", []byte{0xE4, 0x81}, 3, false},
+		{"in al, dx", []byte{0xEC}, 0, false},
+		{"out dx, ax", []byte{0x66, 0xEF}, 0, true},
+		{"insd", []byte{0x6D}, 0, true},
+		{"out 0x88, al (TSS limit)", []byte{0xE6, 0x88}, 0, true},
+	}
+
+	for _, test := range tests {
+		e := newTestEmulator(test.code, true)
+		e.sreg[CS] = 0x1B
+		e.eflags.load(test.iopl << 12)
+		e.setRegister16(DX, 0x80)
+		e.setRegister32(EDI, 0x5000)
+
+		// TSS at 0x3000, the bitmap at 0x3068 denies port 0x81 only
+		e.tr.TSSBase = 0x3000
+		e.tr.TSSLimit = 0x68 + 0x80/8
+		e.setMemory16(0x3000+102, 0x68)
+		e.memory[0x3068+0x80/8] = 0x02
+
+		f := catchFault(func() { e.exec(&e.inst) })
+		if test.fault != (f != nil) {
+			t.Fatalf("%s: fault=%v", test.name, f)
+		}
+		if f != nil && (f.Vector != vectorGP || f.ErrorCode != 0) {
+			t.Fatalf("%s: fault=%v", test.name, f)
+		}
+	}
+}
+
+func TestIretFlags(t *testing.T) {
+	// iret in ring 3 can not change IOPL and IF
+	e := newTestEmulator([]byte{0xCF}, true)
+	e.sreg[CS] = 0x1B
+	e.sreg[SS] = 0x23
+	e.setRegister32(ESP, 0x8000)
+	e.setMemory32(0x8000, 0x7c10)
+	e.setMemory32(0x8004, 0x1B)
+	e.setMemory32(0x8008, IOPLMask|InterruptFlag|CarryFlag)
+
+	if err := e.execInst(); err != nil {
+		t.Fatal(err)
+	}
+	if e.eip != 0x7c10 || e.eflags.get() != CarryFlag {
+		t.Fatalf("eip=0x%x eflags=0x%x", e.eip, e.eflags.get())
+	}
+}
+
+func TestIretToInnerLevel(t *testing.T) {
+	// iret in ring 3 can not return to ring 0
+	e := newTestEmulator([]byte{0xCF}, true)
+	e.sreg[CS] = 0x1B
+	e.sreg[SS] = 0x23
+	e.setRegister32(ESP, 0x8000)
+	e.setMemory32(0x8000, 0x7c10)
+	e.setMemory32(0x8004, 0x08)
+	e.setMemory32(0x8008, 0)
+
+	err := e.execInst()
+	if f, ok := err.(*Fault); !ok || f.Vector != vectorGP || f.ErrorCode != 0x08 {
+		t.Fatalf("err=%v", err)
+	}
+	if e.eip != 0x7c00 || e.sreg[CS] != 0x1B || e.getRegister32(ESP) != 0x8000 {
+		t.Fatalf("eip=0x%x cs=0x%x esp=0x%x", e.eip, e.sreg[CS], e.getRegister32(ESP))
+	}
+}
+
+func TestIret16(t *testing.T) {
+	// o16 iret in ring 3 can not change IOPL and IF either
+	e := newTestEmulator([]byte{0x66, 0xCF}, true)
+	e.sreg[CS] = 0x1B
+	e.sreg[SS] = 0x23
+	e.setRegister32(ESP, 0x8000)
+	e.setMemory16(0x8000, 0x7c10)
+	e.setMemory16(0x8002, 0x1B)
+	e.setMemory16(0x8004, uint16(IOPLMask|InterruptFlag|CarryFlag))
+
+	if err := e.execInst(); err != nil {
+		t.Fatal(err)
+	}
+	if e.eip != 0x7c10 || e.eflags.get() != CarryFlag || e.getRegister32(ESP) != 0x8006 {
+		t.Fatalf("eip=0x%x eflags=0x%x esp=0x%x", e.eip, e.eflags.get(), e.getRegister32(ESP))
+	}
+
+	// nor return to ring 0
+	e = newTestEmulator([]byte{0x66, 0xCF}, true)
+	e.sreg[CS] = 0x1B
+	e.sreg[SS] = 0x23
+	e.setRegister32(ESP, 0x8000)
+	e.setMemory16(0x8000, 0x7c10)
+	e.setMemory16(0x8002, 0x08)
+
+	err := e.execInst()
+	if f, ok := err.(*Fault); !ok || f.Vector != vectorGP || f.ErrorCode != 0x08 {
+		t.Fatalf("err=%v", err)
+	}
+	if e.eip != 0x7c00 || e.sreg[CS] != 0x1B || e.getRegister32(ESP) != 0x8000 {
+		t.Fatalf("eip=0x%x cs=0x%x esp=0x%x", e.eip, e.sreg[CS], e.getRegister32(ESP))
+	}
+}
+
+func TestPopf(t *testing.T) {
+	// popf in ring 3 can not change IOPL and IF, o16 popf keeps the upper
+	// half
+	e := newTestEmulator([]byte{0x9D, 0x66, 0x9D}, true)
+	e.sreg[CS] = 0x1B
+	e.sreg[SS] = 0x23
+	e.setRegister32(ESP, 0x8000)
+	e.setMemory32(0x8000, IOPLMask|InterruptFlag|CarryFlag|0x40000)
+	e.setMemory16(0x8004, uint16(IOPLMask|InterruptFlag|ZeroFlag))
+
+	if err := e.execInst(); err != nil {
+		t.Fatal(err)
+	}
+	if e.eflags.get() != CarryFlag|0x40000 {
+		t.Fatalf("eflags=0x%x", e.eflags.get())
+	}
+	if err := e.execInst(); err != nil {
+		t.Fatal(err)
+	}
+	if e.eflags.get() != ZeroFlag|0x40000 || e.getRegister32(ESP) != 0x8006 {
+		t.Fatalf("eflags=0x%x esp=0x%x", e.eflags.get(), e.getRegister32(ESP))
+	}
+}
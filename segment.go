@@ -0,0 +1,275 @@
+package main
+
+// access byte of the segment descriptor
+const (
+	segAccessed   = 0x01
+	segWritable   = 0x02 // data segment
+	segReadable   = 0x02 // code segment
+	segExpandDown = 0x04 // data segment
+	segConforming = 0x04 // code segment
+	segCode       = 0x08
+	segNotSystem  = 0x10 // code or data segment
+	segPresent    = 0x80
+)
+
+// system descriptor types
+const (
+	segTypeLDT = 0x2
+)
+
+// segmentCache is the hidden part of the segment register, which is loaded
+// from the descriptor when the selector is loaded
+type segmentCache struct {
+	base     uint32
+	limit    uint32 // in bytes, the granularity is applied
+	access   uint8  // access byte of the descriptor
+	big      bool   // D/B flag, 32bit code or stack segment
+	unusable bool   // loaded with the null selector
+}
+
+// the segment which is used in real mode, and in protected mode before
+// the selector is loaded
+func flatSegment(access uint8, protectedMode bool) segmentCache {
+	if protectedMode {
+		return segmentCache{limit: 0xFFFFFFFF, access: access, big: true}
+	}
+	return segmentCache{limit: 0xFFFF, access: access}
+}
+
+func parseDescriptor(desc uint64) segmentCache {
+	s := segmentCache{
+		base:   uint32(desc>>16)&0xFFFFFF | uint32(desc>>56)<<24,
+		limit:  uint32(desc&0xFFFF) | uint32(desc>>48&0xF)<<16,
+		access: uint8(desc >> 40),
+		big:    desc&(1<<54) != 0,
+	}
+	if desc&(1<<55) != 0 {
+		// 4KB granularity
+		s.limit = s.limit<<12 | 0xFFF
+	}
+	return s
+}
+
+func (s *segmentCache) dpl() uint8 {
+	return s.access >> 5 & 3
+}
+
+func (s *segmentCache) present() bool {
+	return s.access&segPresent != 0
+}
+
+func (s *segmentCache) isCode() bool {
+	return s.access&(segNotSystem|segCode) == segNotSystem|segCode
+}
+
+func (s *segmentCache) isData() bool {
+	return s.access&(segNotSystem|segCode) == segNotSystem
+}
+
+func (s *segmentCache) readable() bool {
+	return s.isData() || (s.isCode() && s.access&segReadable != 0)
+}
+
+func (s *segmentCache) writable() bool {
+	return s.isData() && s.access&segWritable != 0
+}
+
+func (s *segmentCache) conforming() bool {
+	return s.isCode() && s.access&segConforming != 0
+}
+
+// whether size bytes from offset are in the segment
+func (s *segmentCache) contains(offset, size uint32) bool {
+	last := uint64(offset) + uint64(size) - 1
+	if s.isData() && s.access&segExpandDown != 0 {
+		upper := uint64(0xFFFF)
+		if s.big {
+			upper = 0xFFFFFFFF
+		}
+		return offset > s.limit && last <= upper
+	}
+	return last <= uint64(s.limit)
+}
+
+// error code of the faults which refer to the selector
+func selectorErrorCode(selector uint16, ext uint32) uint32 {
+	return uint32(selector&0xFFFC) | ext
+}
+
+// read the segment descriptor of the selector from GDT or LDT
+func (e *Emulator) descriptor(selector uint16, ext uint32) segmentCache {
+	base, limit := e.gdtrBase, uint32(e.gdtrSize)
+	if selector&4 != 0 {
+		base, limit = e.ldtr.base, e.ldtr.limit
+	}
+	if uint32(selector|7) > limit {
+		raiseWithErrorCode(vectorGP, selectorErrorCode(selector, ext))
+	}
+	address := base + uint32(selector&^7)
+	return parseDescriptor(uint64(e.readPhysical32(address+4))<<32 | uint64(e.readPhysical32(address)))
+}
+
+// load the segment register. In protected mode, the descriptor is loaded
+// into the cache with the privilege checks.
+func (e *Emulator) setSreg16(index uint8, value uint16) {
+	if e.cr[0]&1 == 0 {
+		// real mode
+		e.sreg[index] = uint32(value)
+		e.segments[index].base = uint32(value) << 4
+		return
+	}
+
+	cpl := e.cpl()
+	rpl := uint8(value & 3)
+	errorCode := selectorErrorCode(value, 0)
+
+	switch index {
+	case CS:
+		e.loadCodeSegment(value, cpl, 0)
+		return
+	case SS:
+		if value&^3 == 0 {
+			raiseWithErrorCode(vectorGP, 0)
+		}
+		s := e.descriptor(value, 0)
+		if !s.writable() || rpl != cpl || s.dpl() != cpl {
+			raiseWithErrorCode(vectorGP, errorCode)
+		}
+		if !s.present() {
+			raiseWithErrorCode(vectorSS, errorCode)
+		}
+		e.segments[SS] = s
+	default:
+		if value&^3 == 0 {
+			// the null selector can be loaded, but the segment is unusable
+			e.segments[index] = segmentCache{unusable: true}
+			break
+		}
+		s := e.descriptor(value, 0)
+		if !s.readable() {
+			raiseWithErrorCode(vectorGP, errorCode)
+		}
+		if !s.conforming() && (rpl > s.dpl() || cpl > s.dpl()) {
+			raiseWithErrorCode(vectorGP, errorCode)
+		}
+		if !s.present() {
+			raiseWithErrorCode(vectorNP, errorCode)
+		}
+		e.segments[index] = s
+	}
+	e.sreg[index] = uint32(value)
+}
+
+// load CS by far jmp, interrupt or iret, and CPL becomes newCPL. The code
+// segment must be accessible from the current CPL for the transfer, which is
+// checked by canTransfer.
+func (e *Emulator) loadCodeSegment(selector uint16, newCPL uint8, ext uint32) {
+	if e.cr[0]&1 == 0 {
+		e.setSreg16(CS, selector)
+		return
+	}
+	if selector&^3 == 0 {
+		raiseWithErrorCode(vectorGP, ext)
+	}
+	s := e.descriptor(selector, ext)
+	if !s.isCode() || !e.canTransfer(&s, selector, newCPL) {
+		raiseWithErrorCode(vectorGP, selectorErrorCode(selector, ext))
+	}
+	if !s.present() {
+		raiseWithErrorCode(vectorNP, selectorErrorCode(selector, ext))
+	}
+	e.segments[CS] = s
+	e.sreg[CS] = uint32(selector&^3 | uint16(newCPL))
+}
+
+// privilege check of the control transfer to the code segment
+func (e *Emulator) canTransfer(s *segmentCache, selector uint16, newCPL uint8) bool {
+	cpl := e.cpl()
+	rpl := uint8(selector & 3)
+	switch {
+	case newCPL == cpl:
+		// far jmp, or interrupt and iret in the same level
+		if s.conforming() {
+			return s.dpl() <= cpl
+		}
+		return s.dpl() == cpl && rpl <= cpl
+	case newCPL < cpl:
+		// interrupt to the inner level
+		return s.dpl() == newCPL
+	default:
+		// iret to the outer level
+		return rpl == newCPL && (s.conforming() || s.dpl() == newCPL)
+	}
+}
+
+// make the data segment registers unusable if they are not accessible from
+// the outer level after iret
+func (e *Emulator) invalidateSegments() {
+	cpl := e.cpl()
+	for _, index := range []uint8{ES, DS, FS, GS} {
+		s := &e.segments[index]
+		if !s.unusable && !s.conforming() && s.dpl() < cpl {
+			e.sreg[index] = 0
+			e.segments[index] = segmentCache{unusable: true}
+		}
+	}
+}
+
+// base address of the segment
+func (e *Emulator) segmentBase(index uint8) uint32 {
+	return e.segments[index].base
+}
+
+// linear address of index:offset to access size bytes. #GP(0), or #SS(0)
+// for the stack segment, is raised if the segment does not allow it.
+func (e *Emulator) linearAddress(index uint8, offset, size uint32, write bool) uint32 {
+	s := &e.segments[index]
+	vector := uint8(vectorGP)
+	if index == SS {
+		vector = vectorSS
+	}
+	if e.cr[0]&1 != 0 && (s.unusable || (write && !s.writable()) || (!write && !s.readable())) {
+		raiseWithErrorCode(vector, 0)
+	}
+	if !s.contains(offset, size) {
+		raiseWithErrorCode(vector, 0)
+	}
+	return s.base + offset
+}
+
+// linear address of the instruction at CS:offset
+func (e *Emulator) codeAddress(offset uint32) uint32 {
+	if !e.segments[CS].contains(offset, 1) {
+		raiseWithErrorCode(vectorGP, 0)
+	}
+	return e.segments[CS].base + offset
+}
+
+// LDTRegister is the selector and the cached descriptor of LDT
+type LDTRegister struct {
+	selector uint16
+	base     uint32 // physical address
+	limit    uint32
+}
+
+// lldt r/m16 (0x0F 0x00 /2)
+func (e *Emulator) lldt(inst *Instruction) {
+	selector := e.getRm16(inst.modrm)
+	if selector&^3 == 0 {
+		// LDT is unusable
+		e.ldtr = LDTRegister{}
+		return
+	}
+	errorCode := selectorErrorCode(selector, 0)
+	if selector&4 != 0 {
+		raiseWithErrorCode(vectorGP, errorCode)
+	}
+	s := e.descriptor(selector, 0)
+	if s.access&(segNotSystem|0xF) != segTypeLDT {
+		raiseWithErrorCode(vectorGP, errorCode)
+	}
+	if !s.present() {
+		raiseWithErrorCode(vectorNP, errorCode)
+	}
+	e.ldtr = LDTRegister{selector, e.v2p(s.base), s.limit}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+)
+
+// segment descriptor, flags are G, D/B, L and AVL
+func makeDescriptor(base, limit uint32, access, flags uint8) uint64 {
+	return uint64(limit&0xFFFF) | uint64(base&0xFFFFFF)<<16 | uint64(access)<<40 |
+		uint64(limit>>16&0xF)<<48 | uint64(flags)<<52 | uint64(base>>24)<<56
+}
+
+func TestSegment(t *testing.T) {
+	tests := []struct {
+		name      string
+		code      []byte
+		steps     int
+		vector    int64 // vector of the fault, -1 if none
+		errorCode uint32
+		eax       uint32
+	}{
+		{"mov ds, 0x28; mov eax, [0x20]",
+			[]byte{0x66, 0xB8, 0x28, 0x00, 0x8E, 0xD8, 0xA1, 0x20, 0x00, 0x00, 0x00}, 3, -1, 0, 0x11223344},
+		{"mov ds, 0x28; mov eax, [0xffe] (limit)",
+			[]byte{0x66, 0xB8, 0x28, 0x00, 0x8E, 0xD8, 0xA1, 0xFE, 0x0F, 0x00, 0x00}, 3, vectorGP, 0, 0},
+		{"mov ds, 0x30; mov [0], eax (read-only)",
+			[]byte{0x66, 0xB8, 0x30, 0x00, 0x8E, 0xD8, 0xA3, 0x00, 0x00, 0x00, 0x00}, 3, vectorGP, 0, 0},
+		{"mov ds, 0x38 (not present)",
+			[]byte{0x66, 0xB8, 0x38, 0x00, 0x8E, 0xD8}, 2, vectorNP, 0x38, 0},
+		{"mov ds, 0x50 (GDT limit)",
+			[]byte{0x66, 0xB8, 0x50, 0x00, 0x8E, 0xD8}, 2, vectorGP, 0x50, 0},
+		{"mov ss, 0x23 (DPL 3)",
+			[]byte{0x66, 0xB8, 0x23, 0x00, 0x8E, 0xD0}, 2, vectorGP, 0x20, 0},
+		{"mov ss, 0x08 (code)",
+			[]byte{0x66, 0xB8, 0x08, 0x00, 0x8E, 0xD0}, 2, vectorGP, 0x08, 0},
+		{"mov ds, 0x13 (RPL 3)",
+			[]byte{0x66, 0xB8, 0x13, 0x00, 0x8E, 0xD8}, 2, vectorGP, 0x10, 0},
+		{"mov ds, 0; mov eax, [0] (null)",
+			[]byte{0x66, 0xB8, 0x00, 0x00, 0x8E, 0xD8, 0xA1, 0x00, 0x00, 0x00, 0x00}, 3, vectorGP, 0, 0},
+		{"mov cs, ax",
+			[]byte{0x8E, 0xC8}, 1, vectorUD, 0, 0},
+		{"lldt 0x40; mov ds, 0x0c; mov eax, [0x10]",
+			[]byte{0x66, 0xB8, 0x40, 0x00, 0x0F, 0x00, 0xD0, 0x66, 0xB8, 0x0C, 0x00, 0x8E, 0xD8, 0xA1, 0x10, 0x00, 0x00, 0x00}, 5, -1, 0, 0x55667788},
+		{"mov ss, 0x48; push eax (expand-down)",
+			[]byte{0x66, 0xB8, 0x48, 0x00, 0x8E, 0xD0, 0x50}, 3, vectorSS, 0, 0},
+		{"jmp 0x58:0; mov ax, 0x1234 (16bit code segment)",
+			[]byte{0xEA, 0x00, 0x00, 0x00, 0x00, 0x58, 0x00}, 2, -1, 0, 0x1234},
+	}
+
+	for _, test := range tests {
+		e := newTestEmulator(test.code, true)
+		e.setRegister32(ESP, 0x800)
+		e.gdtrSize = 0x5F
+		setDescriptor(e, 0x828, makeDescriptor(0x10000, 0xFFF, 0x92, 0x4))    // data, byte granularity
+		setDescriptor(e, 0x830, makeDescriptor(0, 0xFFFFF, 0x90, 0xC))        // read-only data
+		setDescriptor(e, 0x838, makeDescriptor(0, 0xFFFFF, 0x12, 0xC))        // not present
+		setDescriptor(e, 0x840, makeDescriptor(0x3000, 0xF, 0x82, 0))         // LDT
+		setDescriptor(e, 0x848, makeDescriptor(0, 0xFFF, 0x96, 0x4))          // expand-down stack
+		setDescriptor(e, 0x858, makeDescriptor(0x9000, 0xFFFF, 0x9A, 0))      // 16bit code
+		setDescriptor(e, 0x3008, makeDescriptor(0x20000, 0xFFFFF, 0x92, 0xC)) // data in LDT
+		e.setMemory32(0x10020, 0x11223344)
+		e.setMemory32(0x20010, 0x55667788)
+		copy(e.memory[0x9000:], []byte{0xB8, 0x34, 0x12})
+
+		var err error
+		for i := 0; i < test.steps && err == nil; i++ {
+			err = e.execInst()
+		}
+
+		if test.vector < 0 {
+			if err != nil || e.getRegister32(EAX) != test.eax {
+				t.Fatalf("%s: err=%v eax=0x%x", test.name, err, e.getRegister32(EAX))
+			}
+			continue
+		}
+		// no handler in IDT, then the first fault is returned
+		f, ok := err.(*Fault)
+		if !ok || f.Vector != uint8(test.vector) || f.ErrorCode != test.errorCode {
+			t.Fatalf("%s: err=%v", test.name, err)
+		}
+	}
+}
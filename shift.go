@@ -0,0 +1,156 @@
+package main
+
+// shift and rotate operations, in the order of ModRM reg field of group 2
+// (0xC0, 0xC1, 0xD0-0xD3)
+const (
+	shiftRol = iota
+	shiftRor
+	shiftRcl
+	shiftRcr
+	shiftShl
+	shiftShr
+	shiftSal // same as SHL
+	shiftSar
+)
+
+// calculate v op count of size bits, and update eflags
+func (e *Emulator) shift(op uint8, v, count uint32, size uint8) uint32 {
+	mask := sizeMask(size)
+	sign := signMask(size)
+	count &= 0x1F
+
+	switch op {
+	case shiftShl, shiftSal:
+		result := (v << count) & mask
+		e.eflags.updateByShift(lazyShl, v, count, result, size)
+		return result
+	case shiftShr:
+		result := v >> count
+		e.eflags.updateByShift(lazyShr, v, count, result, size)
+		return result
+	case shiftSar:
+		// sign extend to 32bit, then shift
+		signed := int32(v<<(32-size)) >> (32 - size)
+		result := uint32(signed>>count) & mask
+		e.eflags.updateByShift(lazySar, v, count, result, size)
+		return result
+	}
+
+	if count == 0 {
+		return v
+	}
+
+	var result uint32
+	var cf bool
+	switch op {
+	case shiftRol:
+		n := count % uint32(size)
+		result = (v<<n | v>>(uint32(size)-n)) & mask
+		cf = result&1 != 0
+		e.eflags.updateByRotate(cf, (result&sign != 0) != cf)
+	case shiftRor:
+		n := count % uint32(size)
+		result = (v>>n | v<<(uint32(size)-n)) & mask
+		cf = result&sign != 0
+		e.eflags.updateByRotate(cf, cf != (result&(sign>>1) != 0))
+	case shiftRcl, shiftRcr:
+		// rotate size+1 bits of CF:v
+		n := uint64(count % (uint32(size) + 1))
+		if n == 0 {
+			return v
+		}
+		width := uint64(size) + 1
+		x := uint64(v)
+		if e.eflags.isEnable(CarryFlag) {
+			x |= 1 << size
+		}
+		if op == shiftRcl {
+			x = x<<n | x>>(width-n)
+		} else {
+			x = x>>n | x<<(width-n)
+		}
+		result = uint32(x) & mask
+		cf = (x>>size)&1 != 0
+		if op == shiftRcl {
+			e.eflags.updateByRotate(cf, (result&sign != 0) != cf)
+		} else {
+			e.eflags.updateByRotate(cf, (result&sign != 0) != (result&(sign>>1) != 0))
+		}
+	}
+	return result
+}
+
+// count of group 2: imm8 (0xC0, 0xC1), 1 (0xD0, 0xD1) or CL (0xD2, 0xD3)
+func (e *Emulator) shiftCount(inst *Instruction) uint32 {
+	switch inst.opecode {
+	case 0xD0, 0xD1:
+		return 1
+	case 0xD2, 0xD3, 0x0FA5, 0x0FAD:
+		return uint32(e.getRegister8(CL))
+	}
+	return inst.imm
+}
+
+// group 2: r/m8 = r/m8 op count (0xC0, 0xD0, 0xD2)
+func (e *Emulator) shiftRm8(inst *Instruction) {
+	m := inst.modrm
+	result := e.shift(m.opecode, uint32(e.getRm8(m)), e.shiftCount(inst), 8)
+	e.setRm8(m, uint8(result))
+}
+
+// group 2: r/m = r/m op count (0xC1, 0xD1, 0xD3)
+func (e *Emulator) shiftRm(inst *Instruction) {
+	m := inst.modrm
+	count := e.shiftCount(inst)
+	if inst.opsize == 16 {
+		result := e.shift(m.opecode, uint32(e.getRm16(m)), count, 16)
+		e.setRm16(m, uint16(result))
+	} else {
+		result := e.shift(m.opecode, e.getRm32(m), count, 32)
+		e.setRm32(m, result)
+	}
+}
+
+// shld r/m, r, count (0x0F 0xA4, 0x0F 0xA5)
+func (e *Emulator) shld(inst *Instruction) {
+	m := inst.modrm
+	count := e.shiftCount(inst) & 0x1F
+	if count == 0 {
+		return
+	}
+	if inst.opsize == 16 {
+		rm16 := uint32(e.getRm16(m))
+		x := rm16<<16 | uint32(e.getR16(m))
+		result := (x << count >> 16) & 0xFFFF
+		e.setRm16(m, uint16(result))
+		e.eflags.updateByShift(lazyShl, rm16, count, result, 16)
+	} else {
+		rm32 := e.getRm32(m)
+		x := uint64(rm32)<<32 | uint64(e.getR32(m))
+		result := uint32(x << count >> 32)
+		e.setRm32(m, result)
+		e.eflags.updateByShift(lazyShl, rm32, count, result, 32)
+	}
+}
+
+// shrd r/m, r, count (0x0F 0xAC, 0x0F 0xAD)
+func (e *Emulator) shrd(inst *Instruction) {
+	m := inst.modrm
+	count := e.shiftCount(inst) & 0x1F
+	if count == 0 {
+		return
+	}
+	if inst.opsize == 16 {
+		rm16 := uint32(e.getRm16(m))
+		x := uint32(e.getR16(m))<<16 | rm16
+		result := (x >> count) & 0xFFFF
+		e.setRm16(m, uint16(result))
+		e.eflags.updateByShift(lazyShr, rm16, count, result, 16)
+	} else {
+		rm32 := e.getRm32(m)
+		x := uint64(e.getR32(m))<<32 | uint64(rm32)
+		result := uint32(x >> count)
+		e.setRm32(m, result)
+		e.eflags.updateByShift(lazyShr, rm32, count, result, 32)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestShift(t *testing.T) {
+	const flagMask = CarryFlag | ParityFlag | ZeroFlag | SignFlag | OverflowFlag
+	tests := []struct {
+		name   string
+		code   []byte
+		eflags uint32
+		eax    uint32
+		ecx    uint32
+		result uint32 // EAX after execution
+		flags  uint32
+	}{
+		{"shl eax, 1", []byte{0xD1, 0xE0}, 0, 0x80000001, 0, 0x00000002, CarryFlag | OverflowFlag},
+		{"shl eax, 4", []byte{0xC1, 0xE0, 0x04}, 0, 0x0000000F, 0, 0x000000F0, ParityFlag},
+		{"shr al, cl", []byte{0xD2, 0xE8}, 0, 0x00000081, 1, 0x00000040, CarryFlag | OverflowFlag},
+		{"sar ax, 4", []byte{0x66, 0xC1, 0xF8, 0x04}, 0, 0x00008000, 0, 0x0000F800, SignFlag | ParityFlag},
+		{"sar eax, cl", []byte{0xD3, 0xF8}, 0, 0x80000000, 31, 0xFFFFFFFF, SignFlag | ParityFlag},
+		{"shl al, 0", []byte{0xC0, 0xE0, 0x00}, ZeroFlag, 0x00000001, 0, 0x00000001, ZeroFlag},
+		{"rol al, 1", []byte{0xD0, 0xC0}, 0, 0x00000080, 0, 0x00000001, CarryFlag | OverflowFlag},
+		{"ror eax, cl", []byte{0xD3, 0xC8}, ZeroFlag, 0x12345678, 4, 0x81234567, ZeroFlag | CarryFlag | OverflowFlag},
+		{"rol ax, 16", []byte{0x66, 0xC1, 0xC0, 0x10}, 0, 0x00001235, 0, 0x00001235, CarryFlag | OverflowFlag},
+		{"rcl al, 1", []byte{0xD0, 0xD0}, CarryFlag, 0x00000080, 0, 0x00000001, CarryFlag | OverflowFlag},
+		{"rcr eax, 1", []byte{0xD1, 0xD8}, 0, 0x00000001, 0, 0x00000000, CarryFlag},
+		{"rcl al, 9", []byte{0xC0, 0xD0, 0x09}, 0, 0x00000055, 0, 0x00000055, 0},
+		{"rcr ax, cl", []byte{0x66, 0xD3, 0xD8}, CarryFlag, 0x00000000, 2, 0x00004000, OverflowFlag},
+		{"shld eax, ecx, 4", []byte{0x0F, 0xA4, 0xC8, 0x04}, 0, 0x12345678, 0x9ABCDEF0, 0x23456789, CarryFlag | OverflowFlag},
+		{"shrd eax, ecx, 8", []byte{0x0F, 0xAC, 0xC8, 0x08}, 0, 0x12345678, 0x9ABCDEF0, 0xF0123456, SignFlag | ParityFlag | OverflowFlag},
+		{"shrd ax, cx, cl", []byte{0x66, 0x0F, 0xAD, 0xC8}, 0, 0x00001234, 0x00000004, 0x00004123, 0},
+	}
+
+	for _, test := range tests {
+		e := execOne(t, test.code, true, test.eflags, map[uint8]uint32{EAX: test.eax, ECX: test.ecx})
+		if e.getRegister32(EAX) != test.result {
+			t.Fatalf("%s: EAX=0x%x expected=0x%x", test.name, e.getRegister32(EAX), test.result)
+		}
+		if e.eflags.get()&flagMask != test.flags {
+			t.Fatalf("%s: eflags=0x%x expected=0x%x", test.name, e.eflags.get()&flagMask, test.flags)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+// operand size of string instruction, byte forms have even opecodes
+func stringSize(inst *Instruction) uint8 {
+	if inst.opecode&1 == 0 {
+		return 8
+	}
+	return inst.opsize
+}
+
+// SI/DI/CX or ESI/EDI/ECX, depends on the address size
+func (e *Emulator) getIndex(inst *Instruction, reg uint8) uint32 {
+	if inst.addrsize == 16 {
+		return uint32(e.getRegister16(reg))
+	}
+	return e.getRegister32(reg)
+}
+
+func (e *Emulator) setIndex(inst *Instruction, reg uint8, value uint32) {
+	if inst.addrsize == 16 {
+		e.setRegister16(reg, uint16(value))
+	} else {
+		e.setRegister32(reg, value)
+	}
+}
+
+// step SI/DI by size bits according to DirectionFlag
+func (e *Emulator) stepIndex(inst *Instruction, reg uint8, size uint8) {
+	n := uint32(size / 8)
+	if e.eflags.isEnable(DirectionFlag) {
+		e.setIndex(inst, reg, e.getIndex(inst, reg)-n)
+	} else {
+		e.setIndex(inst, reg, e.getIndex(inst, reg)+n)
+	}
+}
+
+// source of string instruction is DS:ESI (segment can be overridden)
+func (e *Emulator) stringSource(inst *Instruction, size uint8) uint32 {
+	return e.linearAddress(inst.segment, e.getIndex(inst, ESI), uint32(size/8), false)
+}
+
+// destination of string instruction is always ES:EDI
+func (e *Emulator) stringDestination(inst *Instruction, size uint8, write bool) uint32 {
+	return e.linearAddress(ES, e.getIndex(inst, EDI), uint32(size/8), write)
+}
+
+// AL, AX or EAX
+func (e *Emulator) getAccumulator(size uint8) uint32 {
+	switch size {
+	case 8:
+		return uint32(e.getRegister8(AL))
+	case 16:
+		return uint32(e.getRegister16(AX))
+	}
+	return e.getRegister32(EAX)
+}
+
+func (e *Emulator) setAccumulator(size uint8, value uint32) {
+	switch size {
+	case 8:
+		e.setRegister8(AL, uint8(value))
+	case 16:
+		e.setRegister16(AX, uint16(value))
+	default:
+		e.setRegister32(EAX, value)
+	}
+}
+
+func (e *Emulator) getMemory(address uint32, size uint8) uint32 {
+	switch size {
+	case 8:
+		return uint32(e.getMemory8(address))
+	case 16:
+		return uint32(e.getMemory16(address))
+	}
+	return e.getMemory32(address)
+}
+
+func (e *Emulator) setMemory(address, value uint32, size uint8) {
+	switch size {
+	case 8:
+		e.setMemory8(address, uint8(value))
+	case 16:
+		e.setMemory16(address, uint16(value))
+	default:
+		e.setMemory32(address, value)
+	}
+}
+
+// movs: ES:[EDI] = DS:[ESI] (0xA4, 0xA5)
+func (e *Emulator) movs(inst *Instruction) {
+	size := stringSize(inst)
+	value := e.getMemory(e.stringSource(inst, size), size)
+	e.setMemory(e.stringDestination(inst, size, true), value, size)
+	e.stepIndex(inst, ESI, size)
+	e.stepIndex(inst, EDI, size)
+}
+
+// cmps: compare DS:[ESI] with ES:[EDI] (0xA6, 0xA7)
+func (e *Emulator) cmps(inst *Instruction) {
+	size := stringSize(inst)
+	v1 := e.getMemory(e.stringSource(inst, size), size)
+	v2 := e.getMemory(e.stringDestination(inst, size, false), size)
+	e.eflags.updateBySubtraction(v1, v2, 0, (v1-v2)&sizeMask(size), size)
+	e.stepIndex(inst, ESI, size)
+	e.stepIndex(inst, EDI, size)
+}
+
+// stos: ES:[EDI] = AL/AX/EAX (0xAA, 0xAB)
+func (e *Emulator) stos(inst *Instruction) {
+	size := stringSize(inst)
+	e.setMemory(e.stringDestination(inst, size, true), e.getAccumulator(size), size)
+	e.stepIndex(inst, EDI, size)
+}
+
+// lods: AL/AX/EAX = DS:[ESI] (0xAC, 0xAD)
+func (e *Emulator) lods(inst *Instruction) {
+	size := stringSize(inst)
+	e.setAccumulator(size, e.getMemory(e.stringSource(inst, size), size))
+	e.stepIndex(inst, ESI, size)
+}
+
+// scas: compare AL/AX/EAX with ES:[EDI] (0xAE, 0xAF)
+func (e *Emulator) scas(inst *Instruction) {
+	size := stringSize(inst)
+	v1 := e.getAccumulator(size)
+	v2 := e.getMemory(e.stringDestination(inst, size, false), size)
+	e.eflags.updateBySubtraction(v1, v2, 0, (v1-v2)&sizeMask(size), size)
+	e.stepIndex(inst, EDI, size)
+}
+
+// ins: ES:[EDI] = port DX (0x6C, 0x6D)
+func (e *Emulator) ins(inst *Instruction) {
+	size := stringSize(inst)
+	port := e.getRegister16(DX)
+	e.checkIOPermission(port, size)
+	var value uint32
+	switch size {
+	case 8:
+		value = uint32(e.io.in8(port))
+	case 16:
+		value = uint32(e.io.in16(port))
+	default:
+		value = e.io.in32(port)
+	}
+	e.setMemory(e.stringDestination(inst, size, true), value, size)
+	e.stepIndex(inst, EDI, size)
+}
+
+// outs: port DX = DS:[ESI] (0x6E, 0x6F)
+func (e *Emulator) outs(inst *Instruction) {
+	size := stringSize(inst)
+	port := e.getRegister16(DX)
+	e.checkIOPermission(port, size)
+	value := e.getMemory(e.stringSource(inst, size), size)
+	switch size {
+	case 8:
+		e.io.out8(port, uint8(value))
+	case 16:
+		e.io.out16(port, uint16(value))
+	default:
+		e.io.out32(port, value)
+	}
+	e.stepIndex(inst, ESI, size)
+}
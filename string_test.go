@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+)
+
+// execute the (repeated) string instruction until eip goes to the next one
+func execString(t *testing.T, e *Emulator) {
+	for e.eip == 0x7c00 {
+		if err := e.execInst(); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+}
+
+func TestRepMovs(t *testing.T) {
+	// rep movsd
+	e := newTestEmulator([]byte{0xF3, 0xA5}, true)
+	copy(e.memory[0x9000:], "0123456789abcdef")
+	e.setRegister32(ESI, 0x9000)
+	e.setRegister32(EDI, 0xA000)
+	e.setRegister32(ECX, 3)
+	execString(t, e)
+	if string(e.memory[0xA000:0xA010]) != "0123456789ab\x00\x00\x00\x00" {
+		t.Fatalf("memory=%q", e.memory[0xA000:0xA010])
+	}
+	assetRegister32(t, e, "ESI", ESI, 0x900C)
+	assetRegister32(t, e, "EDI", EDI, 0xA00C)
+	assetRegister32(t, e, "ECX", ECX, 0)
+}
+
+func TestMovsDirection(t *testing.T) {
+	// std; movsw
+	e := newTestEmulator([]byte{0xFD, 0x66, 0xA5}, true)
+	copy(e.memory[0x9000:], "abcd")
+	e.setRegister32(ESI, 0x9002)
+	e.setRegister32(EDI, 0xA002)
+	for i := 0; i < 2; i++ {
+		if err := e.execInst(); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if string(e.memory[0xA002:0xA004]) != "cd" {
+		t.Fatalf("memory=%q", e.memory[0xA000:0xA004])
+	}
+	assetRegister32(t, e, "ESI", ESI, 0x9000)
+	assetRegister32(t, e, "EDI", EDI, 0xA000)
+}
+
+func TestRepeCmps(t *testing.T) {
+	// memcmp: repe cmpsb
+	e := newTestEmulator([]byte{0xF3, 0xA6}, true)
+	copy(e.memory[0x9000:], "hello")
+	copy(e.memory[0xA000:], "help!")
+	e.setRegister32(ESI, 0x9000)
+	e.setRegister32(EDI, 0xA000)
+	e.setRegister32(ECX, 5)
+	execString(t, e)
+	assetRegister32(t, e, "ESI", ESI, 0x9004)
+	assetRegister32(t, e, "EDI", EDI, 0xA004)
+	assetRegister32(t, e, "ECX", ECX, 1)
+	// 'l' < 'p'
+	if e.eflags.isEnable(ZeroFlag) || !e.eflags.isEnable(CarryFlag) {
+		t.Fatalf("eflags=0x%x", e.eflags.get())
+	}
+}
+
+func TestRepStos16(t *testing.T) {
+	// rep stosw with 16bit address size, ES:DI and CX
+	e := newTestEmulator([]byte{0xF3, 0xAB}, false)
+	e.setSreg16(ES, 0x0900)
+	e.setRegister32(EDI, 0x12340010)
+	e.setRegister32(ECX, 0x56780002)
+	e.setRegister32(EAX, 0xBEEF)
+	execString(t, e)
+	if e.getMemory32(0x9010) != 0xBEEFBEEF {
+		t.Fatalf("memory=0x%x", e.getMemory32(0x9010))
+	}
+	assetRegister32(t, e, "EDI", EDI, 0x12340014)
+	assetRegister32(t, e, "ECX", ECX, 0x56780000)
+}
+
+func TestLodsSegmentOverride(t *testing.T) {
+	// lodsb fs:[si] in real mode
+	e := newTestEmulator([]byte{0x64, 0xAC}, false)
+	e.setSreg16(FS, 0x1000)
+	e.setRegister32(ESI, 0x0020)
+	e.memory[0x10020] = 0x5A
+	if err := e.execInst(); err != nil {
+		t.Fatal(err.Error())
+	}
+	assetRegister32(t, e, "EAX", EAX, 0xaa5A)
+	assetRegister32(t, e, "ESI", ESI, 0x0021)
+}
+
+func TestRepScasw(t *testing.T) {
+	// repne scasw, searching for 0x0000
+	e := newTestEmulator([]byte{0xF2, 0x66, 0xAF}, true)
+	copy(e.memory[0x9000:], []byte{1, 0, 2, 0, 0, 0, 3, 0})
+	e.setRegister32(EAX, 0)
+	e.setRegister32(EDI, 0x9000)
+	e.setRegister32(ECX, 10)
+	execString(t, e)
+	assetRegister32(t, e, "EDI", EDI, 0x9006)
+	assetRegister32(t, e, "ECX", ECX, 7)
+	if !e.eflags.isEnable(ZeroFlag) {
+		t.Fatalf("eflags=0x%x", e.eflags.get())
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+// TLB caches the translations of the linear pages
+type TLB struct {
+	pages      map[uint32]tlbEntry // 4KB pages, keyed by vaddress>>12
+	largePages map[uint32]tlbEntry // 4MB pages, keyed by vaddress>>22
+	Hits       uint64              // number of translations found in the TLB
+	Misses     uint64              // number of translations by the page walk
+}
+
+type tlbEntry struct {
+	frame uint32 // physical address of the page
+	flags uint32 // effective PageWrite and PageUser of the page
+	dirty bool   // the dirty bit is already set in the page entry
+}
+
+// NewTLB returns an empty TLB
+func NewTLB() TLB {
+	return TLB{
+		pages:      map[uint32]tlbEntry{},
+		largePages: map[uint32]tlbEntry{},
+	}
+}
+
+// find the entry of the linear address
+func (tlb *TLB) lookup(vaddress uint32) (tlbEntry, uint32, bool) {
+	if entry, ok := tlb.pages[vaddress>>12]; ok {
+		return entry, vaddress & 0xFFF, true
+	}
+	if entry, ok := tlb.largePages[vaddress>>22]; ok {
+		return entry, vaddress & 0x3FFFFF, true
+	}
+	return tlbEntry{}, 0, false
+}
+
+func (tlb *TLB) insert(vaddress uint32, entry tlbEntry, large bool) {
+	if large {
+		tlb.largePages[vaddress>>22] = entry
+	} else {
+		tlb.pages[vaddress>>12] = entry
+	}
+}
+
+// invalidate the page which contains the linear address
+func (tlb *TLB) invalidate(vaddress uint32) {
+	delete(tlb.pages, vaddress>>12)
+	delete(tlb.largePages, vaddress>>22)
+}
+
+// invalidate all entries
+func (tlb *TLB) flush() {
+	tlb.pages = map[uint32]tlbEntry{}
+	tlb.largePages = map[uint32]tlbEntry{}
+}
+
+// invlpg m (0x0F 0x01 /7)
+func (e *Emulator) invlpg(inst *Instruction) {
+	m := inst.modrm
+	e.tlb.invalidate(e.segmentBase(m.segment) + e.calcMemoryAddress(m))
+}
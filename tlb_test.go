@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTLB(t *testing.T) {
+	// invlpg [0x5000]; mov cr3, eax
+	e := newTestEmulator([]byte{0x0F, 0x01, 0x3D, 0x00, 0x50, 0x00, 0x00, 0x0F, 0x22, 0xD8}, true)
+
+	// page directory at 0x10000, page table at 0x11000 maps 0-4MB
+	e.writePhysical32(0x10000, 0x11000|PagePresent|PageWrite)
+	for i := uint32(0); i < 1024; i++ {
+		e.writePhysical32(0x11000+4*i, i<<12|PagePresent|PageWrite)
+	}
+	e.cr[3] = 0x10000
+	e.cr[0] |= CR0PagingFlag
+	e.setRegister32(EAX, 0x10000)
+
+	assertTLB := func(name string, vaddress, paddress uint32, hit bool) {
+		e.tlb.Hits, e.tlb.Misses = 0, 0
+		p := e.v2p(vaddress)
+		if p != paddress || (e.tlb.Hits == 1) != hit || e.tlb.Hits+e.tlb.Misses != 1 {
+			t.Fatalf("%s: paddress=0x%x hits=%d misses=%d", name, p, e.tlb.Hits, e.tlb.Misses)
+		}
+	}
+	assertTLB("first access", 0x5123, 0x5123, false)
+	assertTLB("same page", 0x5FFF, 0x5FFF, true)
+
+	// the cached translation is used until it is invalidated
+	e.writePhysical32(0x11000+4*5, 0x8000|PagePresent|PageWrite)
+	assertTLB("stale entry", 0x5000, 0x5000, true)
+
+	// the first write walks the page tables again to set the dirty bit
+	if p := e.translate(0x5000, true); p != 0x8000 || e.readPhysical32(0x11000+4*5)&PageDirty == 0 {
+		t.Fatalf("write: paddress=0x%x", p)
+	}
+	e.writePhysical32(0x11000+4*5, 0x5000|PagePresent|PageWrite)
+	assertTLB("dirty entry", 0x5000, 0x8000, true)
+
+	// invlpg
+	e.execInst()
+	assertTLB("invlpg", 0x5000, 0x5000, false)
+
+	// mov cr3 flushes all entries
+	e.writePhysical32(0x11000+4*5, 0x9000|PagePresent|PageWrite)
+	e.execInst()
+	assertTLB("mov cr3", 0x5000, 0x9000, false)
+}
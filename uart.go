@@ -0,0 +1,298 @@
+package main
+
+import (
+	"io"
+)
+
+// I/O ports and IRQ of COM1
+const (
+	com1Base = 0x3F8
+	com1IRQ  = 4
+)
+
+// registers of the UART, offsets from the base port
+const (
+	uartRBR = 0 // read: receiver buffer, write: transmitter holding, DLAB: divisor latch low
+	uartIER = 1 // interrupt enable, DLAB: divisor latch high
+	uartIIR = 2 // read: interrupt identification, write: FIFO control
+	uartLCR = 3 // line control
+	uartMCR = 4 // modem control
+	uartLSR = 5 // line status
+	uartMSR = 6 // modem status
+	uartSCR = 7 // scratch
+)
+
+// bits of the registers
+const (
+	uartERBFI = 0x01 // IER: received data available
+	uartETBEI = 0x02 // IER: transmitter holding register empty
+	uartELSI  = 0x04 // IER: receiver line status
+
+	uartIIRNone       = 0x01 // IIR: no interrupt is pending
+	uartIIRLineStatus = 0x06 // IIR: receiver line status
+	uartIIRData       = 0x04 // IIR: received data available
+	uartIIRTimeout    = 0x0C // IIR: character timeout
+	uartIIRTHRE       = 0x02 // IIR: transmitter holding register empty
+	uartIIRFIFO       = 0xC0 // IIR: FIFOs are enabled
+
+	uartFIFOEnable = 0x01 // FCR: enable the FIFOs
+	uartFIFOClearR = 0x02 // FCR: clear the receiver FIFO
+	uartFIFOClearT = 0x04 // FCR: clear the transmitter FIFO
+
+	uartDLAB = 0x80 // LCR: divisor latch access
+
+	uartLoop = 0x10 // MCR: loopback
+
+	uartDR   = 0x01 // LSR: data ready
+	uartOE   = 0x02 // LSR: overrun error
+	uartTHRE = 0x20 // LSR: transmitter holding register empty
+	uartTEMT = 0x40 // LSR: transmitter empty
+)
+
+// size of the FIFO
+const uartFIFOSize = 16
+
+// UART is the 16550A UART. The transmitted characters are written to writer,
+// and the characters read from reader are received. Transmission completes
+// immediately, so THR is always empty. The modem lines are always active
+// unless in the loopback mode.
+type UART struct {
+	irq    IRQLines
+	line   uint8 // IRQ line
+	reader io.Reader
+	writer io.Writer
+	input  chan byte // characters read from reader, nil unless it is being read
+
+	ier     uint8
+	lcr     uint8
+	mcr     uint8
+	lsr     uint8
+	scr     uint8
+	fcr     uint8
+	divisor uint16
+	fifo    []byte // received characters, only one without FIFO
+	thri    bool   // THR empty interrupt is pending
+	raised  bool   // level of the IRQ line
+	started bool   // reader is being read, or has been read to the end
+}
+
+// NewUART returns the UART which raises the IRQ line on irq
+func NewUART(reader io.Reader, writer io.Writer, irq IRQLines, line uint8) *UART {
+	return &UART{
+		irq:     irq,
+		line:    line,
+		reader:  reader,
+		writer:  writer,
+		lsr:     uartTHRE | uartTEMT,
+		divisor: 12, // 9600 baud
+	}
+}
+
+// start reading reader when the guest uses the receiver, so that the host
+// input is not taken by the emulator which does not use COM1
+func (u *UART) start() {
+	if u.started || u.reader == nil {
+		return
+	}
+	u.started = true
+	u.input = make(chan byte, 256)
+	go func(reader io.Reader, input chan<- byte) {
+		buf := make([]byte, 256)
+		for {
+			n, err := reader.Read(buf)
+			for _, c := range buf[:n] {
+				input <- c
+			}
+			if err != nil {
+				close(input)
+				return
+			}
+		}
+	}(u.reader, u.input)
+}
+
+// poll moves the characters read from reader into the FIFO while it has
+// space
+func (u *UART) poll() {
+	if u.input == nil {
+		return
+	}
+	for len(u.fifo) < u.fifoSize() {
+		select {
+		case c, ok := <-u.input:
+			if !ok {
+				u.input = nil
+				return
+			}
+			u.Receive(c)
+		default:
+			u.update()
+			return
+		}
+	}
+	u.update()
+}
+
+// Receive puts the character to the FIFO. The overrun error is set and the
+// character is lost if the FIFO is full.
+func (u *UART) Receive(c byte) {
+	if len(u.fifo) >= u.fifoSize() {
+		u.lsr |= uartOE
+	} else {
+		u.fifo = append(u.fifo, c)
+	}
+	u.update()
+}
+
+func (u *UART) fifoSize() int {
+	if u.fcr&uartFIFOEnable != 0 {
+		return uartFIFOSize
+	}
+	return 1
+}
+
+// number of the characters which raise the received data interrupt
+func (u *UART) triggerLevel() int {
+	if u.fcr&uartFIFOEnable == 0 {
+		return 1
+	}
+	return []int{1, 4, 8, 14}[u.fcr>>6]
+}
+
+// the pending interrupt with the highest priority
+func (u *UART) interruptID() uint8 {
+	switch {
+	case u.ier&uartELSI != 0 && u.lsr&uartOE != 0:
+		return uartIIRLineStatus
+	case u.ier&uartERBFI != 0 && len(u.fifo) >= u.triggerLevel():
+		return uartIIRData
+	case u.ier&uartERBFI != 0 && len(u.fifo) > 0:
+		// the characters below the trigger level time out immediately
+		return uartIIRTimeout
+	case u.ier&uartETBEI != 0 && u.thri:
+		return uartIIRTHRE
+	}
+	return uartIIRNone
+}
+
+// set the IRQ line to the interrupt state. The line is not gated by OUT2 of
+// MCR, as xv6 never sets it.
+func (u *UART) update() {
+	pending := u.interruptID() != uartIIRNone
+	if pending == u.raised {
+		return
+	}
+	u.raised = pending
+	if pending {
+		u.irq.RaiseIRQ(u.line)
+	} else {
+		u.irq.LowerIRQ(u.line)
+	}
+}
+
+// transmit the character, it is received in the loopback mode
+func (u *UART) transmit(c byte) {
+	if u.mcr&uartLoop != 0 {
+		u.Receive(c)
+	} else if u.writer != nil {
+		u.writer.Write([]byte{c})
+	}
+	u.thri = true
+}
+
+// In reads the register
+func (u *UART) In(port uint16, size uint8) uint32 {
+	defer u.update()
+	switch port - com1Base {
+	case uartRBR:
+		if u.lcr&uartDLAB != 0 {
+			return uint32(uint8(u.divisor))
+		}
+		u.start()
+		u.poll()
+		if len(u.fifo) == 0 {
+			return 0
+		}
+		c := u.fifo[0]
+		u.fifo = u.fifo[1:]
+		return uint32(c)
+	case uartIER:
+		if u.lcr&uartDLAB != 0 {
+			return uint32(u.divisor >> 8)
+		}
+		return uint32(u.ier)
+	case uartIIR:
+		id := u.interruptID()
+		if id == uartIIRTHRE {
+			// reading IIR clears the THR empty interrupt
+			u.thri = false
+		}
+		if u.fcr&uartFIFOEnable != 0 {
+			id |= uartIIRFIFO
+		}
+		return uint32(id)
+	case uartLCR:
+		return uint32(u.lcr)
+	case uartMCR:
+		return uint32(u.mcr)
+	case uartLSR:
+		u.start()
+		u.poll()
+		lsr := u.lsr
+		if len(u.fifo) > 0 {
+			lsr |= uartDR
+		}
+		// reading LSR clears the error
+		u.lsr &^= uartOE
+		return uint32(lsr)
+	case uartMSR:
+		if u.mcr&uartLoop != 0 {
+			// CTS, DSR, RI and DCD are RTS, DTR, OUT1 and OUT2
+			m := u.mcr
+			return uint32(m&0x02<<3 | m&0x01<<5 | m&0x04<<4 | m&0x08<<4)
+		}
+		return 0xB0 // CTS, DSR and DCD
+	case uartSCR:
+		return uint32(u.scr)
+	}
+	return 0
+}
+
+// Out writes the register
+func (u *UART) Out(port uint16, size uint8, value uint32) {
+	defer u.update()
+	v := uint8(value)
+	switch port - com1Base {
+	case uartRBR:
+		if u.lcr&uartDLAB != 0 {
+			u.divisor = u.divisor&0xFF00 | uint16(v)
+			return
+		}
+		u.transmit(v)
+	case uartIER:
+		if u.lcr&uartDLAB != 0 {
+			u.divisor = u.divisor&0x00FF | uint16(v)<<8
+			return
+		}
+		if v&uartETBEI != 0 && u.ier&uartETBEI == 0 {
+			// THR is empty when the interrupt is enabled
+			u.thri = true
+		}
+		u.ier = v & 0x0F
+		if u.ier&uartERBFI != 0 {
+			u.start()
+		}
+	case uartIIR:
+		if (v^u.fcr)&uartFIFOEnable != 0 || v&uartFIFOClearR != 0 {
+			// changing the FIFO mode clears the FIFOs
+			u.fifo = nil
+		}
+		u.fcr = v &^ (uartFIFOClearR | uartFIFOClearT)
+	case uartLCR:
+		u.lcr = v
+	case uartMCR:
+		u.mcr = v & 0x1F
+	case uartSCR:
+		u.scr = v
+	}
+}
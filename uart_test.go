@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUART(t *testing.T) {
+	out := &bytes.Buffer{}
+	irq := &irqRecorder{}
+	u := NewUART(nil, out, irq, com1IRQ)
+
+	// initialize as uartinit() of xv6
+	for _, w := range [][2]uint32{{uartIIR, 0}, {uartLCR, uartDLAB}, {uartRBR, 115200 / 9600}, {uartIER, 0}, {uartLCR, 0x03}, {uartMCR, 0}, {uartIER, uartERBFI}} {
+		u.Out(uint16(com1Base+w[0]), 8, w[1])
+	}
+	if u.divisor != 12 {
+		t.Fatalf("divisor=%d", u.divisor)
+	}
+	if lsr := u.In(com1Base+uartLSR, 8); lsr != uartTHRE|uartTEMT {
+		t.Fatalf("LSR=0x%x", lsr)
+	}
+
+	for _, c := range []byte("hi\n") {
+		u.Out(com1Base+uartRBR, 8, uint32(c))
+	}
+	if out.String() != "hi\n" {
+		t.Fatalf("output=%q", out.String())
+	}
+	if irq.raised != 0 {
+		t.Fatal("THR empty interrupt is not enabled")
+	}
+
+	// received data interrupt
+	u.Receive('a')
+	if !irq.lines[com1IRQ] {
+		t.Fatal("IRQ4 must be raised")
+	}
+	if iir := u.In(com1Base+uartIIR, 8); iir != uartIIRData {
+		t.Fatalf("IIR=0x%x", iir)
+	}
+	if lsr := u.In(com1Base+uartLSR, 8); lsr&uartDR == 0 {
+		t.Fatalf("LSR=0x%x", lsr)
+	}
+	if c := u.In(com1Base+uartRBR, 8); c != 'a' {
+		t.Fatalf("RBR=0x%x", c)
+	}
+	if irq.lines[com1IRQ] || u.In(com1Base+uartIIR, 8) != uartIIRNone {
+		t.Fatal("interrupt must be cleared")
+	}
+
+	// overrun without FIFO
+	u.Out(com1Base+uartIER, 8, uartERBFI|uartELSI)
+	u.Receive('b')
+	u.Receive('c')
+	if iir := u.In(com1Base+uartIIR, 8); iir != uartIIRLineStatus {
+		t.Fatalf("IIR=0x%x", iir)
+	}
+	if lsr := u.In(com1Base+uartLSR, 8); lsr&(uartOE|uartDR) != uartOE|uartDR {
+		t.Fatalf("LSR=0x%x", lsr)
+	}
+	if c := u.In(com1Base+uartRBR, 8); c != 'b' {
+		t.Fatalf("RBR=0x%x", c)
+	}
+
+	// THR empty interrupt is cleared by reading IIR
+	u.Out(com1Base+uartIER, 8, uartETBEI)
+	if iir := u.In(com1Base+uartIIR, 8); iir != uartIIRTHRE {
+		t.Fatalf("IIR=0x%x", iir)
+	}
+	if u.In(com1Base+uartIIR, 8) != uartIIRNone || irq.lines[com1IRQ] {
+		t.Fatal("THR empty interrupt must be cleared")
+	}
+}
+
+func TestUARTFIFO(t *testing.T) {
+	out := &bytes.Buffer{}
+	u := NewUART(nil, out, &irqRecorder{}, com1IRQ)
+
+	// FIFO with the trigger level 4, and loopback
+	u.Out(com1Base+uartIIR, 8, 0x40|uartFIFOEnable)
+	u.Out(com1Base+uartIER, 8, uartERBFI)
+	u.Out(com1Base+uartMCR, 8, uartLoop|0x0B)
+	if msr := u.In(com1Base+uartMSR, 8); msr != 0xB0 {
+		t.Fatalf("MSR=0x%x", msr)
+	}
+	for _, c := range []byte("abc") {
+		u.Out(com1Base+uartRBR, 8, uint32(c))
+	}
+	if out.Len() != 0 {
+		t.Fatalf("output=%q", out.String())
+	}
+	if iir := u.In(com1Base+uartIIR, 8); iir != uartIIRFIFO|uartIIRTimeout {
+		t.Fatalf("IIR=0x%x", iir)
+	}
+	u.Out(com1Base+uartRBR, 8, 'd')
+	if iir := u.In(com1Base+uartIIR, 8); iir != uartIIRFIFO|uartIIRData {
+		t.Fatalf("IIR=0x%x", iir)
+	}
+	var received []byte
+	for u.In(com1Base+uartLSR, 8)&uartDR != 0 {
+		received = append(received, uint8(u.In(com1Base+uartRBR, 8)))
+	}
+	if string(received) != "abcd" {
+		t.Fatalf("received=%q", received)
+	}
+}
+
+func TestUARTReader(t *testing.T) {
+	u := NewUART(strings.NewReader("ls\n"), nil, &irqRecorder{}, com1IRQ)
+	u.Out(com1Base+uartIIR, 8, uartFIFOEnable)
+
+	var received []byte
+	for deadline := time.Now().Add(time.Second); len(received) < 3 && time.Now().Before(deadline); {
+		if u.In(com1Base+uartLSR, 8)&uartDR != 0 {
+			received = append(received, uint8(u.In(com1Base+uartRBR, 8)))
+		}
+	}
+	if string(received) != "ls\n" {
+		t.Fatalf("received=%q", received)
+	}
+
+	// reader is not read again after EOF
+	for deadline := time.Now().Add(time.Second); u.input != nil && time.Now().Before(deadline); {
+		u.In(com1Base+uartLSR, 8)
+	}
+	u.In(com1Base+uartLSR, 8)
+	if u.input != nil {
+		t.Fatal("reader is started again after EOF")
+	}
+}
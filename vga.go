@@ -0,0 +1,173 @@
+package main
+
+import (
+	"image"
+	"image/color"
+)
+
+// memory and I/O ports of the VGA graphics mode
+const (
+	vgaBase   = 0xA0000
+	vgaSize   = 0x10000
+	vgaWidth  = 320
+	vgaHeight = 200
+
+	dacMask       = 0x3C6 // pixel mask
+	dacReadIndex  = 0x3C7 // read: DAC state, write: index to read
+	dacWriteIndex = 0x3C8 // index to write
+	dacData       = 0x3C9 // red, green and blue of the color at the index
+)
+
+// video modes
+const (
+	vgaModeText    = 0x03 // 80x25 16 colors text
+	vgaModeGraphic = 0x13 // 320x200 256 colors graphics
+)
+
+// colors 0-15 of the text mode in 6 bits per component
+var vgaTextColors = [16][3]uint8{
+	{0, 0, 0}, {0, 0, 42}, {0, 42, 0}, {0, 42, 42}, {42, 0, 0}, {42, 0, 42}, {42, 21, 0}, {42, 42, 42},
+	{21, 21, 21}, {21, 21, 63}, {21, 63, 21}, {21, 63, 63}, {63, 21, 21}, {63, 21, 63}, {63, 63, 21}, {63, 63, 63},
+}
+
+// VGA is the mode 13h graphics, whose pixels are the bytes from 0xA0000
+// indexing the 256 colors of the DAC palette. The other modes are the text
+// mode of CGA.
+type VGA struct {
+	memory  [vgaSize]byte
+	mode    uint8
+	palette [256][3]uint8 // 6 bits per component
+	mask    uint8
+	read    uint8 // index to read
+	write   uint8 // index to write
+	reading bool  // the last index was to read
+	rgb     int   // component of the color to be accessed next
+	dirty   bool  // the screen is changed since Frame
+}
+
+// NewVGA returns the VGA in the text mode
+func NewVGA() *VGA {
+	v := &VGA{mode: vgaModeText}
+	v.resetPalette()
+	return v
+}
+
+// the colors of the text mode, and 16 grays. The others are black until they
+// are set.
+func (v *VGA) resetPalette() {
+	v.palette = [256][3]uint8{}
+	copy(v.palette[:], vgaTextColors[:])
+	for i := 0; i < 16; i++ {
+		gray := uint8(i * 63 / 15)
+		v.palette[16+i] = [3]uint8{gray, gray, gray}
+	}
+	v.mask = 0xFF
+	v.dirty = true
+}
+
+// SetMode changes the video mode. The screen is cleared unless bit 7 of mode
+// is set.
+func (v *VGA) SetMode(mode uint8) {
+	v.mode = mode & 0x7F
+	if mode&0x80 == 0 {
+		v.memory = [vgaSize]byte{}
+	}
+	v.resetPalette()
+}
+
+// Mode returns the video mode
+func (v *VGA) Mode() uint8 {
+	return v.mode
+}
+
+// Read reads the memory
+func (v *VGA) Read(offset uint32, size uint8) uint32 {
+	var ret uint32
+	for i := uint32(0); i < uint32(size/8) && offset+i < vgaSize; i++ {
+		ret |= uint32(v.memory[offset+i]) << (i * 8)
+	}
+	return ret
+}
+
+// Write writes the memory
+func (v *VGA) Write(offset uint32, size uint8, value uint32) {
+	for i := uint32(0); i < uint32(size/8) && offset+i < vgaSize; i++ {
+		v.memory[offset+i] = uint8(value >> (i * 8))
+	}
+	v.dirty = true
+}
+
+// In reads the DAC
+func (v *VGA) In(port uint16, size uint8) uint32 {
+	switch port {
+	case dacMask:
+		return uint32(v.mask)
+	case dacReadIndex:
+		if v.reading {
+			return 0x03
+		}
+		return 0x00
+	case dacWriteIndex:
+		return uint32(v.write)
+	case dacData:
+		value := v.palette[v.read][v.rgb]
+		if v.next() {
+			v.read++
+		}
+		return uint32(value)
+	}
+	return 0
+}
+
+// Out writes the DAC
+func (v *VGA) Out(port uint16, size uint8, value uint32) {
+	switch port {
+	case dacMask:
+		v.mask = uint8(value)
+		v.dirty = true
+	case dacReadIndex:
+		v.read = uint8(value)
+		v.reading = true
+		v.rgb = 0
+	case dacWriteIndex:
+		v.write = uint8(value)
+		v.reading = false
+		v.rgb = 0
+	case dacData:
+		v.palette[v.write][v.rgb] = uint8(value) & 0x3F
+		v.dirty = true
+		if v.next() {
+			v.write++
+		}
+	}
+}
+
+// move to the next component, and return true when the color is completed
+func (v *VGA) next() bool {
+	v.rgb++
+	if v.rgb < 3 {
+		return false
+	}
+	v.rgb = 0
+	return true
+}
+
+// Dirty returns whether the screen is changed since Frame
+func (v *VGA) Dirty() bool {
+	return v.dirty
+}
+
+// Frame returns the screen of mode 13h
+func (v *VGA) Frame() image.Image {
+	v.dirty = false
+	palette := make(color.Palette, len(v.palette))
+	for i, c := range v.palette {
+		// 6 bits to 8 bits
+		palette[i] = color.RGBA{c[0]<<2 | c[0]>>4, c[1]<<2 | c[1]>>4, c[2]<<2 | c[2]>>4, 0xFF}
+	}
+	frame := image.NewPaletted(image.Rect(0, 0, vgaWidth, vgaHeight), palette)
+	for i := range frame.Pix {
+		frame.Pix[i] = v.memory[i] & v.mask
+	}
+	return frame
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"image/color"
+	"testing"
+)
+
+func TestVGA(t *testing.T) {
+	// mov ax, 0x13; int 0x10; mov ah, 0x0f; int 0x10
+	e := newTestEmulator([]byte{0xB8, 0x13, 0x00, 0xCD, 0x10, 0xB4, 0x0F, 0xCD, 0x10}, false)
+	e.vga.memory[0] = 0xFF
+	for i := 0; i < 4; i++ {
+		if err := e.execInst(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if e.vga.Mode() != vgaModeGraphic || e.vga.memory[0] != 0 {
+		t.Fatalf("mode=0x%x", e.vga.Mode())
+	}
+	if ax, bh := e.getRegister16(AX), e.getRegister8(BH); ax != 40<<8|vgaModeGraphic || bh != 0 {
+		t.Fatalf("AX=0x%x BH=0x%x", ax, bh)
+	}
+
+	// set color 0x80 to orange, and read it back
+	e.io.out8(dacWriteIndex, 0x80)
+	for _, c := range []uint8{63, 32, 0} {
+		e.io.out8(dacData, c)
+	}
+	e.io.out8(dacReadIndex, 0x80)
+	for _, c := range []uint8{63, 32, 0} {
+		if v := e.io.in8(dacData); v != c {
+			t.Fatalf("DAC=%d, want %d", v, c)
+		}
+	}
+	if e.io.in8(dacReadIndex) != 0x03 || e.io.in8(dacWriteIndex) != 0x81 {
+		t.Fatal("DAC index is not incremented")
+	}
+
+	e.setMemory8(vgaBase+vgaWidth*10+20, 0x80)
+	e.setMemory8(vgaBase+vgaWidth*10+21, 0x0E)
+	if !e.vga.Dirty() {
+		t.Fatal("screen must be dirty")
+	}
+	frame := e.vga.Frame()
+	if b := frame.Bounds(); b.Dx() != vgaWidth || b.Dy() != vgaHeight {
+		t.Fatalf("bounds=%v", b)
+	}
+	for _, tt := range []struct {
+		x, y int
+		want color.RGBA
+	}{
+		{20, 10, color.RGBA{0xFF, 0x82, 0x00, 0xFF}},
+		{21, 10, color.RGBA{0xFF, 0xFF, 0x55, 0xFF}}, // yellow
+		{0, 0, color.RGBA{0x00, 0x00, 0x00, 0xFF}},
+	} {
+		if c := color.RGBAModel.Convert(frame.At(tt.x, tt.y)); c != tt.want {
+			t.Errorf("(%d, %d)=%v, want %v", tt.x, tt.y, c, tt.want)
+		}
+	}
+	if e.vga.Dirty() {
+		t.Fatal("screen must not be dirty after Frame")
+	}
+}
+
+func TestVGATextMode(t *testing.T) {
+	// mov ax, 0x03; int 0x10
+	e := newTestEmulator([]byte{0xB8, 0x03, 0x00, 0xCD, 0x10}, false)
+	e.setMemory16(cgaBase, 0x0741)
+	for i := 0; i < 2; i++ {
+		if err := e.execInst(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if e.vga.Mode() != vgaModeText || e.getMemory16(cgaBase) != 0x0720 {
+		t.Fatalf("mode=0x%x screen=0x%x", e.vga.Mode(), e.getMemory16(cgaBase))
+	}
+}
@@ -76,7 +76,9 @@ func ExecEmu() {
 	for i := 0; i < len(bin); i++ {
 		e.memory[uint32(i+0x7c00)] = bin[i]
 	}
-	e.io.hdds[0], _ = os.Open("./xv6_testing.img")
+	if disk, err := OpenRawDisk("./xv6_testing.img", true); err == nil {
+		e.io.hdds[0] = disk
+	}
 
 	// main loop
 	var res []RegisterSet
@@ -98,7 +100,7 @@ func ExecEmu() {
 			Esi:    fmt.Sprintf("0x%x", e.getRegister32(ESI)),
 			Edi:    fmt.Sprintf("0x%x", e.getRegister32(EDI)),
 			Eip:    fmt.Sprintf("0x%x", e.eip),
-			Eflags: fmt.Sprintf("0x%x", e.eflags),
+			Eflags: fmt.Sprintf("0x%x", e.eflags.get()),
 			Cs:     fmt.Sprintf("0x%x", e.sreg[CS]),
 			Ss:     fmt.Sprintf("0x%x", e.sreg[SS]),
 			Ds:     fmt.Sprintf("0x%x", e.sreg[DS]),